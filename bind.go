@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/soaska/proxy/internal/egress"
+)
+
+// listenBind opens a BIND listener on an egress address of the family the
+// peer connects from, picked for key. Without a matching family it listens on
+// all addresses of that family.
+func listenBind(ctx context.Context, pool *egress.Pool, key string, peer net.IP) (*net.TCPListener, error) {
+	network := "tcp4"
+	if peer.To4() == nil {
+		network = "tcp6"
+	}
+
+	var host string
+	if ip := pool.Pick(key, peer.To4() == nil); ip != nil {
+		host = ip.String()
+	}
+
+	lc := net.ListenConfig{Control: egress.Control}
+	ln, err := lc.Listen(ctx, network, net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
+
+// bindListener wraps the accepted BIND peer for rate limiting and stats.
+// It keeps the *net.TCPListener so its SetDeadline stays reachable.
+type bindListener struct {
+	*net.TCPListener
+	// peers are the addresses the policy check resolved the peer to
+	peers []net.IP
+	wrap  func(net.Conn) net.Conn
+}
+
+func (l *bindListener) PeerAddrs() []net.IP {
+	return l.peers
+}
+
+func (l *bindListener) WrapPeer(conn net.Conn) net.Conn {
+	return l.wrap(conn)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/soaska/proxy/internal/auth"
+	"github.com/soaska/proxy/internal/database"
+	"github.com/soaska/proxy/internal/policy"
+	"github.com/soaska/proxy/internal/stats"
+)
+
+const usage = `usage: proxy [command] [--config path]
+
+Commands:
+  serve                       run the proxy, the default
+  config check [path]         validate the config and print the effective config
+  users list                  list proxy users
+  users add <name>            add a user, the password is read from stdin
+  users remove <name>         remove a user
+  whitelist test <host:port>  explain the policy decision for a destination
+  stats dump                  print the stored statistics as JSON
+  db migrate                  create or upgrade the stats database schema
+  db vacuum                   compact the stats database
+  db backup <file>            write a copy of the stats database to file
+
+Every command takes --config, config.yml by default.
+`
+
+func main() {
+	// --config may also come before the command
+	global := commandFlags("proxy")
+	if err := global.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+	args := global.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+
+	var code int
+	switch args[0] {
+	case "serve":
+		code = runServeCommand(args[1:])
+	case "config":
+		code = runConfigCommand(args[1:])
+	case "users":
+		code = runUsersCommand(args[1:])
+	case "whitelist":
+		code = runWhitelistCommand(args[1:])
+	case "stats":
+		code = runStatsCommand(args[1:])
+	case "db":
+		code = runDBCommand(args[1:])
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], usage)
+		code = 2
+	}
+	os.Exit(code)
+}
+
+// commandFlags creates the flag set of a subcommand with the --config flag
+func commandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&configPath, "config", configPath, "config file")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	return fs
+}
+
+// parseArgs parses flags anywhere among the arguments and returns the
+// positional ones
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, bool) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, false
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, true
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// usageError prints the usage and returns the exit code for bad arguments
+func usageError(format string, args ...any) int {
+	fmt.Fprintf(os.Stderr, format+"\n\n%s", append(args, usage)...)
+	return 2
+}
+
+func runServeCommand(args []string) int {
+	fs := commandFlags("serve")
+	rest, ok := parseArgs(fs, args)
+	if !ok {
+		return 2
+	}
+	if len(rest) > 0 {
+		return usageError("serve takes no arguments")
+	}
+	serve()
+	return 0
+}
+
+// openDB loads the config and opens the stats database, creating and
+// migrating it if needed
+func openDB() (*sql.DB, error) {
+	if err := loadConfig(); err != nil {
+		return nil, err
+	}
+	return database.InitDB(cfg.Stats.DatabasePath)
+}
+
+func runUsersCommand(args []string) int {
+	fs := commandFlags("users")
+	rest, ok := parseArgs(fs, args)
+	if !ok {
+		return 2
+	}
+	if len(rest) == 0 {
+		return usageError("users needs a subcommand: list, add or remove")
+	}
+	action, rest := rest[0], rest[1:]
+	switch {
+	case action == "list" && len(rest) == 0:
+	case (action == "add" || action == "remove") && len(rest) == 1:
+	default:
+		return usageError("usage: proxy users list | add <name> | remove <name>")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+	store := auth.NewStore(db)
+	ctx := context.Background()
+
+	switch action {
+	case "list":
+		users, err := store.List(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tDISABLED\tCREATED\tLAST LOGIN")
+		for _, u := range users {
+			lastLogin := "-"
+			if u.LastLogin != nil {
+				lastLogin = u.LastLogin.Format(time.DateTime)
+			}
+			fmt.Fprintf(w, "%s\t%t\t%s\t%s\n", u.Username, u.Disabled, u.CreatedAt.Format(time.DateTime), lastLogin)
+		}
+		w.Flush()
+	case "add":
+		password, err := readPassword()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := store.Add(ctx, rest[0], password); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case "remove":
+		if err := store.Remove(ctx, rest[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", rest[0], err)
+			return 1
+		}
+		// A running proxy forgets cached logins within a minute
+		fmt.Fprintf(os.Stderr, "User %s removed\n", rest[0])
+	}
+	return 0
+}
+
+// readPassword reads the first line of stdin, prompting for it on a
+// terminal
+func readPassword() (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Password: ")
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("no password on stdin")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func runWhitelistCommand(args []string) int {
+	fs := commandFlags("whitelist test")
+	network := fs.String("network", "tcp", "tcp or udp")
+	client := fs.String("client", "127.0.0.1", "client address the request comes from")
+	rest, ok := parseArgs(fs, args)
+	if !ok {
+		return 2
+	}
+	if len(rest) != 2 || rest[0] != "test" {
+		return usageError("usage: proxy whitelist test <host:port> [--network tcp|udp] [--client ip]")
+	}
+	if *network != "tcp" && *network != "udp" {
+		return usageError("invalid network %q, expected tcp or udp", *network)
+	}
+	host, portStr, err := net.SplitHostPort(rest[1])
+	if err != nil {
+		return usageError("invalid destination %q: %v", rest[1], err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return usageError("invalid port %q", portStr)
+	}
+
+	if err := loadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	dns, err := buildResolver(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	wl := policy.NewWhitelist()
+	checkIPs(wl, dns)
+	deny, allow, err := buildRules(cfg, wl)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	engine := policy.NewEngine(dns, deny, allow)
+	ctx := context.Background()
+
+	// Every address of a name is checked on its own, show each verdict
+	req := policy.Request{Client: *client, Network: *network, Port: uint16(port)}
+	if net.ParseIP(host) == nil {
+		req.Host = strings.TrimSuffix(strings.ToLower(host), ".")
+		addrs, err := dns.LookupIPAddr(ctx, host)
+		if err != nil {
+			fmt.Printf("%s: failed to resolve: %v\n", host, err)
+		} else {
+			fmt.Printf("%s resolves to:\n", host)
+		}
+		for _, addr := range addrs {
+			r := req
+			r.IP = addr.IP
+			fmt.Printf("  %-39s %s\n", addr.IP, engine.Evaluate(&r).Reason)
+		}
+	}
+
+	d := engine.Allow(ctx, *client, *network, host, uint16(port))
+	if err := d.Error(); err != nil {
+		fmt.Printf("%s %s is denied: %v\n", *network, rest[1], err)
+		return 1
+	}
+	fmt.Printf("%s %s is allowed: %s\n", *network, rest[1], d.Reason)
+	if len(cfg.Upstream.Proxies) > 0 {
+		pool, err := newEgressPool(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		router, err := buildRouter(cfg, pool)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		req.IP = d.Addrs[0]
+		var via []string
+		for _, u := range router.Candidates(&req) {
+			via = append(via, u.Name)
+		}
+		fmt.Printf("via %s\n", strings.Join(via, ", "))
+	}
+	return 0
+}
+
+func runStatsCommand(args []string) int {
+	fs := commandFlags("stats dump")
+	rest, ok := parseArgs(fs, args)
+	if !ok {
+		return 2
+	}
+	if len(rest) != 1 || rest[0] != "dump" {
+		return usageError("usage: proxy stats dump")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	dump, err := stats.NewQuery(db).Dump(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(dump); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func runDBCommand(args []string) int {
+	fs := commandFlags("db")
+	rest, ok := parseArgs(fs, args)
+	if !ok {
+		return 2
+	}
+	switch {
+	case len(rest) == 1 && (rest[0] == "migrate" || rest[0] == "vacuum"):
+	case len(rest) == 2 && rest[0] == "backup":
+	default:
+		return usageError("usage: proxy db migrate | vacuum | backup <file>")
+	}
+
+	// Opening the database runs the migrations
+	db, err := openDB()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	switch rest[0] {
+	case "vacuum":
+		err = database.Vacuum(ctx, db)
+	case "backup":
+		err = database.Backup(ctx, db, rest[1])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
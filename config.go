@@ -1,24 +1,71 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
-	"strconv"
+	"reflect"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/yaml.v3"
-)
 
-const (
-	configPath = "config.yml"
+	"github.com/soaska/proxy/internal/ratelimit"
+	"github.com/soaska/proxy/internal/stats"
 )
 
+// configPath is the config file, set by the --config flag
+var configPath = "config.yml"
+
 type config struct {
-	Listen         string        `yaml:"listen"`
-	Whitelist      []string      `yaml:"whitelist"`
-	UpdateInterval time.Duration `yaml:"refresh_interval"`
-	Subnet         string        `yaml:"subnet"`
-	SubnetMask     int           `yaml:"subnet_mask"`
+	Listen         string        `yaml:"listen" env:"LISTEN"`
+	Whitelist      []string      `yaml:"whitelist" env:"WHITELIST"`
+	UpdateInterval time.Duration `yaml:"refresh_interval" env:"REFRESH_INTERVAL"`
+	ResolvedTTL    time.Duration `yaml:"resolved_ttl" env:"RESOLVED_TTL"`
+	Subnet         string        `yaml:"subnet" env:"SUBNET"`
+	SubnetMask     int           `yaml:"subnet_mask" env:"SUBNET_MASK"`
+
+	// Name resolution for the whitelist and destinations
+	DNS DNSConfig `yaml:"dns"`
+
+	// How source addresses are picked, and optionally from where
+	Egress EgressConfig `yaml:"egress"`
+
+	// Parent proxies and per-destination routing through them
+	Upstream UpstreamConfig `yaml:"upstream"`
+
+	// Optional HTTP CONNECT listener
+	HTTPProxy HTTPProxyConfig `yaml:"http_proxy"`
+
+	// Optional MTProto proxy for Telegram clients
+	MTProto MTProtoConfig `yaml:"mtproto"`
+
+	// Telegram DC table and latency probes
+	Telegram TelegramConfig `yaml:"telegram"`
+
+	// Telegram admin bot
+	Bot BotConfig `yaml:"bot"`
+
+	// Destination policy on top of the whitelist
+	Policy PolicyConfig `yaml:"policy"`
+
+	// Client authentication
+	Auth AuthConfig `yaml:"auth"`
+
+	// Traffic quotas
+	Quotas QuotasConfig `yaml:"quotas"`
+
+	// Connection limits
+	Limits ConnLimitsConfig `yaml:"limits"`
+
+	// Session timeouts
+	Timeouts TimeoutsConfig `yaml:"timeouts"`
+
+	// Bandwidth rate limits
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
 
 	// Stats configuration
 	Stats StatsConfig `yaml:"stats"`
@@ -27,96 +74,350 @@ type config struct {
 	API APIConfig `yaml:"api"`
 }
 
+type DNSConfig struct {
+	// Servers are udp://, tls:// or https:// nameservers tried in order,
+	// /etc/resolv.conf if empty
+	Servers   []string      `yaml:"servers" env:"DNS_SERVERS"`
+	CacheSize int           `yaml:"cache_size" env:"DNS_CACHE_SIZE"`
+	MinTTL    time.Duration `yaml:"min_ttl" env:"DNS_MIN_TTL"`
+	MaxTTL    time.Duration `yaml:"max_ttl" env:"DNS_MAX_TTL"`
+	// Rules resolve matching host names with their own servers
+	Rules []DNSRuleConfig `yaml:"rules"`
+}
+
+type DNSRuleConfig struct {
+	Hosts   []string `yaml:"hosts"`
+	Servers []string `yaml:"servers"`
+}
+
+type EgressConfig struct {
+	// Strategy is random, sticky, round_robin or lru
+	Strategy string `yaml:"strategy" env:"EGRESS_STRATEGY"`
+	// StickyTTL is how long an idle client keeps its sticky address
+	StickyTTL time.Duration `yaml:"sticky_ttl" env:"EGRESS_STICKY_TTL"`
+	// StickyKey identifies sticky clients: client_ip or username
+	StickyKey string `yaml:"sticky_key" env:"EGRESS_STICKY_KEY"`
+	// Addresses replaces subnet with IPs, subnets and interface names
+	Addresses []string `yaml:"addresses" env:"EGRESS_ADDRESSES"`
+}
+
+type UpstreamConfig struct {
+	Proxies []UpstreamProxyConfig `yaml:"proxies"`
+	Routes  []UpstreamRouteConfig `yaml:"routes"`
+	// Default lists the upstreams of destinations matching no route,
+	// direct if empty
+	Default     []string             `yaml:"default"`
+	HealthCheck UpstreamHealthConfig `yaml:"health_check" env:"UPSTREAM_HEALTH_"`
+}
+
+type UpstreamProxyConfig struct {
+	Name string `yaml:"name"`
+	// Type is socks5, http or tailscale
+	Type     string `yaml:"type"`
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Tailscale node, the binary has to be built with -tags tailscale
+	StateDir   string `yaml:"state_dir"`
+	Hostname   string `yaml:"hostname"`
+	AuthKey    string `yaml:"auth_key"`
+	ControlURL string `yaml:"control_url"`
+	ExitNode   string `yaml:"exit_node"`
+}
+
+// UpstreamRouteConfig sends destinations matching the rule through Via,
+// in order of preference
+type UpstreamRouteConfig struct {
+	RuleConfig `yaml:",inline"`
+	Via        []string `yaml:"via"`
+	// HealthTarget is checked through Via instead of the health check
+	// target, so trouble reaching it reorders only this route
+	HealthTarget string `yaml:"health_target"`
+}
+
+type UpstreamHealthConfig struct {
+	// Target is dialed through every upstream to check it
+	Target   string        `yaml:"target" env:"TARGET"`
+	Interval time.Duration `yaml:"interval" env:"INTERVAL"`
+	Timeout  time.Duration `yaml:"timeout" env:"TIMEOUT"`
+}
+
+type HTTPProxyConfig struct {
+	Enabled bool   `yaml:"enabled" env:"HTTP_PROXY_ENABLED"`
+	Listen  string `yaml:"listen" env:"HTTP_PROXY_LISTEN"`
+}
+
+type MTProtoConfig struct {
+	Enabled bool   `yaml:"enabled" env:"MTPROTO_ENABLED"`
+	Listen  string `yaml:"listen" env:"MTPROTO_LISTEN"`
+	// PublicHost is the server address put into tg://proxy links
+	PublicHost string `yaml:"public_host" env:"MTPROTO_PUBLIC_HOST"`
+	// FakeTLSDomain enables fake-TLS (ee secrets), empty for dd secrets
+	FakeTLSDomain string `yaml:"fake_tls_domain" env:"MTPROTO_DOMAIN"`
+	// FrontAddr receives clients failing the fake-TLS handshake,
+	// defaults to the domain on port 443
+	FrontAddr string                `yaml:"front_addr" env:"MTPROTO_FRONT_ADDR"`
+	TimeSkew  time.Duration         `yaml:"time_skew" env:"MTPROTO_TIME_SKEW"`
+	Secrets   []MTProtoSecretConfig `yaml:"secrets"`
+}
+
+type MTProtoSecretConfig struct {
+	// Name is used as the username in stats, quotas and rate limits
+	Name   string `yaml:"name"`
+	Secret string `yaml:"secret"`
+}
+
+type TelegramConfig struct {
+	// DCFile replaces the built-in DC table and is reloaded on change
+	DCFile string `yaml:"dc_file" env:"TELEGRAM_DC_FILE"`
+	// ProbeInterval between DC latency probes, 0 disables them
+	ProbeInterval time.Duration `yaml:"probe_interval" env:"DC_PROBE_INTERVAL"`
+}
+
+type BotConfig struct {
+	// Token from @BotFather, the bot is off without one
+	Token string `yaml:"token" env:"TELEGRAM_BOT_TOKEN"`
+	// AdminIDs are the Telegram user IDs allowed to use the bot
+	AdminIDs []int64 `yaml:"admin_ids" env:"TELEGRAM_ADMIN_IDS"`
+	// APIURL of a self-hosted Bot API server, api.telegram.org if empty
+	APIURL string `yaml:"api_url" env:"TELEGRAM_API_URL"`
+}
+
+type PolicyConfig struct {
+	Deny  []RuleConfig `yaml:"deny"`
+	Allow []RuleConfig `yaml:"allow"`
+}
+
+// RuleConfig describes a single policy rule. All non-empty fields must
+// match for the rule to apply; hosts and cidrs match if either does.
+type RuleConfig struct {
+	Hosts    []string `yaml:"hosts"`
+	CIDRs    []string `yaml:"cidrs"`
+	Ports    []string `yaml:"ports"`
+	Networks []string `yaml:"networks"`
+}
+
+type AuthConfig struct {
+	// Enabled requires SOCKS5 clients to log in with a user from the
+	// stats database.
+	Enabled bool `yaml:"enabled" env:"AUTH_ENABLED"`
+}
+
+type QuotasConfig struct {
+	Enabled       bool          `yaml:"enabled" env:"QUOTAS_ENABLED"`
+	FlushInterval time.Duration `yaml:"flush_interval" env:"QUOTAS_FLUSH_INTERVAL"`
+	// Defaults for users and client IPs without an explicit quota
+	PerUser   QuotaLimitsConfig `yaml:"per_user" env:"QUOTA_PER_USER_"`
+	PerClient QuotaLimitsConfig `yaml:"per_client" env:"QUOTA_PER_CLIENT_"`
+}
+
+type QuotaLimitsConfig struct {
+	Daily   ByteSize `yaml:"daily" env:"DAILY"`
+	Monthly ByteSize `yaml:"monthly" env:"MONTHLY"`
+	Total   ByteSize `yaml:"total" env:"TOTAL"`
+}
+
+func (q QuotaLimitsConfig) limits() stats.QuotaLimits {
+	return stats.QuotaLimits{
+		DailyBytes:   int64(q.Daily),
+		MonthlyBytes: int64(q.Monthly),
+		TotalBytes:   int64(q.Total),
+	}
+}
+
+type ConnLimitsConfig struct {
+	MaxConns      int `yaml:"max_conns" env:"MAX_CONNS"`
+	MaxConnsPerIP int `yaml:"max_conns_per_ip" env:"MAX_CONNS_PER_IP"`
+	// New connections per second from a single IP
+	ConnRatePerIP  float64 `yaml:"conn_rate_per_ip" env:"CONN_RATE_PER_IP"`
+	ConnBurstPerIP int     `yaml:"conn_burst_per_ip" env:"CONN_BURST_PER_IP"`
+}
+
+type TimeoutsConfig struct {
+	Handshake   time.Duration `yaml:"handshake" env:"HANDSHAKE_TIMEOUT"`
+	Idle        time.Duration `yaml:"idle" env:"IDLE_TIMEOUT"`
+	MaxLifetime time.Duration `yaml:"max_lifetime" env:"MAX_LIFETIME"`
+	// Idle time after which the socket of a UDP association to a single
+	// target is closed
+	UDPTarget time.Duration `yaml:"udp_target" env:"UDP_TARGET_TIMEOUT"`
+}
+
+type RateLimitConfig struct {
+	Enabled       bool             `yaml:"enabled" env:"RATE_LIMIT_ENABLED"`
+	Global        RateLimitsConfig `yaml:"global" env:"RATE_LIMIT_GLOBAL_"`
+	PerClient     RateLimitsConfig `yaml:"per_client" env:"RATE_LIMIT_PER_CLIENT_"`
+	PerConnection RateLimitsConfig `yaml:"per_connection" env:"RATE_LIMIT_PER_CONNECTION_"`
+	// Per-user limits replace per_client limits for that user
+	PerUser map[string]RateLimitsConfig `yaml:"per_user"`
+}
+
+// RateLimitsConfig holds rates in bytes per second
+type RateLimitsConfig struct {
+	Upload   ByteSize `yaml:"upload" env:"UPLOAD"`
+	Download ByteSize `yaml:"download" env:"DOWNLOAD"`
+	Burst    ByteSize `yaml:"burst" env:"BURST"`
+}
+
+func (r RateLimitsConfig) limits() ratelimit.Limits {
+	return ratelimit.Limits{
+		Upload:   int64(r.Upload),
+		Download: int64(r.Download),
+		Burst:    int64(r.Burst),
+	}
+}
+
+func (r RateLimitConfig) limiterConfig() ratelimit.Config {
+	perUser := make(map[string]ratelimit.Limits, len(r.PerUser))
+	for username, limits := range r.PerUser {
+		perUser[username] = limits.limits()
+	}
+	return ratelimit.Config{
+		Global:        r.Global.limits(),
+		PerClient:     r.PerClient.limits(),
+		PerConnection: r.PerConnection.limits(),
+		PerUser:       perUser,
+	}
+}
+
 type StatsConfig struct {
-	Enabled       bool   `yaml:"enabled"`
-	DatabasePath  string `yaml:"database_path"`
-	GeoIPPath     string `yaml:"geoip_path"`
-	RetentionDays int    `yaml:"retention_days"`
+	Enabled       bool   `yaml:"enabled" env:"STATS_ENABLED"`
+	DatabasePath  string `yaml:"database_path" env:"STATS_DATABASE_PATH"`
+	GeoIPPath     string `yaml:"geoip_path" env:"STATS_GEOIP_PATH"`
+	RetentionDays int    `yaml:"retention_days" env:"STATS_RETENTION_DAYS"`
 }
 
 type APIConfig struct {
-	Enabled     bool     `yaml:"enabled"`
-	Listen      string   `yaml:"listen"`
-	APIKey      string   `yaml:"api_key"`
-	CORSOrigins []string `yaml:"cors_origins"`
+	Enabled     bool     `yaml:"enabled" env:"API_ENABLED"`
+	Listen      string   `yaml:"listen" env:"API_LISTEN"`
+	APIKey      string   `yaml:"api_key" env:"API_KEY"`
+	CORSOrigins []string `yaml:"cors_origins" env:"API_CORS_ORIGINS"`
 }
 
+// cfg is the configuration the process started with. Settings that are
+// reloaded at runtime are read through currentConfig.
 var cfg *config
 
+// liveConfig is the last configuration that was applied
+var liveConfig atomic.Pointer[config]
+
+func currentConfig() *config {
+	return liveConfig.Load()
+}
+
 func loadConfig() error {
-	// Initialize with defaults
-	cfg = &config{
+	c, err := readConfig(configPath)
+	if err != nil {
+		return err
+	}
+	cfg = c
+	liveConfig.Store(c)
+	return nil
+}
+
+// defaultConfig returns the settings used when neither the config file
+// nor the environment sets them
+func defaultConfig() *config {
+	return &config{
 		Listen:         ":6666",
 		UpdateInterval: time.Minute,
+		ResolvedTTL:    time.Hour,
+		DNS: DNSConfig{
+			CacheSize: 10000,
+			MaxTTL:    time.Hour,
+		},
+		Egress: EgressConfig{
+			Strategy:  "random",
+			StickyTTL: 30 * time.Minute,
+			StickyKey: "client_ip",
+		},
+		Upstream: UpstreamConfig{
+			HealthCheck: UpstreamHealthConfig{
+				Target:   "149.154.167.51:443",
+				Interval: 30 * time.Second,
+				Timeout:  5 * time.Second,
+			},
+		},
+		HTTPProxy: HTTPProxyConfig{
+			Listen: ":8118",
+		},
+		Telegram: TelegramConfig{
+			ProbeInterval: 5 * time.Minute,
+		},
+		MTProto: MTProtoConfig{
+			Listen:   ":443",
+			TimeSkew: 5 * time.Minute,
+		},
 		Stats: StatsConfig{
 			Enabled:       true,
 			DatabasePath:  "./data/stats.db",
 			GeoIPPath:     "./data/GeoLite2-City.mmdb",
 			RetentionDays: 90,
 		},
+		Timeouts: TimeoutsConfig{
+			Handshake: 10 * time.Second,
+			Idle:      5 * time.Minute,
+			UDPTarget: 2 * time.Minute,
+		},
+		Quotas: QuotasConfig{
+			FlushInterval: 30 * time.Second,
+		},
 		API: APIConfig{
 			Enabled: true,
 			Listen:  ":8080",
 		},
 	}
+}
+
+// readConfig reads the config file at path over the defaults, applies the
+// environment overrides and validates the result. Unknown keys are
+// errors, and so is every invalid value, reported with its line or
+// environment variable.
+func readConfig(path string) (*config, error) {
+	c := defaultConfig()
 
 	// Load from file if exists
-	f, err := os.Open(configPath)
-	if err == nil {
-		defer f.Close()
-		if err := yaml.NewDecoder(f).Decode(cfg); err != nil {
-			return fmt.Errorf("failed to decode config file: %w", err)
+	var root *yaml.Node
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		root = &yaml.Node{}
+		if err := yaml.Unmarshal(data, root); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", path, err)
 		}
-	}
-
-	// Override with environment variables
-	applyEnvOverrides()
-
-	return nil
-}
-
-func applyEnvOverrides() {
-	if v := os.Getenv("LISTEN"); v != "" {
-		cfg.Listen = v
-	}
-	if v := os.Getenv("SUBNET"); v != "" {
-		cfg.Subnet = v
-	}
-	if v := os.Getenv("SUBNET_MASK"); v != "" {
-		if mask, err := strconv.Atoi(v); err == nil {
-			cfg.SubnetMask = mask
+		var unknown configErrors
+		unknownKeys(root, reflect.TypeFor[config](), "", &unknown)
+		if len(unknown) > 0 {
+			for i := range unknown {
+				unknown[i].File = path
+			}
+			return nil, unknown
 		}
-	}
-	if v := os.Getenv("REFRESH_INTERVAL"); v != "" {
-		if d, err := time.ParseDuration(v); err == nil {
-			cfg.UpdateInterval = d
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			var typeErr *yaml.TypeError
+			if errors.As(err, &typeErr) {
+				errs := typeErrors(root, typeErr)
+				for i := range errs {
+					errs[i].File = path
+				}
+				return nil, errs
+			}
+			return nil, fmt.Errorf("failed to decode %s: %w", path, err)
 		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
 	}
 
-	// Stats
-	if v := os.Getenv("STATS_ENABLED"); v != "" {
-		cfg.Stats.Enabled = v == "true" || v == "1"
-	}
-	if v := os.Getenv("STATS_DATABASE_PATH"); v != "" {
-		cfg.Stats.DatabasePath = v
-	}
-	if v := os.Getenv("STATS_GEOIP_PATH"); v != "" {
-		cfg.Stats.GeoIPPath = v
-	}
-	if v := os.Getenv("STATS_RETENTION_DAYS"); v != "" {
-		if days, err := strconv.Atoi(v); err == nil {
-			cfg.Stats.RetentionDays = days
-		}
-	}
+	// Override with environment variables
+	env := &envOverrides{sources: map[string]string{}}
+	c.applyEnvOverrides(env)
 
-	// API
-	if v := os.Getenv("API_ENABLED"); v != "" {
-		cfg.API.Enabled = v == "true" || v == "1"
-	}
-	if v := os.Getenv("API_LISTEN"); v != "" {
-		cfg.API.Listen = v
-	}
-	if v := os.Getenv("API_KEY"); v != "" {
-		cfg.API.APIKey = v
+	errs := append(env.errs, c.validate()...)
+	if len(errs) > 0 {
+		errs.locate(path, root, env.sources)
+		return nil, errs
 	}
+	return c, nil
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// runConfigCommand runs "config check", which validates a config file
+// with the environment overrides and prints the effective config with
+// secrets redacted
+func runConfigCommand(args []string) int {
+	fs := commandFlags("config check")
+	rest, ok := parseArgs(fs, args)
+	if !ok {
+		return 2
+	}
+	if len(rest) == 0 || rest[0] != "check" || len(rest) > 2 {
+		return usageError("usage: proxy config check [path]")
+	}
+	path := configPath
+	if len(rest) == 2 {
+		path = rest[1]
+	}
+
+	c, err := readConfig(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var doc yaml.Node
+	if err := doc.Encode(c); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	redactSecrets(&doc)
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	enc.Close()
+	fmt.Fprintf(os.Stderr, "%s: OK\n", path)
+	return 0
+}
+
+// redactSecrets replaces the values of secretKeys in a yaml tree
+func redactSecrets(n *yaml.Node) {
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			if secretKeys[key.Value] && value.Kind == yaml.ScalarNode && value.Value != "" {
+				value.Value = "<redacted>"
+				value.Style = 0
+				continue
+			}
+			redactSecrets(value)
+		}
+		return
+	}
+	for _, child := range n.Content {
+		redactSecrets(child)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/soaska/proxy/internal/egress"
+	"github.com/soaska/proxy/internal/resolver"
+	"github.com/soaska/proxy/internal/session"
+)
+
+// newEgressPool builds the source address pool from egress.addresses, or
+// from subnet/subnet_mask when no list is configured
+func newEgressPool(c *config) (*egress.Pool, error) {
+	strategy, err := egress.ParseStrategy(c.Egress.Strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	var pool *egress.Pool
+	if len(c.Egress.Addresses) > 0 {
+		pool, err = egress.NewPoolFromList(c.Egress.Addresses)
+	} else {
+		pool, err = egress.NewPool(c.Subnet, c.SubnetMask)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pool.SetStrategy(strategy, c.Egress.StickyTTL)
+	return pool, nil
+}
+
+// egressKey identifies the client of ctx for sticky source addresses
+func egressKey(ctx context.Context) string {
+	if currentConfig().Egress.StickyKey == "username" {
+		if username := session.Username(ctx); username != "" {
+			return "user:" + username
+		}
+	}
+	return "ip:" + sessionClientIP(ctx)
+}
+
+// dialFromPool dials addr from an egress address picked for key, without
+// policy checks or stats. Destinations of a family the pool has no
+// addresses of are dialed from the default source.
+func dialFromPool(ctx context.Context, pool *egress.Pool, key, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Control: egress.Control}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			if localIP := pool.Pick(key, ip.To4() == nil); localIP != nil {
+				switch network {
+				case "udp", "udp4", "udp6":
+					dialer.LocalAddr = &net.UDPAddr{IP: localIP}
+				default:
+					dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+				}
+			}
+		}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// dialHostFromPool is dialFromPool for a host name, resolved with dns. The
+// addresses are raced happy eyeballs style like destinations.
+func dialHostFromPool(ctx context.Context, dns *resolver.Mux, pool *egress.Pool, key, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, _, err = dns.LookupTTL(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	conn, _, err := resolver.DialParallel(ctx, destinationAddrs(ips, pool), pool.IsIPv6(), func(attemptCtx context.Context, ip net.IP) (net.Conn, error) {
+		return dialFromPool(attemptCtx, pool, key, network+ipFamily(ip), net.JoinHostPort(ip.String(), port))
+	})
+	return conn, err
+}
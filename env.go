@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envOverrides reads environment variables overriding settings. It
+// remembers which settings they replaced and which values were invalid.
+type envOverrides struct {
+	sources map[string]string
+	errs    configErrors
+}
+
+// lookup returns the value of the variable name, which overrides the
+// setting at path. NAME_FILE names a file holding the value instead, as
+// with Docker secrets.
+func (e *envOverrides) lookup(name, path string) (string, bool) {
+	v := os.Getenv(name)
+	file := os.Getenv(name + "_FILE")
+	switch {
+	case file != "" && v != "":
+		e.fail(name, path, fmt.Errorf("both %s and %s_FILE are set", name, name))
+		return "", false
+	case file != "":
+		e.sources[path] = name + "_FILE"
+		data, err := os.ReadFile(file)
+		if err != nil {
+			e.fail(name+"_FILE", path, err)
+			return "", false
+		}
+		return strings.TrimRight(string(data), "\r\n"), true
+	case v != "":
+		e.sources[path] = name
+		return v, true
+	}
+	return "", false
+}
+
+func (e *envOverrides) fail(name, path string, err error) {
+	e.errs = append(e.errs, configError{Path: path, Env: name, Msg: err.Error()})
+}
+
+// apply sets the fields of struct v from the variables named by their env
+// tags. The tag of a section ending in "_" prefixes the tags of its
+// fields, so a section type can be used more than once.
+func (e *envOverrides) apply(v reflect.Value, path, prefix string) {
+	t := v.Type()
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		p := path
+		if opts != "inline" {
+			if path != "" {
+				p += "."
+			}
+			p += name
+		}
+
+		tag := f.Tag.Get("env")
+		if isSection(f.Type) {
+			if strings.HasSuffix(tag, "_") || tag == "" {
+				e.apply(v.Field(i), p, prefix+tag)
+			}
+			continue
+		}
+		if tag == "" {
+			continue
+		}
+		if s, ok := e.lookup(prefix+tag, p); ok {
+			if err := setFromEnv(v.Field(i), s); err != nil {
+				e.fail(e.sources[p], p, err)
+			}
+		}
+	}
+}
+
+// isSection reports whether t is a config section rather than a value
+func isSection(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != reflect.TypeFor[time.Duration]()
+}
+
+var errUnsupportedEnv = errors.New("setting cannot be set from the environment")
+
+// setFromEnv parses s into the setting f. Lists are comma-separated.
+func setFromEnv(f reflect.Value, s string) error {
+	switch dst := f.Addr().Interface().(type) {
+	case *time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*dst = d
+		return nil
+	case *ByteSize:
+		size, err := ParseByteSize(s)
+		if err != nil {
+			return err
+		}
+		*dst = size
+		return nil
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		f.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		f.SetFloat(n)
+	case reflect.Slice:
+		var items []string
+		for item := range strings.SplitSeq(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		list := reflect.MakeSlice(f.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setFromEnv(list.Index(i), item); err != nil {
+				return err
+			}
+		}
+		f.Set(list)
+	default:
+		return errUnsupportedEnv
+	}
+	return nil
+}
+
+// applyEnvOverrides sets the tagged settings from the environment, and
+// the lists of sections that are set from a single variable
+func (c *config) applyEnvOverrides(env *envOverrides) {
+	env.apply(reflect.ValueOf(c).Elem(), "", "")
+
+	// Upstream
+	if v, ok := env.lookup("UPSTREAM_PROXY", "upstream.proxies"); ok {
+		env.sources["upstream.default"] = env.sources["upstream.proxies"]
+		if u, err := url.Parse(v); err != nil || u.Host == "" {
+			env.fail(env.sources["upstream.proxies"], "upstream.proxies", errors.New("invalid proxy URL"))
+		} else {
+			p := UpstreamProxyConfig{Name: "upstream", Type: u.Scheme, Address: u.Host}
+			if u.User != nil {
+				p.Username = u.User.Username()
+				p.Password, _ = u.User.Password()
+			}
+			c.Upstream.Proxies = []UpstreamProxyConfig{p}
+			c.Upstream.Default = []string{p.Name, "direct"}
+		}
+	}
+
+	// MTProto
+	if v, ok := env.lookup("MTPROTO_SECRET", "mtproto.secrets"); ok {
+		c.MTProto.Secrets = []MTProtoSecretConfig{{Name: "default", Secret: v}}
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/soaska/proxy/internal/stats"
+	"github.com/soaska/proxy/internal/telegram"
+)
+
+type DCUsage struct {
+	telegram.DC
+	stats.DCTraffic
+	Probes []telegram.Probe `json:"probes,omitempty"`
+}
+
+type DCsResponse struct {
+	DCs []DCUsage `json:"dcs"`
+	// Connections to Telegram addresses outside the DC table
+	OtherConnections int64 `json:"other_connections"`
+}
+
+// SetTelegram enables the DC endpoint. prober may be nil.
+func (s *Server) SetTelegram(dcs *telegram.DCMap, prober *telegram.Prober) {
+	s.dcs = dcs
+	s.dcProber = prober
+}
+
+// handleDCStats returns traffic and the latest latency probes per DC
+func (s *Server) handleDCStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.dcs == nil {
+		respondError(w, http.StatusNotFound, "DC map is not available")
+		return
+	}
+
+	ctx := r.Context()
+	usage, err := s.query.DCTraffic(ctx)
+	if err != nil {
+		log.Printf("[API] Failed to fetch DC stats: %v", err)
+		respondError(w, http.StatusInternalServerError, "failed to fetch DC stats")
+		return
+	}
+
+	probes := make(map[int][]telegram.Probe)
+	if s.dcProber != nil {
+		latest, err := s.dcProber.GetLatest(ctx)
+		if err != nil {
+			log.Printf("[API] Failed to query DC probes: %v", err)
+		}
+		for _, p := range latest {
+			probes[p.DCID] = append(probes[p.DCID], p)
+		}
+	}
+
+	resp := DCsResponse{OtherConnections: usage[0].Connections}
+	for _, dc := range s.dcs.DCs() {
+		resp.DCs = append(resp.DCs, DCUsage{DC: dc, DCTraffic: usage[dc.ID], Probes: probes[dc.ID]})
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/soaska/proxy/internal/stats"
+)
+
+type QuotasResponse struct {
+	Quotas []stats.QuotaUsage `json:"quotas"`
+}
+
+// handleQuotas manages explicit traffic quotas: GET lists with usage,
+// POST/PUT sets limits, DELETE removes a quota or, with reset=1, its usage.
+func (s *Server) handleQuotas(w http.ResponseWriter, r *http.Request) {
+	quotas := s.collector.Quotas()
+	if quotas == nil {
+		respondError(w, http.StatusNotFound, "quotas are disabled")
+		return
+	}
+
+	ctx := r.Context()
+
+	switch r.Method {
+	case http.MethodGet:
+		list, err := quotas.ListQuotas(ctx)
+		if err != nil {
+			log.Printf("[API] Failed to list quotas: %v", err)
+			respondError(w, http.StatusInternalServerError, "failed to list quotas")
+			return
+		}
+		writeJSON(w, QuotasResponse{Quotas: list})
+
+	case http.MethodPost, http.MethodPut:
+		var req stats.Quota
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		req.Subject = strings.TrimSpace(req.Subject)
+		if err := quotas.SetQuota(ctx, req); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, map[string]string{"status": "saved"})
+
+	case http.MethodDelete:
+		query := r.URL.Query()
+		subjectType := query.Get("subject_type")
+		subject := strings.TrimSpace(query.Get("subject"))
+		if subjectType == "" || subject == "" {
+			respondError(w, http.StatusBadRequest, "subject_type and subject parameters are required")
+			return
+		}
+
+		var err error
+		if query.Get("reset") == "1" {
+			err = quotas.ResetUsage(ctx, subjectType, subject)
+		} else {
+			err = quotas.DeleteQuota(ctx, subjectType, subject)
+		}
+		if err != nil {
+			log.Printf("[API] Failed to update quota: %v", err)
+			respondError(w, http.StatusInternalServerError, "failed to update quota")
+			return
+		}
+		writeJSON(w, map[string]string{"status": "deleted"})
+
+	default:
+		respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
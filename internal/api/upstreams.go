@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/soaska/proxy/internal/upstream"
+)
+
+type UpstreamsResponse struct {
+	Upstreams []upstream.Status `json:"upstreams"`
+}
+
+// SetUpstreams enables the upstream health endpoint
+func (s *Server) SetUpstreams(router *upstream.Router) {
+	s.upstreams = router
+}
+
+// handleUpstreams returns the health of the direct path and every parent proxy
+func (s *Server) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.upstreams == nil {
+		respondError(w, http.StatusNotFound, "upstreams are not available")
+		return
+	}
+
+	resp := UpstreamsResponse{Upstreams: []upstream.Status{}}
+	for _, u := range s.upstreams.Upstreams() {
+		resp.Upstreams = append(resp.Upstreams, u.Status())
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/soaska/proxy/internal/auth"
+)
+
+type UserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Disabled *bool  `json:"disabled,omitempty"`
+}
+
+type UsersResponse struct {
+	Users []auth.User `json:"users"`
+}
+
+// handleUsers manages proxy users: GET lists, POST creates,
+// PUT changes password or disabled flag, DELETE removes.
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	if s.users == nil {
+		respondError(w, http.StatusNotFound, "authentication is disabled")
+		return
+	}
+
+	ctx := r.Context()
+
+	switch r.Method {
+	case http.MethodGet:
+		users, err := s.users.List(ctx)
+		if err != nil {
+			log.Printf("[API] Failed to list users: %v", err)
+			respondError(w, http.StatusInternalServerError, "failed to list users")
+			return
+		}
+		writeJSON(w, UsersResponse{Users: users})
+
+	case http.MethodPost:
+		var req UserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if err := s.users.Add(ctx, strings.TrimSpace(req.Username), req.Password); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, map[string]string{"status": "created"})
+
+	case http.MethodPut:
+		var req UserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.Password != "" {
+			if err := s.users.SetPassword(ctx, req.Username, req.Password); err != nil {
+				respondUserError(w, err)
+				return
+			}
+		}
+		if req.Disabled != nil {
+			if err := s.users.SetDisabled(ctx, req.Username, *req.Disabled); err != nil {
+				respondUserError(w, err)
+				return
+			}
+		}
+		writeJSON(w, map[string]string{"status": "updated"})
+
+	case http.MethodDelete:
+		username := strings.TrimSpace(r.URL.Query().Get("username"))
+		if username == "" {
+			respondError(w, http.StatusBadRequest, "username parameter is required")
+			return
+		}
+		if err := s.users.Remove(ctx, username); err != nil {
+			respondUserError(w, err)
+			return
+		}
+		writeJSON(w, map[string]string{"status": "deleted"})
+
+	default:
+		respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func respondUserError(w http.ResponseWriter, err error) {
+	if errors.Is(err, auth.ErrUserNotFound) {
+		respondError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	log.Printf("[API] Failed to update user: %v", err)
+	respondError(w, http.StatusBadRequest, err.Error())
+}
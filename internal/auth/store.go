@@ -0,0 +1,247 @@
+// Package auth manages proxy user credentials stored in the stats database.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// verifyCacheTTL is how long a successful password check is remembered.
+// Hash verification is deliberately slow, while Telegram clients open many
+// short connections with the same credentials.
+const verifyCacheTTL = time.Minute
+
+var (
+	// ErrInvalidCredentials is returned for unknown users and wrong passwords
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrUserDisabled is returned when the user exists but is disabled
+	ErrUserDisabled = errors.New("user disabled")
+	// ErrUserNotFound is returned by management calls for unknown users
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// User is a proxy user record
+type User struct {
+	ID        int64      `json:"id"`
+	Username  string     `json:"username"`
+	Disabled  bool       `json:"disabled"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastLogin *time.Time `json:"last_login,omitempty"`
+}
+
+// Store keeps users in the `users` table
+type Store struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	cache map[string]cachedLogin
+}
+
+type cachedLogin struct {
+	digest    [sha256.Size]byte
+	expiresAt time.Time
+}
+
+// NewStore creates a user store on top of db
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db:    db,
+		cache: make(map[string]cachedLogin),
+	}
+}
+
+// Authenticate checks username and password. It returns
+// ErrInvalidCredentials or ErrUserDisabled on failure.
+func (s *Store) Authenticate(ctx context.Context, username, password string) error {
+	digest := sha256.Sum256([]byte(username + "\x00" + password))
+
+	s.mu.Lock()
+	cached, ok := s.cache[username]
+	s.mu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) && subtle.ConstantTimeCompare(cached.digest[:], digest[:]) == 1 {
+		return nil
+	}
+
+	var hash string
+	var disabled bool
+	err := s.db.QueryRowContext(ctx,
+		`SELECT password_hash, disabled FROM users WHERE username = ?`,
+		username,
+	).Scan(&hash, &disabled)
+	if err == sql.ErrNoRows {
+		return ErrInvalidCredentials
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load user: %w", err)
+	}
+
+	if !VerifyPassword(hash, password) {
+		return ErrInvalidCredentials
+	}
+	if disabled {
+		return ErrUserDisabled
+	}
+
+	s.mu.Lock()
+	s.cache[username] = cachedLogin{digest: digest, expiresAt: time.Now().Add(verifyCacheTTL)}
+	s.mu.Unlock()
+
+	if _, err := s.db.ExecContext(ctx,
+		`UPDATE users SET last_login = ? WHERE username = ?`, time.Now(), username,
+	); err != nil {
+		log.Printf("[AUTH] Failed to update last login for %s: %v", username, err)
+	}
+
+	return nil
+}
+
+// Add creates a user with the given password
+func (s *Store) Add(ctx context.Context, username, password string) error {
+	if username == "" || len(username) > 255 {
+		return fmt.Errorf("username must be 1-255 bytes long")
+	}
+	if password == "" || len(password) > 255 {
+		return fmt.Errorf("password must be 1-255 bytes long")
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO users (username, password_hash, disabled, created_at) VALUES (?, ?, 0, ?)`,
+		username, hash, time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add user: %w", err)
+	}
+
+	log.Printf("[AUTH] User %s added", username)
+	return nil
+}
+
+// SetPassword replaces the password of an existing user
+func (s *Store) SetPassword(ctx context.Context, username, password string) error {
+	if password == "" || len(password) > 255 {
+		return fmt.Errorf("password must be 1-255 bytes long")
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return s.update(ctx, username, `UPDATE users SET password_hash = ? WHERE username = ?`, hash, username)
+}
+
+// SetDisabled disables or re-enables a user without deleting it
+func (s *Store) SetDisabled(ctx context.Context, username string, disabled bool) error {
+	return s.update(ctx, username, `UPDATE users SET disabled = ? WHERE username = ?`, disabled, username)
+}
+
+// Remove deletes a user
+func (s *Store) Remove(ctx context.Context, username string) error {
+	return s.update(ctx, username, `DELETE FROM users WHERE username = ?`, username)
+}
+
+// List returns all users ordered by name
+func (s *Store) List(ctx context.Context) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, username, disabled, created_at, last_login FROM users ORDER BY username`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		var lastLogin sql.NullTime
+		if err := rows.Scan(&u.ID, &u.Username, &u.Disabled, &u.CreatedAt, &lastLogin); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		if lastLogin.Valid {
+			u.LastLogin = &lastLogin.Time
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *Store) update(ctx context.Context, username, query string, args ...any) error {
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update user %s: %w", username, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+
+	// Drop cached logins so the change applies to the next connection
+	s.mu.Lock()
+	delete(s.cache, username)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// HashPassword hashes password with bcrypt
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// VerifyPassword checks password against a bcrypt hash or an argon2id hash
+// in PHC format ($argon2id$v=19$m=65536,t=3,p=4$salt$hash).
+func VerifyPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return verifyArgon2id(hash, password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func verifyArgon2id(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	got := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
@@ -0,0 +1,294 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soaska/proxy/internal/speedtest"
+	"github.com/soaska/proxy/internal/stats"
+)
+
+// DefaultAPIURL is the Telegram Bot API server
+const DefaultAPIURL = "https://api.telegram.org"
+
+const (
+	// pollTimeout is how long a getUpdates call waits for updates
+	pollTimeout = 30 * time.Second
+	// retryDelay is the pause after a failed getUpdates call
+	retryDelay = 5 * time.Second
+	// maxHandlers is how many commands run at once, polling waits for a
+	// free slot beyond that
+	maxHandlers = 4
+)
+
+// Stats are the statistics the bot reports, *stats.Query implements it
+type Stats interface {
+	PublicStats(ctx context.Context) (*stats.PublicStatsResponse, error)
+	Traffic(ctx context.Context) (*stats.TrafficSummary, error)
+	Countries(ctx context.Context, limit int) (*stats.CountryBreakdown, error)
+	Recent(ctx context.Context, limit int) ([]stats.RecentConnection, error)
+	Today(ctx context.Context, now time.Time) (*stats.TodayStats, error)
+	Week(ctx context.Context, now time.Time) (*stats.WeekStats, error)
+	Peak(ctx context.Context, window time.Duration) (*stats.PeakUsage, error)
+	Compare(ctx context.Context, now time.Time) (*stats.Comparison, error)
+	CountryDetail(ctx context.Context, code string) (*stats.CountryDetail, error)
+	Snapshot(ctx context.Context) (*stats.Snapshot, error)
+	Info(ctx context.Context) (*stats.ServerInfo, error)
+}
+
+// Bot is a Telegram admin bot on the Bot API with long polling. Only the
+// admins may use it, in private chats and groups alike.
+type Bot struct {
+	token     string
+	apiURL    string
+	client    *http.Client
+	stats     Stats
+	speedtest *speedtest.Service
+
+	mu       sync.RWMutex
+	adminIDs []int64
+}
+
+// NewBot creates a bot. st may be nil, then the speedtest commands are
+// unavailable.
+func NewBot(token string, adminIDs []int64, statsSource Stats, st *speedtest.Service) *Bot {
+	b := &Bot{
+		token:     token,
+		apiURL:    DefaultAPIURL,
+		client:    &http.Client{Timeout: pollTimeout + 10*time.Second},
+		stats:     statsSource,
+		speedtest: st,
+		adminIDs:  adminIDs,
+	}
+	if st != nil {
+		st.SetNotifyCallback(b.notifySpeedtest)
+	}
+	return b
+}
+
+// SetAPIURL replaces the Bot API server, such as a local one
+func (b *Bot) SetAPIURL(apiURL string) {
+	b.apiURL = strings.TrimSuffix(apiURL, "/")
+}
+
+// SetAdmins replaces the Telegram user IDs allowed to use the bot
+func (b *Bot) SetAdmins(ids []int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.adminIDs = ids
+}
+
+func (b *Bot) admins() []int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.adminIDs
+}
+
+func (b *Bot) isAdmin(id int64) bool {
+	return slices.Contains(b.admins(), id)
+}
+
+// Run polls for updates and answers commands until ctx is done, then
+// waits for the commands still running
+func (b *Bot) Run(ctx context.Context) {
+	var me user
+	if err := b.call(ctx, "getMe", nil, &me); err != nil {
+		log.Printf("[BOT] Failed to reach the Bot API: %v", err)
+	} else {
+		log.Printf("[BOT] Started as @%s", me.Username)
+	}
+	if len(b.admins()) == 0 {
+		log.Println("[BOT] No admin_ids configured, every command will be ignored")
+	}
+	if err := b.call(ctx, "setMyCommands", map[string]any{"commands": commandList}, nil); err != nil && ctx.Err() == nil {
+		log.Printf("[BOT] Failed to set the command list: %v", err)
+	}
+
+	// A slow command must not hold up the others
+	sem := make(chan struct{}, maxHandlers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	offset := int64(0)
+	for {
+		var updates []update
+		err := b.call(ctx, "getUpdates", map[string]any{
+			"offset":          offset,
+			"timeout":         int(pollTimeout.Seconds()),
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("[BOT] Failed to get updates: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryDelay):
+			}
+			continue
+		}
+
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message == nil {
+				continue
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				b.handleMessage(ctx, u.Message)
+			}()
+		}
+	}
+}
+
+// Bot API types, only the fields the bot uses
+
+type update struct {
+	UpdateID int64    `json:"update_id"`
+	Message  *message `json:"message"`
+}
+
+type message struct {
+	MessageID int64  `json:"message_id"`
+	From      *user  `json:"from"`
+	Chat      chat   `json:"chat"`
+	Text      string `json:"text"`
+}
+
+type user struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type chat struct {
+	ID int64 `json:"id"`
+}
+
+type botCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+type apiResponse struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+}
+
+// call invokes a Bot API method with a JSON body and decodes its result
+// into result, which may be nil
+func (b *Bot) call(ctx context.Context, method string, params any, result any) error {
+	if params == nil {
+		params = struct{}{}
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.methodURL(method), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return b.do(req, method, result)
+}
+
+// sendDocument uploads data as a file named name
+func (b *Bot) sendDocument(ctx context.Context, chatID int64, name string, data []byte) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("chat_id", strconv.FormatInt(chatID, 10))
+	fw, err := mw.CreateFormFile("document", name)
+	if err != nil {
+		return err
+	}
+	fw.Write(data)
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.methodURL("sendDocument"), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return b.do(req, "sendDocument", nil)
+}
+
+func (b *Bot) methodURL(method string) string {
+	return b.apiURL + "/bot" + b.token + "/" + method
+}
+
+func (b *Bot) do(req *http.Request, method string, result any) error {
+	resp, err := b.client.Do(req)
+	if err != nil {
+		// The error names the URL, which holds the token
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	var r apiResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&r); err != nil {
+		return fmt.Errorf("%s: %s: invalid response: %w", method, resp.Status, err)
+	}
+	if !r.OK {
+		return fmt.Errorf("%s: %d %s", method, r.ErrorCode, r.Description)
+	}
+	if result != nil {
+		if err := json.Unmarshal(r.Result, result); err != nil {
+			return fmt.Errorf("%s: invalid result: %w", method, err)
+		}
+	}
+	return nil
+}
+
+// send sends an HTML message to a chat
+func (b *Bot) send(ctx context.Context, chatID int64, text string) {
+	err := b.call(ctx, "sendMessage", map[string]any{
+		"chat_id":                  chatID,
+		"text":                     text,
+		"parse_mode":               "HTML",
+		"disable_web_page_preview": true,
+	}, nil)
+	if err != nil && ctx.Err() == nil {
+		log.Printf("[BOT] Failed to send message to %d: %v", chatID, err)
+	}
+}
+
+// notifySpeedtest sends a finished speedtest to every admin
+func (b *Bot) notifySpeedtest(result *speedtest.Result, triggeredBy, triggeredIP, triggeredCountry string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	text := formatSpeedtest(result, triggeredBy, triggeredIP, triggeredCountry)
+	for _, id := range b.admins() {
+		b.send(ctx, id, text)
+	}
+}
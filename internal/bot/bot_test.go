@@ -0,0 +1,158 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPI is a Bot API server serving a fixed batch of updates
+type fakeAPI struct {
+	t       *testing.T
+	updates []update
+
+	mu      sync.Mutex
+	offsets []int64
+	sent    []map[string]any
+	sentCh  chan struct{}
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method, ok := strings.CutPrefix(r.URL.Path, "/bottest-token/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var params map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		f.t.Errorf("%s: invalid body: %v", method, err)
+	}
+
+	var result any = true
+	switch method {
+	case "getMe":
+		result = user{ID: 1, Username: "test_bot"}
+	case "getUpdates":
+		f.mu.Lock()
+		offset := int64(params["offset"].(float64))
+		f.offsets = append(f.offsets, offset)
+		f.mu.Unlock()
+
+		var batch []update
+		for _, u := range f.updates {
+			if u.UpdateID >= offset {
+				batch = append(batch, u)
+			}
+		}
+		if len(batch) == 0 {
+			// Long poll without updates
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		result = batch
+	case "sendMessage":
+		f.mu.Lock()
+		f.sent = append(f.sent, params)
+		f.mu.Unlock()
+		f.sentCh <- struct{}{}
+		result = message{MessageID: 1}
+	}
+
+	raw, _ := json.Marshal(result)
+	json.NewEncoder(w).Encode(apiResponse{OK: true, Result: raw})
+}
+
+func TestRun(t *testing.T) {
+	const admin, stranger = 42, 7
+	api := &fakeAPI{
+		t: t,
+		updates: []update{
+			{UpdateID: 10, Message: &message{MessageID: 1, From: &user{ID: stranger}, Chat: chat{ID: stranger}, Text: "/help"}},
+			{UpdateID: 11, Message: &message{MessageID: 2, From: &user{ID: admin}, Chat: chat{ID: admin}, Text: "/help@test_bot"}},
+			{UpdateID: 12},
+			{UpdateID: 13, Message: &message{MessageID: 3, From: &user{ID: admin}, Chat: chat{ID: admin}, Text: "not a command"}},
+		},
+		sentCh: make(chan struct{}, 10),
+	}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	b := NewBot("test-token", []int64{admin}, nil, nil)
+	b.SetAPIURL(srv.URL + "/")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-api.sentCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message sent")
+	}
+	// Let the poller come back for the next batch
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		api.mu.Lock()
+		n := len(api.offsets)
+		api.mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	if len(api.offsets) < 2 || api.offsets[0] != 0 || api.offsets[1] != 14 {
+		t.Errorf("getUpdates offsets = %v, want [0 14 ...]", api.offsets)
+	}
+	if len(api.sent) != 1 {
+		t.Fatalf("sent %d messages, want 1 to the admin: %v", len(api.sent), api.sent)
+	}
+	want := map[string]any{
+		"chat_id":                  float64(admin),
+		"text":                     helpText,
+		"parse_mode":               "HTML",
+		"disable_web_page_preview": true,
+	}
+	for key, value := range want {
+		if got := api.sent[0][key]; got != value {
+			t.Errorf("sendMessage %s = %v, want %v", key, got, value)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		text     string
+		cmd, arg string
+		ok       bool
+	}{
+		{"/stats", "stats", "", true},
+		{"/Search@test_bot  de ", "search", "de", true},
+		{"/search DE", "search", "DE", true},
+		{"stats", "", "", false},
+		{"/", "", "", false},
+		{"/@test_bot", "", "", false},
+	}
+	for _, tt := range tests {
+		cmd, arg, ok := parseCommand(tt.text)
+		if cmd != tt.cmd || arg != tt.arg || ok != tt.ok {
+			t.Errorf("parseCommand(%q) = %q, %q, %v, want %q, %q, %v", tt.text, cmd, arg, ok, tt.cmd, tt.arg, tt.ok)
+		}
+	}
+}
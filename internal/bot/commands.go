@@ -0,0 +1,453 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/soaska/proxy/internal/speedtest"
+	"github.com/soaska/proxy/internal/stats"
+)
+
+// commandTimeout bounds the queries of one command
+const commandTimeout = 30 * time.Second
+
+// commandList is the command menu shown by Telegram clients
+var commandList = []botCommand{
+	{"stats", "Общая статистика"},
+	{"traffic", "Трафик и средние значения"},
+	{"countries", "Подключения по странам"},
+	{"top", "Топ-5 стран"},
+	{"recent", "Последние подключения"},
+	{"today", "Статистика за сегодня"},
+	{"week", "Статистика за 7 дней"},
+	{"peak", "Пиковые часы и дни"},
+	{"compare", "Сегодня/вчера, эта неделя/прошлая"},
+	{"speedtest", "Запустить speedtest"},
+	{"speedtest_result", "Последний speedtest"},
+	{"search", "Статистика страны: /search DE"},
+	{"export", "Статистика в JSON"},
+	{"info", "Сведения о сервере"},
+	{"help", "Список команд"},
+}
+
+// parseCommand splits "/cmd@bot arg" into the command and its argument
+func parseCommand(text string) (string, string, bool) {
+	if !strings.HasPrefix(text, "/") {
+		return "", "", false
+	}
+	cmd, arg, _ := strings.Cut(text[1:], " ")
+	cmd, _, _ = strings.Cut(cmd, "@")
+	return strings.ToLower(cmd), strings.TrimSpace(arg), cmd != ""
+}
+
+func (b *Bot) handleMessage(ctx context.Context, m *message) {
+	cmd, arg, ok := parseCommand(m.Text)
+	if !ok {
+		return
+	}
+	// Others get no answer, which would only confirm the bot is there
+	if m.From == nil || !b.isAdmin(m.From.ID) {
+		var from int64
+		if m.From != nil {
+			from = m.From.ID
+		}
+		log.Printf("[BOT] Ignored /%s from user %d", cmd, from)
+		return
+	}
+
+	text, err := b.reply(ctx, m, cmd, arg)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[BOT] /%s failed: %v", cmd, err)
+		text = "Не удалось получить данные, подробности в логе сервера"
+	}
+	if text != "" {
+		b.send(ctx, m.Chat.ID, text)
+	}
+}
+
+// reply runs a command and returns the answer, empty if the command has
+// answered on its own
+func (b *Bot) reply(ctx context.Context, m *message, cmd, arg string) (string, error) {
+	qctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+
+	switch cmd {
+	case "start":
+		return startText, nil
+	case "help":
+		return helpText, nil
+	case "stats":
+		resp, err := b.stats.PublicStats(qctx)
+		if err != nil {
+			return "", err
+		}
+		return formatStats(resp), nil
+	case "traffic":
+		resp, err := b.stats.Traffic(qctx)
+		if err != nil {
+			return "", err
+		}
+		return formatTraffic(resp), nil
+	case "countries":
+		resp, err := b.stats.Countries(qctx, 25)
+		if err != nil {
+			return "", err
+		}
+		return formatCountries("Страны", resp), nil
+	case "top":
+		resp, err := b.stats.Countries(qctx, 5)
+		if err != nil {
+			return "", err
+		}
+		return formatCountries("Топ-5 стран", resp), nil
+	case "recent":
+		conns, err := b.stats.Recent(qctx, 10)
+		if err != nil {
+			return "", err
+		}
+		return formatRecent("Последние подключения", conns), nil
+	case "today":
+		resp, err := b.stats.Today(qctx, time.Now())
+		if err != nil {
+			return "", err
+		}
+		return formatToday(resp), nil
+	case "week":
+		resp, err := b.stats.Week(qctx, time.Now())
+		if err != nil {
+			return "", err
+		}
+		return formatWeek(resp), nil
+	case "peak":
+		resp, err := b.stats.Peak(qctx, 0)
+		if err != nil {
+			return "", err
+		}
+		return formatPeak(resp), nil
+	case "compare":
+		resp, err := b.stats.Compare(qctx, time.Now())
+		if err != nil {
+			return "", err
+		}
+		return formatCompare(resp), nil
+	case "search":
+		if arg == "" {
+			return "Укажите код страны, например: /search DE", nil
+		}
+		resp, err := b.stats.CountryDetail(qctx, arg)
+		if errors.Is(err, stats.ErrNoCountryData) {
+			return fmt.Sprintf("Нет данных по стране %s", html.EscapeString(strings.ToUpper(arg))), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return formatSearch(resp), nil
+	case "export":
+		resp, err := b.stats.Snapshot(qctx)
+		if err != nil {
+			return "", err
+		}
+		data, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		name := "stats-" + resp.Timestamp.Format("2006-01-02-150405") + ".json"
+		return "", b.sendDocument(qctx, m.Chat.ID, name, data)
+	case "info":
+		resp, err := b.stats.Info(qctx)
+		if err != nil {
+			return "", err
+		}
+		return formatInfo(resp), nil
+	case "speedtest":
+		return b.startSpeedtest(ctx, m), nil
+	case "speedtest_result":
+		if b.speedtest == nil {
+			return "Speedtest недоступен", nil
+		}
+		result, err := b.speedtest.GetLatestResult(qctx)
+		if err != nil {
+			return "", err
+		}
+		if result == nil {
+			return "Замеров скорости ещё не было, запустите /speedtest", nil
+		}
+		return formatSpeedtest(result, "", "", ""), nil
+	}
+	return "Неизвестная команда, список команд: /help", nil
+}
+
+// startSpeedtest runs a speedtest in the background. The result reaches
+// every admin through the notify callback, failures only the chat.
+func (b *Bot) startSpeedtest(ctx context.Context, m *message) string {
+	if b.speedtest == nil {
+		return "Speedtest недоступен"
+	}
+	triggeredBy := "telegram"
+	if m.From.Username != "" {
+		triggeredBy += ":@" + m.From.Username
+	}
+	go func() {
+		if _, err := b.speedtest.RunSpeedtest(ctx, triggeredBy, ""); err != nil && ctx.Err() == nil {
+			log.Printf("[BOT] Speedtest failed: %v", err)
+			b.send(ctx, m.Chat.ID, "Speedtest не удался: "+html.EscapeString(err.Error()))
+		}
+	}()
+	return "Speedtest запущен, результат придёт через 30–60 секунд"
+}
+
+var startText = `<b>Бот администратора прокси</b>
+
+/stats — общая статистика
+/traffic — трафик
+/speedtest — замер скорости
+/info — сведения о сервере
+
+Все команды: /help`
+
+var helpText = func() string {
+	var sb strings.Builder
+	sb.WriteString("<b>Команды</b>\n\n")
+	for _, c := range commandList {
+		fmt.Fprintf(&sb, "/%s — %s\n", c.Command, c.Description)
+	}
+	fmt.Fprintf(&sb, "\nSpeedtest можно запускать не чаще раза в %d минут, результат получат все администраторы.", int(speedtest.SpeedTestCooldown.Minutes()))
+	sb.WriteString("\n/search принимает двухбуквенный код страны (ISO 3166).")
+	return sb.String()
+}()
+
+func formatStats(s *stats.PublicStatsResponse) string {
+	var sb strings.Builder
+	sb.WriteString("<b>Статистика</b>\n\n")
+	fmt.Fprintf(&sb, "Аптайм: %s\n", formatUptime(s.UptimeSeconds))
+	fmt.Fprintf(&sb, "Активных подключений: %d\n", s.ActiveConnections)
+	fmt.Fprintf(&sb, "Всего подключений: %d\n", s.TotalConnections)
+	fmt.Fprintf(&sb, "Отклонено: %d\n", s.RejectedConns)
+	fmt.Fprintf(&sb, "Трафик: %s\n", formatGB(s.TotalTrafficGB))
+	if len(s.Countries) > 0 {
+		sb.WriteString("\n<b>Страны</b>\n")
+		for i, c := range s.Countries {
+			if i == 5 {
+				break
+			}
+			fmt.Fprintf(&sb, "%s %s — %.1f%%\n", html.EscapeString(c.Country), html.EscapeString(c.CountryName), c.Percentage)
+		}
+	}
+	fmt.Fprintf(&sb, "\nОбновлено: %s", formatTime(s.UpdatedAt))
+	return sb.String()
+}
+
+func formatTraffic(t *stats.TrafficSummary) string {
+	var sb strings.Builder
+	sb.WriteString("<b>Трафик</b>\n\n")
+	fmt.Fprintf(&sb, "Всего: %s\n", formatGB(t.TotalTrafficGB))
+	fmt.Fprintf(&sb, "Скачано: %s (%.1f%%)\n", formatGB(t.DownloadGB), t.DownloadPercent)
+	fmt.Fprintf(&sb, "Отдано: %s (%.1f%%)\n", formatGB(t.UploadGB), t.UploadPercent)
+	fmt.Fprintf(&sb, "В час: %s, в сутки: %s\n", formatGB(t.TrafficPerHourGB), formatGB(t.TrafficPerDayGB))
+	fmt.Fprintf(&sb, "На подключение: %.2f MB\n", t.TrafficPerConnectionMB)
+	fmt.Fprintf(&sb, "Средняя длительность: %s\n", formatDuration(int64(t.AvgDurationSeconds)))
+	fmt.Fprintf(&sb, "\nПодключений: %d, активных: %d\n", t.TotalConnections, t.ActiveConnections)
+	fmt.Fprintf(&sb, "Аптайм: %s", formatUptime(t.UptimeSeconds))
+	return sb.String()
+}
+
+func formatCountries(title string, c *stats.CountryBreakdown) string {
+	if len(c.Countries) == 0 {
+		return "Подключений по странам ещё нет"
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<b>%s</b> (всего подключений: %d)\n\n", title, c.TotalConnections)
+	for i, u := range c.Countries {
+		fmt.Fprintf(&sb, "%d. %s %s — %d (%.1f%%), %s\n", i+1,
+			html.EscapeString(u.Country), html.EscapeString(u.CountryName),
+			u.Connections, u.Percentage, formatBytes(u.TotalBytes))
+	}
+	return sb.String()
+}
+
+func formatRecent(title string, conns []stats.RecentConnection) string {
+	if len(conns) == 0 {
+		return "Завершённых подключений ещё нет"
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<b>%s</b>\n\n", title)
+	for _, c := range conns {
+		place := c.CountryName
+		if c.City != "" {
+			place += ", " + c.City
+		}
+		fmt.Fprintf(&sb, "%s %s — %s, %s\n", formatTime(c.ConnectedAt), html.EscapeString(place),
+			formatBytes(c.BytesIn+c.BytesOut), formatDuration(c.DurationSeconds))
+	}
+	return sb.String()
+}
+
+func formatToday(t *stats.TodayStats) string {
+	var sb strings.Builder
+	sb.WriteString("<b>Сегодня</b>\n\n")
+	fmt.Fprintf(&sb, "Подключений: %d\nТрафик: %s\n", t.TotalConnections, formatBytes(t.TotalBytes))
+	if len(t.Hourly) > 0 {
+		sb.WriteString("\n<b>По часам (UTC)</b>\n")
+		for _, h := range t.Hourly {
+			fmt.Fprintf(&sb, "%s:00 — %d\n", h.Hour, h.Connections)
+		}
+	}
+	return sb.String()
+}
+
+func formatWeek(w *stats.WeekStats) string {
+	var sb strings.Builder
+	sb.WriteString("<b>За 7 дней</b>\n\n")
+	fmt.Fprintf(&sb, "Подключений: %d (%.1f в день)\nТрафик: %s\n", w.TotalConnections, w.AveragePerDay, formatBytes(w.TotalBytes))
+	if len(w.Daily) > 0 {
+		sb.WriteString("\n<b>По дням</b>\n")
+		for _, d := range w.Daily {
+			fmt.Fprintf(&sb, "%s — %d, %s\n", d.Day, d.Connections, formatBytes(d.TotalBytes))
+		}
+	}
+	return sb.String()
+}
+
+func formatPeak(p *stats.PeakUsage) string {
+	if p.PeakHourConnections == 0 {
+		return "Подключений ещё не было"
+	}
+	var sb strings.Builder
+	sb.WriteString("<b>Пиковая нагрузка</b>\n\n")
+	fmt.Fprintf(&sb, "Час (UTC): %s:00, подключений: %d\n", p.PeakHour, p.PeakHourConnections)
+	fmt.Fprintf(&sb, "День: %s, подключений: %d\n", p.PeakDay, p.PeakDayConnections)
+	if p.BusiestCountry != "" {
+		fmt.Fprintf(&sb, "Страна: %s %s, подключений: %d\n", html.EscapeString(p.BusiestCountry),
+			html.EscapeString(p.BusiestCountryName), p.BusiestCountrySessions)
+	}
+	return sb.String()
+}
+
+func formatCompare(c *stats.Comparison) string {
+	var sb strings.Builder
+	sb.WriteString("<b>Сравнение</b>\n\n")
+	fmt.Fprintf(&sb, "Сегодня: %d, %s\n", c.TodayConnections, formatBytes(c.TodayBytes))
+	fmt.Fprintf(&sb, "Вчера: %d, %s\n", c.YesterdayConnections, formatBytes(c.YesterdayBytes))
+	fmt.Fprintf(&sb, "Изменение: подключения %s, трафик %s\n\n", formatChange(c.TodayConnections, c.YesterdayConnections),
+		formatChange(c.TodayBytes, c.YesterdayBytes))
+	fmt.Fprintf(&sb, "Эта неделя: %d, %s\n", c.ThisWeekConnections, formatBytes(c.ThisWeekBytes))
+	fmt.Fprintf(&sb, "Прошлая неделя: %d, %s\n", c.LastWeekConnections, formatBytes(c.LastWeekBytes))
+	fmt.Fprintf(&sb, "Изменение: подключения %s, трафик %s", formatChange(c.ThisWeekConnections, c.LastWeekConnections),
+		formatChange(c.ThisWeekBytes, c.LastWeekBytes))
+	return sb.String()
+}
+
+func formatSearch(s *stats.CountryDetail) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<b>%s %s</b>\n\n", html.EscapeString(s.Country), html.EscapeString(s.CountryName))
+	fmt.Fprintf(&sb, "Подключений: %d\nТрафик: %s\n", s.TotalConnections, formatBytes(s.TotalBytes))
+	if len(s.Recent) > 0 {
+		sb.WriteString("\n")
+		sb.WriteString(formatRecent("Последние подключения", s.Recent))
+	}
+	return sb.String()
+}
+
+func formatInfo(i *stats.ServerInfo) string {
+	var sb strings.Builder
+	sb.WriteString("<b>Сервер</b>\n\n")
+	fmt.Fprintf(&sb, "Аптайм: %s\n", formatUptime(i.UptimeSeconds))
+	fmt.Fprintf(&sb, "Подключений: %d, активных: %d, отклонено: %d\n", i.TotalConnections, i.ActiveConnections, i.RejectedConns)
+	fmt.Fprintf(&sb, "Трафик: %s (скачано %s, отдано %s)\n", formatGB(i.TotalTrafficGB), formatGB(i.DownloadGB), formatGB(i.UploadGB))
+	fmt.Fprintf(&sb, "Размер базы: %s\n", formatBytes(i.DatabaseSizeBytes))
+	fmt.Fprintf(&sb, "Стран: %d\n", i.CountriesServed)
+	if i.TopCountry != nil {
+		fmt.Fprintf(&sb, "Топ страна: %s %s (%.1f%%)\n", html.EscapeString(i.TopCountry.Country),
+			html.EscapeString(i.TopCountry.CountryName), i.TopCountry.Percentage)
+	}
+	fmt.Fprintf(&sb, "\nОбновлено: %s", formatTime(i.UpdatedAt))
+	return sb.String()
+}
+
+func formatSpeedtest(r *speedtest.Result, triggeredBy, triggeredIP, triggeredCountry string) string {
+	var sb strings.Builder
+	sb.WriteString("<b>Speedtest</b>\n\n")
+	fmt.Fprintf(&sb, "Скачивание: %.2f Мбит/с\n", r.DownloadMbps)
+	fmt.Fprintf(&sb, "Отдача: %.2f Мбит/с\n", r.UploadMbps)
+	fmt.Fprintf(&sb, "Пинг: %.1f мс\n", r.PingMs)
+	fmt.Fprintf(&sb, "Сервер: %s, %s\n", html.EscapeString(r.ServerName), html.EscapeString(r.ServerLocation))
+	if triggeredBy != "" {
+		by := triggeredBy
+		if triggeredIP != "" {
+			by += " с " + triggeredIP
+		}
+		if triggeredCountry != "" {
+			by += " (" + triggeredCountry + ")"
+		}
+		fmt.Fprintf(&sb, "Запустил: %s\n", html.EscapeString(by))
+	}
+	fmt.Fprintf(&sb, "\n%s", formatTime(r.TestedAt))
+	return sb.String()
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit && exp < 3; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %cB", float64(b)/float64(div), "KMGT"[exp])
+}
+
+func formatGB(gb float64) string {
+	return formatBytes(int64(gb * (1 << 30)))
+}
+
+// formatUptime formats seconds as days, hours and minutes
+func formatUptime(seconds int64) string {
+	d := seconds / 86400
+	h := seconds % 86400 / 3600
+	m := seconds % 3600 / 60
+	if d > 0 {
+		return fmt.Sprintf("%dд %dч %dм", d, h, m)
+	}
+	return fmt.Sprintf("%dч %dм", h, m)
+}
+
+// formatDuration formats a connection duration
+func formatDuration(seconds int64) string {
+	switch {
+	case seconds >= 3600:
+		return fmt.Sprintf("%dч %dм", seconds/3600, seconds%3600/60)
+	case seconds >= 60:
+		return fmt.Sprintf("%dм %dс", seconds/60, seconds%60)
+	}
+	return fmt.Sprintf("%dс", seconds)
+}
+
+// formatChange formats the change from old to cur in percent, a dash if
+// there was nothing to compare with
+func formatChange(cur, old int64) string {
+	if old == 0 {
+		if cur == 0 {
+			return "0%"
+		}
+		return "—"
+	}
+	return fmt.Sprintf("%+.0f%%", float64(cur-old)*100/float64(old))
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "—"
+	}
+	return t.Local().Format("02.01.2006 15:04")
+}
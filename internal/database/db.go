@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -90,6 +91,48 @@ func runMigrations(db *sql.DB) error {
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_speedtest_tested_at ON speedtest_results(tested_at DESC)`,
 
+		// dc_latency table, filled by the Telegram DC prober
+		`CREATE TABLE IF NOT EXISTS dc_latency (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			dc_id INTEGER NOT NULL,
+			addr TEXT NOT NULL,
+			rtt_ms REAL,
+			error TEXT,
+			probed_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_dc_latency_addr ON dc_latency(addr, probed_at DESC)`,
+
+		// users table
+		`CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			disabled INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL,
+			last_login DATETIME
+		)`,
+
+		// quotas table
+		`CREATE TABLE IF NOT EXISTS quotas (
+			subject_type TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			daily_bytes INTEGER NOT NULL DEFAULT 0,
+			monthly_bytes INTEGER NOT NULL DEFAULT 0,
+			total_bytes INTEGER NOT NULL DEFAULT 0,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (subject_type, subject)
+		)`,
+
+		// quota_usage table, one row per subject and period
+		`CREATE TABLE IF NOT EXISTS quota_usage (
+			subject_type TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			period TEXT NOT NULL,
+			bytes INTEGER NOT NULL DEFAULT 0,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (subject_type, subject, period)
+		)`,
+
 		// Initialize server_stats if empty
 		`INSERT OR IGNORE INTO server_stats (id, start_time, total_connections, total_bytes_in, total_bytes_out)
 		 VALUES (1, datetime('now'), 0, 0, 0)`,
@@ -101,9 +144,64 @@ func runMigrations(db *sql.DB) error {
 		}
 	}
 
+	// Columns added after the initial schema
+	columns := []struct {
+		table, name, definition string
+	}{
+		{"connections", "username", "TEXT"},
+		{"connections", "close_reason", "TEXT"},
+		{"connections", "protocol", "TEXT"},
+		{"connections", "dc_id", "INTEGER"},
+		{"server_stats", "total_rejected", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfMissing(db, c.table, c.name, c.definition); err != nil {
+			return fmt.Errorf("migration failed: %w", err)
+		}
+	}
+
+	indexes := []string{
+		`CREATE INDEX IF NOT EXISTS idx_connections_username ON connections(username)`,
+		`CREATE INDEX IF NOT EXISTS idx_connections_dc_id ON connections(dc_id)`,
+	}
+	for _, index := range indexes {
+		if _, err := db.Exec(index); err != nil {
+			return fmt.Errorf("migration failed: %w", err)
+		}
+	}
+
 	return nil
 }
 
+// addColumnIfMissing adds a column to an existing table. SQLite has no
+// ADD COLUMN IF NOT EXISTS, so the schema is checked first.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
+
 // CleanupOldStats removes statistics older than retention days
 func CleanupOldStats(db *sql.DB, retentionDays int) error {
 	cutoffDate := time.Now().AddDate(0, 0, -retentionDays)
@@ -116,3 +214,21 @@ func CleanupOldStats(db *sql.DB, retentionDays int) error {
 	log.Printf("[DB] Cleaned up connections older than %d days", retentionDays)
 	return nil
 }
+
+// Vacuum rebuilds the database file, returning the space of deleted rows
+// to the file system
+func Vacuum(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `VACUUM`); err != nil {
+		return fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	return nil
+}
+
+// Backup writes a consistent copy of the database to path, which must not
+// exist. It is safe while the proxy is writing to the database.
+func Backup(ctx context.Context, db *sql.DB, path string) error {
+	if _, err := db.ExecContext(ctx, `VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("failed to back up database: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+// Package egress picks source addresses for outgoing connections.
+package egress
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/c-robinson/iplib"
+	"golang.org/x/sys/unix"
+)
+
+// Pool hands out source addresses from subnets and single addresses of
+// either family, following a Strategy. It is safe for concurrent use.
+type Pool struct {
+	mu sync.Mutex // guards all fields, the families are swapped by Update
+
+	v4, v6 *family
+	desc   []string
+
+	strategy  Strategy
+	stickyTTL time.Duration
+	sticky    map[string]stickyEntry
+	lastSweep time.Time
+}
+
+// NewPool creates a pool for subnet/maskLen. Both IPv4 and IPv6 subnets are supported.
+func NewPool(subnet string, maskLen int) (*Pool, error) {
+	ip := net.ParseIP(subnet)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid subnet address %q", subnet)
+	}
+
+	maxLen := 32
+	if ip.To4() == nil {
+		maxLen = 128
+	}
+	if maskLen <= 0 || maskLen > maxLen {
+		return nil, fmt.Errorf("invalid subnet mask /%d for %s", maskLen, subnet)
+	}
+
+	p := newPool()
+	p.addSubnet(iplib.NewNet(ip, maskLen))
+	return p, nil
+}
+
+// NewPoolFromList creates a pool from a fixed list of addresses. Entries
+// are single IPs, subnets in CIDR notation or interface names, which
+// contribute every global unicast address assigned to them.
+func NewPoolFromList(entries []string) (*Pool, error) {
+	p := newPool()
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if ip := net.ParseIP(entry); ip != nil {
+			p.addIP(ip)
+			continue
+		}
+		if _, n, err := iplib.ParseCIDR(entry); err == nil {
+			p.addSubnet(n)
+			continue
+		}
+
+		iface, err := net.InterfaceByName(entry)
+		if err != nil {
+			return nil, fmt.Errorf("egress entry %q is neither an address, a subnet nor an interface", entry)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("addresses of interface %s: %w", entry, err)
+		}
+		found := false
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !ipNet.IP.IsGlobalUnicast() {
+				continue
+			}
+			p.addIP(ipNet.IP)
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("interface %s has no usable addresses", entry)
+		}
+	}
+
+	if p.v4 == nil && p.v6 == nil {
+		return nil, fmt.Errorf("egress address list is empty")
+	}
+	return p, nil
+}
+
+func newPool() *Pool {
+	return &Pool{strategy: StrategyRandom}
+}
+
+func (p *Pool) familyOf(ip net.IP) **family {
+	if ip.To4() != nil {
+		return &p.v4
+	}
+	return &p.v6
+}
+
+func (p *Pool) addSubnet(n iplib.Net) {
+	f := p.familyOf(n.IP())
+	if *f == nil {
+		*f = &family{v6: n.IP().To4() == nil}
+	}
+	first, last := n.FirstAddress(), n.LastAddress()
+	// The all-zeros address of an IPv6 subnet is the subnet-router
+	// anycast address, skip it like the IPv4 network address
+	if (*f).v6 && !first.Equal(last) {
+		first = iplib.NextIP(first)
+	}
+	(*f).add(first, last)
+	p.desc = append(p.desc, n.String())
+}
+
+func (p *Pool) addIP(ip net.IP) {
+	f := p.familyOf(ip)
+	if *f == nil {
+		*f = &family{v6: ip.To4() == nil}
+	}
+	(*f).add(ip, ip)
+	p.desc = append(p.desc, ip.String())
+}
+
+// Pick returns a source address of the requested family for a client
+// identified by key, or nil if the pool has none of that family. key only
+// matters to the sticky strategy and may be empty.
+func (p *Pool) Pick(key string, v6 bool) net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := p.v4
+	if v6 {
+		f = p.v6
+	}
+	if f == nil {
+		return nil
+	}
+	return p.pick(f, key)
+}
+
+// Update replaces the addresses and strategy of p with those of q, which
+// must not be used afterwards. Sticky clients keep their address if it is
+// still in the pool.
+func (p *Pool) Update(q *Pool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.v4, p.v6, p.desc = q.v4, q.v6, q.desc
+	if p.strategy != q.strategy || p.stickyTTL != q.stickyTTL {
+		p.sticky = nil
+	}
+	p.strategy, p.stickyTTL = q.strategy, q.stickyTTL
+	for key, e := range p.sticky {
+		if f := *p.familyOf(e.ip); f == nil || !f.contains(e.ip) {
+			delete(p.sticky, key)
+		}
+	}
+}
+
+// Has reports whether the pool has addresses of the given family
+func (p *Pool) Has(v6 bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if v6 {
+		return p.v6 != nil
+	}
+	return p.v4 != nil
+}
+
+// IsIPv6 reports whether the pool hands out only IPv6 addresses, making
+// IPv6 the preferred destination family
+func (p *Pool) IsIPv6() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.v4 == nil
+}
+
+// Contains reports whether ip belongs to the pool
+func (p *Pool) Contains(ip net.IP) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := *p.familyOf(ip)
+	return f != nil && f.contains(ip)
+}
+
+// String returns the subnets and addresses of the pool
+func (p *Pool) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return strings.Join(p.desc, ", ")
+}
+
+// addrRange is an inclusive range of addresses of one family
+type addrRange struct {
+	first, size *big.Int
+}
+
+// family holds the addresses of one IP version
+type family struct {
+	v6     bool
+	ranges []addrRange
+	total  *big.Int
+
+	// strategy state, guarded by Pool.mu
+	next uint64 // round-robin position
+	lru  *lruList
+}
+
+func (f *family) add(first, last net.IP) {
+	lo, hi := ipToInt(first), ipToInt(last)
+	size := new(big.Int).Sub(hi, lo)
+	size.Add(size, big.NewInt(1))
+	f.ranges = append(f.ranges, addrRange{lo, size})
+	if f.total == nil {
+		f.total = new(big.Int)
+	}
+	f.total.Add(f.total, size)
+}
+
+// at returns the i-th address of the family
+func (f *family) at(i *big.Int) net.IP {
+	i = new(big.Int).Set(i)
+	for _, r := range f.ranges {
+		if i.Cmp(r.size) < 0 {
+			return intToIP(i.Add(i, r.first), f.v6)
+		}
+		i.Sub(i, r.size)
+	}
+	// unreachable for i < total
+	return intToIP(f.ranges[0].first, f.v6)
+}
+
+func (f *family) contains(ip net.IP) bool {
+	n := ipToInt(ip)
+	for _, r := range f.ranges {
+		off := new(big.Int).Sub(n, r.first)
+		if off.Sign() >= 0 && off.Cmp(r.size) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil {
+		return new(big.Int).SetBytes(ip4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+func intToIP(n *big.Int, v6 bool) net.IP {
+	if v6 {
+		return net.IP(n.FillBytes(make([]byte, net.IPv6len)))
+	}
+	return net.IP(n.FillBytes(make([]byte, net.IPv4len)))
+}
+
+// Control is a net.Dialer/net.ListenConfig control function that enables
+// IP_FREEBIND (or IPV6_FREEBIND), so the kernel lets us bind to addresses
+// that are routed to the host but not assigned to any interface.
+func Control(network, address string, c syscall.RawConn) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+
+	var operr error
+	if err := c.Control(func(fd uintptr) {
+		const (
+			IP_FREEBIND   = 15
+			IPV6_FREEBIND = 78
+		)
+		switch network {
+		case "tcp6", "udp6":
+			operr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, IPV6_FREEBIND, 1)
+		default:
+			operr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, IP_FREEBIND, 1)
+		}
+	}); err != nil {
+		return err
+	}
+	return operr
+}
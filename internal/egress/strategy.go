@@ -0,0 +1,168 @@
+package egress
+
+import (
+	"container/list"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Strategy selects how a Pool picks source addresses
+type Strategy string
+
+const (
+	// StrategyRandom picks a random address for every connection
+	StrategyRandom Strategy = "random"
+	// StrategySticky keeps handing a client the same address until it
+	// has not connected for the sticky TTL
+	StrategySticky Strategy = "sticky"
+	// StrategyRoundRobin walks the addresses in order
+	StrategyRoundRobin Strategy = "round_robin"
+	// StrategyLRU picks the address whose last use is the oldest
+	StrategyLRU Strategy = "lru"
+)
+
+// DefaultStickyTTL is used when SetStrategy gets no TTL
+const DefaultStickyTTL = 30 * time.Minute
+
+// maxLRUAddrs is the largest family tracked address by address for LRU.
+// Bigger ones are walked in order, which never reuses an address before
+// all others were used either.
+const maxLRUAddrs = 65536
+
+// ParseStrategy parses a strategy name, "" meaning random
+func ParseStrategy(s string) (Strategy, error) {
+	switch st := Strategy(s); st {
+	case "":
+		return StrategyRandom, nil
+	case StrategyRandom, StrategySticky, StrategyRoundRobin, StrategyLRU:
+		return st, nil
+	}
+	return "", fmt.Errorf("unknown egress strategy %q", s)
+}
+
+// SetStrategy changes how addresses are picked. ttl only applies to
+// StrategySticky.
+func (p *Pool) SetStrategy(s Strategy, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = DefaultStickyTTL
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.strategy = s
+	p.stickyTTL = ttl
+	p.sticky = nil
+}
+
+type stickyEntry struct {
+	ip      net.IP
+	expires time.Time
+}
+
+func (p *Pool) pick(f *family, key string) net.IP {
+	var ip net.IP
+	switch p.strategy {
+	case StrategySticky:
+		if key == "" {
+			ip = f.random()
+		} else {
+			ip = p.pickSticky(f, key)
+		}
+	case StrategyRoundRobin:
+		ip = f.roundRobin()
+	case StrategyLRU:
+		ip = f.leastRecentlyUsed()
+		f.used(ip)
+	default:
+		ip = f.random()
+	}
+	return ip
+}
+
+// pickSticky returns the address key got last time, unless it expired.
+// Every pick extends the TTL, so a busy client keeps its address.
+func (p *Pool) pickSticky(f *family, key string) net.IP {
+	now := time.Now()
+	if p.sticky == nil {
+		p.sticky = make(map[string]stickyEntry)
+	}
+	p.sweepSticky(now)
+
+	if f.v6 {
+		key += "/6"
+	}
+	e, ok := p.sticky[key]
+	if !ok || now.After(e.expires) {
+		e.ip = f.random()
+	}
+	e.expires = now.Add(p.stickyTTL)
+	p.sticky[key] = e
+	return e.ip
+}
+
+// sweepSticky drops expired sticky entries, at most once per TTL
+func (p *Pool) sweepSticky(now time.Time) {
+	if now.Sub(p.lastSweep) < p.stickyTTL {
+		return
+	}
+	p.lastSweep = now
+	for key, e := range p.sticky {
+		if now.After(e.expires) {
+			delete(p.sticky, key)
+		}
+	}
+}
+
+func (f *family) random() net.IP {
+	i, err := rand.Int(rand.Reader, f.total)
+	if err != nil {
+		return f.at(big.NewInt(0))
+	}
+	return f.at(i)
+}
+
+func (f *family) roundRobin() net.IP {
+	i := new(big.Int).SetUint64(f.next)
+	f.next++
+	return f.at(i.Mod(i, f.total))
+}
+
+func (f *family) leastRecentlyUsed() net.IP {
+	if f.total.Cmp(big.NewInt(maxLRUAddrs)) > 0 {
+		return f.roundRobin()
+	}
+	if f.lru == nil {
+		f.lru = newLRUList(f)
+	}
+	return f.lru.order.Front().Value.(net.IP)
+}
+
+// used moves ip to the back of the LRU order
+func (f *family) used(ip net.IP) {
+	if f.lru == nil {
+		return
+	}
+	if e, ok := f.lru.index[string(ip)]; ok {
+		f.lru.order.MoveToBack(e)
+	}
+}
+
+// lruList orders the addresses of a family by last use, the front being
+// the least recently used one
+type lruList struct {
+	order *list.List // of net.IP
+	index map[string]*list.Element
+}
+
+func newLRUList(f *family) *lruList {
+	n := f.total.Int64()
+	l := &lruList{order: list.New(), index: make(map[string]*list.Element, n)}
+	for i := int64(0); i < n; i++ {
+		ip := f.at(big.NewInt(i))
+		l.index[string(ip)] = l.order.PushBack(ip)
+	}
+	return l
+}
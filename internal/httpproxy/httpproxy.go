@@ -0,0 +1,211 @@
+// Package httpproxy is an HTTP proxy server that only supports the
+// CONNECT method. It dials through the same Dialer as the SOCKS5 server
+// so both listeners share policy, egress and stats.
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/soaska/proxy/internal/session"
+	"github.com/soaska/proxy/internal/socks5"
+)
+
+// Server is an HTTP CONNECT proxy server.
+type Server struct {
+	// Logf optionally specifies the logger to use.
+	// If nil, the standard logger is used.
+	Logf func(format string, args ...any)
+
+	// Dialer optionally specifies the dialer to use for outgoing
+	// connections. If nil, the net package's standard dialer is used.
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Authenticator, if set, checks the Proxy-Authorization credentials.
+	// It takes precedence over Username and Password.
+	Authenticator socks5.Authenticator
+
+	// Username and Password, if set, are the credential clients must provide.
+	Username string
+	Password string
+
+	// Limits, if set, caps the accepted connections. It may be shared with
+	// the SOCKS5 server.
+	Limits *socks5.Limits
+
+	// HandshakeTimeout limits the time to read the CONNECT request.
+	// Zero means no limit.
+	HandshakeTimeout time.Duration
+
+	// IdleTimeout closes a tunnel without traffic in either direction
+	// for this long. Zero means no limit.
+	IdleTimeout time.Duration
+	// MaxLifetime closes tunnels older than that. Zero means no limit.
+	MaxLifetime time.Duration
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func (s *Server) requireAuth() bool {
+	return s.Authenticator != nil || s.Username != "" || s.Password != ""
+}
+
+func (s *Server) authenticate(ctx context.Context, user, pwd string) error {
+	if s.Authenticator != nil {
+		return s.Authenticator.Authenticate(ctx, user, pwd)
+	}
+	if user != s.Username || pwd != s.Password {
+		return errors.New("invalid credentials")
+	}
+	return nil
+}
+
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := s.Dialer
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	return dial(ctx, network, addr)
+}
+
+// Serve accepts and handles incoming connections on l.
+func (s *Server) Serve(l net.Listener) error {
+	return socks5.Serve(l, s.Limits, s.logf, func(c net.Conn) {
+		if err := s.handle(c); err != nil {
+			s.logf("http proxy: client connection from %s failed: %v", c.RemoteAddr(), err)
+		}
+	})
+}
+
+func (s *Server) handle(c net.Conn) error {
+	if s.HandshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return fmt.Errorf("read request: %w", err)
+	}
+	if req.Method != http.MethodConnect {
+		writeResponse(c, http.StatusMethodNotAllowed, http.Header{"Allow": {http.MethodConnect}})
+		return fmt.Errorf("unsupported method %s", req.Method)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = session.WithClientAddr(ctx, c.RemoteAddr().String())
+	ctx = session.WithProtocol(ctx, session.ProtocolHTTP)
+
+	if s.requireAuth() {
+		user, pwd, ok := proxyBasicAuth(req)
+		if !ok {
+			writeResponse(c, http.StatusProxyAuthRequired, authHeader)
+			return errors.New("missing proxy credentials")
+		}
+		if err := s.authenticate(ctx, user, pwd); err != nil {
+			writeResponse(c, http.StatusProxyAuthRequired, authHeader)
+			return fmt.Errorf("authentication failed for user %q: %w", user, err)
+		}
+		ctx = session.WithUsername(ctx, user)
+	}
+
+	addr := req.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		writeResponse(c, http.StatusBadRequest, nil)
+		return fmt.Errorf("invalid CONNECT target %q: %w", addr, err)
+	}
+
+	srv, err := s.dial(ctx, "tcp", addr)
+	if err != nil {
+		writeResponse(c, statusForError(err), nil)
+		return fmt.Errorf("dial %s: %w", addr, err)
+	}
+	defer srv.Close()
+
+	if err := writeResponse(c, http.StatusOK, nil); err != nil {
+		return err
+	}
+	c.SetDeadline(time.Time{})
+
+	// Bytes the client sent right after the request, e.g. a TLS
+	// ClientHello, are already in the buffer. Sending them first leaves
+	// the relay with the socket itself, which it can splice.
+	if n := br.Buffered(); n > 0 {
+		buffered, _ := br.Peek(n)
+		if _, err := srv.Write(buffered); err != nil {
+			return fmt.Errorf("write to %s: %w", addr, err)
+		}
+	}
+	expired, err := socks5.Relay(c, srv, socks5.SessionTimeouts{Idle: s.IdleTimeout, MaxLifetime: s.MaxLifetime})
+	if expired != "" {
+		s.logf("http proxy: closing session from %s: %s", c.RemoteAddr(), expired)
+	}
+	return err
+}
+
+var authHeader = http.Header{"Proxy-Authenticate": {`Basic realm="proxy"`}}
+
+// proxyBasicAuth returns the credentials of the Proxy-Authorization header
+func proxyBasicAuth(req *http.Request) (user, pwd string, ok bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	scheme, encoded, found := strings.Cut(auth, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+func writeResponse(w io.Writer, code int, header http.Header) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	header.Write(&b)
+	if code != http.StatusOK {
+		b.WriteString("Content-Length: 0\r\nConnection: close\r\n")
+	}
+	b.WriteString("\r\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// notAllowedError is implemented by Dialer errors for destinations the
+// server refuses by policy, see socks5 for the same contract.
+type notAllowedError interface {
+	NotAllowed() bool
+}
+
+// statusForError maps a dial error to the response sent to the client
+func statusForError(err error) int {
+	var denied notAllowedError
+	if errors.As(err, &denied) && denied.NotAllowed() {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
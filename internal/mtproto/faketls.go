@@ -0,0 +1,340 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// Fake-TLS makes the connection look like TLS 1.3 to a configured domain.
+// The client puts an HMAC of its ClientHello, keyed with the secret, into
+// the hello random; the server answers with a ServerHello carrying an
+// HMAC in the same place. The obfuscated2 stream then travels inside TLS
+// application data records.
+
+const (
+	recordHeaderLen = 5
+	maxRecordLen    = 16384
+
+	recordHandshake        = 0x16
+	recordChangeCipherSpec = 0x14
+	recordApplicationData  = 0x17
+
+	// offsets in the ClientHello and ServerHello records
+	helloRandomOffset    = recordHeaderLen + 1 + 3 + 2
+	helloRandomLen       = 32
+	helloSessionIDOffset = helloRandomOffset + helloRandomLen
+)
+
+var errNotFakeTLS = errors.New("mtproto: not a fake-TLS client")
+
+// readClientHello reads the first TLS record. It fails for anything that
+// does not start like a TLS handshake.
+func readClientHello(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return hdr, err
+	}
+	if hdr[0] != recordHandshake || hdr[1] != 0x03 || hdr[2] != 0x01 {
+		return hdr, errNotFakeTLS
+	}
+	n := int(binary.BigEndian.Uint16(hdr[3:]))
+	if n < helloSessionIDOffset || n > maxRecordLen {
+		return hdr, errNotFakeTLS
+	}
+
+	hello := make([]byte, recordHeaderLen+n)
+	copy(hello, hdr)
+	if _, err := io.ReadFull(r, hello[recordHeaderLen:]); err != nil {
+		return hello, err
+	}
+	return hello, nil
+}
+
+// clientHello is a ClientHello that was made with one of our secrets
+type clientHello struct {
+	secret    *Secret
+	random    []byte
+	sessionID []byte
+}
+
+// verifyClientHello checks the HMAC in the hello random against secrets,
+// the embedded timestamp against skew and the SNI against domain
+func verifyClientHello(hello []byte, secrets []Secret, domain string, skew time.Duration) (*clientHello, error) {
+	if hello[recordHeaderLen] != 0x01 { // ClientHello
+		return nil, errNotFakeTLS
+	}
+	if len(hello) < helloSessionIDOffset+1 {
+		return nil, errNotFakeTLS
+	}
+	sidLen := int(hello[helloSessionIDOffset])
+	if sidLen > 32 || len(hello) < helloSessionIDOffset+1+sidLen {
+		return nil, errNotFakeTLS
+	}
+	if sni := helloServerName(hello); sni != domain {
+		return nil, fmt.Errorf("mtproto: unexpected server name %q", sni)
+	}
+
+	random := append([]byte(nil), hello[helloRandomOffset:helloSessionIDOffset]...)
+	zeroed := append([]byte(nil), hello...)
+	clear(zeroed[helloRandomOffset:helloSessionIDOffset])
+
+	for i := range secrets {
+		mac := hmac.New(sha256.New, secrets[i].Key[:])
+		mac.Write(zeroed)
+		digest := mac.Sum(nil)
+
+		for j := range digest {
+			digest[j] ^= random[j]
+		}
+		// The first 28 bytes cancel out, the rest is the client clock
+		if subtle.ConstantTimeCompare(digest[:28], make([]byte, 28)) != 1 {
+			continue
+		}
+
+		ts := time.Unix(int64(binary.LittleEndian.Uint32(digest[28:])), 0)
+		if d := time.Since(ts); skew > 0 && (d > skew || d < -skew) {
+			return nil, fmt.Errorf("mtproto: client clock is off by %s", d.Round(time.Second))
+		}
+
+		return &clientHello{
+			secret:    &secrets[i],
+			random:    random,
+			sessionID: append([]byte(nil), hello[helloSessionIDOffset+1:helloSessionIDOffset+1+sidLen]...),
+		}, nil
+	}
+	return nil, errBadHandshake
+}
+
+// helloServerName returns the SNI of a ClientHello record, or ""
+func helloServerName(hello []byte) string {
+	p := hello[helloSessionIDOffset:]
+	skip := func(lenBytes int) bool {
+		if len(p) < lenBytes {
+			return false
+		}
+		n := 0
+		for _, b := range p[:lenBytes] {
+			n = n<<8 | int(b)
+		}
+		if len(p) < lenBytes+n {
+			return false
+		}
+		p = p[lenBytes+n:]
+		return true
+	}
+	// session id, cipher suites, compression methods
+	if !skip(1) || !skip(2) || !skip(1) || len(p) < 2 {
+		return ""
+	}
+	p = p[2:] // extensions length
+
+	for len(p) >= 4 {
+		typ := binary.BigEndian.Uint16(p)
+		n := int(binary.BigEndian.Uint16(p[2:]))
+		if len(p) < 4+n {
+			return ""
+		}
+		ext := p[4 : 4+n]
+		p = p[4+n:]
+		if typ != 0 { // server_name
+			continue
+		}
+		// list length, name type, name length, name
+		if len(ext) < 5 || ext[2] != 0 {
+			return ""
+		}
+		nameLen := int(binary.BigEndian.Uint16(ext[3:]))
+		if len(ext) < 5+nameLen {
+			return ""
+		}
+		return string(ext[5 : 5+nameLen])
+	}
+	return ""
+}
+
+// serverHello builds the ServerHello, ChangeCipherSpec and a first
+// application data record answering hello
+func serverHello(hello *clientHello) ([]byte, error) {
+	keyShare := make([]byte, 32)
+	if _, err := rand.Read(keyShare); err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	body.Write([]byte{0x03, 0x03})           // legacy version
+	body.Write(make([]byte, helloRandomLen)) // random, set below
+	body.WriteByte(byte(len(hello.sessionID)))
+	body.Write(hello.sessionID)
+	body.Write([]byte{0x13, 0x01}) // TLS_AES_128_GCM_SHA256
+	body.WriteByte(0x00)           // no compression
+	ext := []byte{
+		0x00, 0x33, 0x00, 0x24, 0x00, 0x1d, 0x00, 0x20, // key_share, x25519
+	}
+	ext = append(ext, keyShare...)
+	ext = append(ext, 0x00, 0x2b, 0x00, 0x02, 0x03, 0x04) // supported_versions, TLS 1.3
+	body.Write([]byte{byte(len(ext) >> 8), byte(len(ext))})
+	body.Write(ext)
+
+	var out bytes.Buffer
+	hs := body.Bytes()
+	writeRecordHeader(&out, recordHandshake, 4+len(hs))
+	out.Write([]byte{0x02, byte(len(hs) >> 16), byte(len(hs) >> 8), byte(len(hs))}) // ServerHello
+	out.Write(hs)
+	out.Write([]byte{recordChangeCipherSpec, 0x03, 0x03, 0x00, 0x01, 0x01})
+
+	// Real servers follow with encrypted extensions and certificates,
+	// a random blob of similar size stands in for them
+	n, err := rand.Int(rand.Reader, big.NewInt(2048))
+	if err != nil {
+		return nil, err
+	}
+	blob := make([]byte, 1024+int(n.Int64()))
+	if _, err := rand.Read(blob); err != nil {
+		return nil, err
+	}
+	writeRecordHeader(&out, recordApplicationData, len(blob))
+	out.Write(blob)
+
+	resp := out.Bytes()
+	mac := hmac.New(sha256.New, hello.secret.Key[:])
+	mac.Write(hello.random)
+	mac.Write(resp)
+	copy(resp[helloRandomOffset:], mac.Sum(nil))
+	return resp, nil
+}
+
+func writeRecordHeader(w *bytes.Buffer, typ byte, n int) {
+	w.Write([]byte{typ, 0x03, 0x03, byte(n >> 8), byte(n)})
+}
+
+// fakeTLSConn carries a byte stream in TLS application data records
+type fakeTLSConn struct {
+	net.Conn
+	pending []byte // rest of the current record
+
+	mu  sync.Mutex // guards buf
+	buf []byte
+}
+
+func (c *fakeTLSConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *fakeTLSConn) readRecord() error {
+	var hdr [recordHeaderLen]byte
+	if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[3:]))
+	if n > maxRecordLen+256 {
+		return fmt.Errorf("mtproto: record too large (%d bytes)", n)
+	}
+
+	if cap(c.pending) < n {
+		c.pending = make([]byte, n)
+	}
+	rec := c.pending[:n]
+	if _, err := io.ReadFull(c.Conn, rec); err != nil {
+		return err
+	}
+
+	switch hdr[0] {
+	case recordApplicationData:
+		c.pending = rec
+	case recordChangeCipherSpec:
+		// Sent once by clients, carries nothing
+		c.pending = rec[:0]
+	default:
+		return fmt.Errorf("mtproto: unexpected TLS record type %#x", hdr[0])
+	}
+	return nil
+}
+
+func (c *fakeTLSConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxRecordLen {
+			chunk = chunk[:maxRecordLen]
+		}
+		c.buf = append(c.buf[:0], recordApplicationData, 0x03, 0x03, byte(len(chunk)>>8), byte(len(chunk)))
+		c.buf = append(c.buf, chunk...)
+		if _, err := c.Conn.Write(c.buf); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// replayCacheSize bounds the handshakes remembered. Under a flood the
+// oldest are forgotten first, they are the closest to expiring anyway.
+const replayCacheSize = 1 << 16
+
+// replayCache remembers handshakes so a recorded one cannot be replayed,
+// e.g. by a censor probing for proxies
+type replayCache struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	seen map[string]time.Time
+	ring []string // keys in the order they were added
+	head int
+	n    int
+}
+
+func newReplayCache(ttl time.Duration, size int) *replayCache {
+	return &replayCache{ttl: ttl, seen: make(map[string]time.Time), ring: make([]string, size)}
+}
+
+// add records key and reports whether it was new
+func (r *replayCache) add(key []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Keys are added in time order, so the expired ones are at the head
+	now := time.Now()
+	for r.n > 0 && now.Sub(r.seen[r.ring[r.head]]) > r.ttl {
+		r.pop()
+	}
+	if _, ok := r.seen[string(key)]; ok {
+		return false
+	}
+	if r.n == len(r.ring) {
+		r.pop()
+	}
+	k := string(key)
+	r.ring[(r.head+r.n)%len(r.ring)] = k
+	r.n++
+	r.seen[k] = now
+	return true
+}
+
+// pop forgets the oldest key
+func (r *replayCache) pop() {
+	delete(r.seen, r.ring[r.head])
+	r.ring[r.head] = ""
+	r.head = (r.head + 1) % len(r.ring)
+	r.n--
+}
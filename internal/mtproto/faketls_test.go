@@ -0,0 +1,42 @@
+package mtproto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	r := newReplayCache(time.Hour, 2)
+	if !r.add([]byte("a")) || !r.add([]byte("b")) {
+		t.Fatal("new keys reported as replays")
+	}
+	if r.add([]byte("a")) {
+		t.Error("replayed key accepted")
+	}
+
+	// A full cache forgets the oldest key
+	if !r.add([]byte("c")) {
+		t.Fatal("new key reported as replay")
+	}
+	if len(r.seen) != 2 {
+		t.Errorf("cache holds %d keys, want 2", len(r.seen))
+	}
+	if r.add([]byte("b")) || r.add([]byte("c")) {
+		t.Error("recent key forgotten")
+	}
+	if !r.add([]byte("a")) {
+		t.Error("evicted key still remembered")
+	}
+}
+
+func TestReplayCacheExpiry(t *testing.T) {
+	r := newReplayCache(10*time.Millisecond, 16)
+	r.add([]byte("a"))
+	time.Sleep(20 * time.Millisecond)
+	if !r.add([]byte("a")) {
+		t.Error("expired key reported as replay")
+	}
+	if len(r.seen) != 1 {
+		t.Errorf("cache holds %d keys, want 1", len(r.seen))
+	}
+}
@@ -0,0 +1,242 @@
+// Package mtproto is an MTProto proxy server for Telegram clients. It
+// speaks the obfuscated2 transport, optionally wrapped in fake-TLS, and
+// forwards clients to the Telegram DC they ask for through the same
+// Dialer as the SOCKS5 server.
+package mtproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/soaska/proxy/internal/session"
+	"github.com/soaska/proxy/internal/socks5"
+	"github.com/soaska/proxy/internal/telegram"
+)
+
+// defaultTimeSkew is used when Server.TimeSkew is zero
+const defaultTimeSkew = 5 * time.Minute
+
+// Server is an MTProto proxy server.
+type Server struct {
+	// Logf optionally specifies the logger to use.
+	// If nil, the standard logger is used.
+	Logf func(format string, args ...any)
+
+	// Dialer optionally specifies the dialer to use for connections to
+	// Telegram DCs. If nil, the net package's standard dialer is used.
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Secrets clients may connect with. At least one is required.
+	Secrets []Secret
+
+	// Domain enables fake-TLS: clients must send a ClientHello for this
+	// server name. Anything else is forwarded to FrontAddr, so probes see
+	// the real site. Empty means plain obfuscated2.
+	Domain string
+
+	// FrontAddr is where failed fake-TLS clients are forwarded. It
+	// defaults to Domain on port 443.
+	FrontAddr string
+
+	// FrontDialer optionally dials FrontAddr. The front site usually is
+	// not an allowed destination, so it may skip the checks of Dialer.
+	// If nil, Dialer is used.
+	FrontDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TimeSkew is how far the clock of fake-TLS clients may be off
+	TimeSkew time.Duration
+
+	// DCs maps the DC ids of clients to addresses. If nil, the built-in
+	// table is used.
+	DCs *telegram.DCMap
+
+	// PreferIPv6 selects the IPv6 addresses of the DCs
+	PreferIPv6 bool
+
+	// Limits, if set, caps the accepted connections. It may be shared with
+	// the SOCKS5 server.
+	Limits *socks5.Limits
+
+	// HandshakeTimeout limits the time for the client handshake.
+	// Zero means no limit.
+	HandshakeTimeout time.Duration
+
+	// IdleTimeout closes a session without traffic in either direction
+	// for this long. Zero means no limit.
+	IdleTimeout time.Duration
+	// MaxLifetime closes sessions older than that. Zero means no limit.
+	MaxLifetime time.Duration
+
+	initOnce sync.Once
+	replays  *replayCache
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func (s *Server) timeSkew() time.Duration {
+	if s.TimeSkew > 0 {
+		return s.TimeSkew
+	}
+	return defaultTimeSkew
+}
+
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := s.Dialer
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	return dial(ctx, network, addr)
+}
+
+// Serve accepts and handles incoming connections on l.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if len(s.Secrets) == 0 {
+		return errors.New("mtproto: no secrets configured")
+	}
+	s.initOnce.Do(func() {
+		if s.DCs == nil {
+			s.DCs = telegram.NewDCMap()
+		}
+		// Handshakes older than twice the skew fail the clock check anyway
+		s.replays = newReplayCache(2*s.timeSkew(), replayCacheSize)
+	})
+
+	return socks5.Serve(l, s.Limits, s.logf, func(c net.Conn) {
+		if err := s.handle(c); err != nil {
+			s.logf("mtproto: client connection from %s failed: %v", c.RemoteAddr(), err)
+		}
+	})
+}
+
+func (s *Server) handle(c net.Conn) error {
+	if s.HandshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+
+	var client net.Conn = c
+	secrets := s.Secrets
+	if s.Domain != "" {
+		hello, err := readClientHello(c)
+		if err != nil && !errors.Is(err, errNotFakeTLS) {
+			return fmt.Errorf("read client hello: %w", err)
+		}
+		var ch *clientHello
+		if err == nil {
+			ch, err = verifyClientHello(hello, s.Secrets, s.Domain, s.timeSkew())
+		}
+		if err == nil && !s.replays.add(ch.random) {
+			err = errors.New("mtproto: replayed client hello")
+		}
+		if err != nil {
+			s.logf("mtproto: forwarding %s to %s: %v", c.RemoteAddr(), s.frontAddr(), err)
+			return s.front(c, hello)
+		}
+
+		resp, err := serverHello(ch)
+		if err != nil {
+			return err
+		}
+		if _, err := c.Write(resp); err != nil {
+			return err
+		}
+		client = &fakeTLSConn{Conn: c}
+		secrets = []Secret{*ch.secret}
+	}
+
+	init := make([]byte, handshakeLen)
+	if _, err := io.ReadFull(client, init); err != nil {
+		return fmt.Errorf("read handshake: %w", err)
+	}
+	hs, err := parseClientHandshake(init, secrets)
+	if err != nil {
+		return err
+	}
+	if s.Domain == "" && !s.replays.add(init[keyOffset:tagOffset]) {
+		return errors.New("mtproto: replayed handshake")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = session.WithClientAddr(ctx, c.RemoteAddr().String())
+	ctx = session.WithUsername(ctx, hs.secret.Name)
+	ctx = session.WithProtocol(ctx, session.ProtocolMTProto)
+
+	addr := s.DCs.Addr(hs.dc, s.PreferIPv6)
+	if addr == "" {
+		return fmt.Errorf("no address for DC %d", hs.dc)
+	}
+	srv, err := s.dial(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("dial DC %d at %s: %w", hs.dc, addr, err)
+	}
+	defer srv.Close()
+
+	dcInit, dcRead, dcWrite, err := newDCHandshake(hs.tag)
+	if err != nil {
+		return err
+	}
+	if _, err := srv.Write(dcInit); err != nil {
+		return fmt.Errorf("DC %d handshake: %w", hs.dc, err)
+	}
+	c.SetDeadline(time.Time{})
+
+	return s.relay(
+		newObfuscatedConn(client, hs.read, hs.write),
+		newObfuscatedConn(srv, dcRead, dcWrite),
+	)
+}
+
+// relay copies data between the client and srv with the session timeouts
+func (s *Server) relay(client, srv net.Conn) error {
+	expired, err := socks5.Relay(client, srv, socks5.SessionTimeouts{Idle: s.IdleTimeout, MaxLifetime: s.MaxLifetime})
+	if expired != "" {
+		s.logf("mtproto: closing session from %s: %s", client.RemoteAddr(), expired)
+	}
+	return err
+}
+
+func (s *Server) frontAddr() string {
+	if s.FrontAddr != "" {
+		return s.FrontAddr
+	}
+	return net.JoinHostPort(s.Domain, "443")
+}
+
+// front relays c to the real site of the fake-TLS domain, replaying what
+// was already read from c
+func (s *Server) front(c net.Conn, read []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = session.WithClientAddr(ctx, c.RemoteAddr().String())
+	ctx = session.WithProtocol(ctx, session.ProtocolMTProto)
+
+	dial := s.FrontDialer
+	if dial == nil {
+		dial = s.dial
+	}
+	srv, err := dial(ctx, "tcp", s.frontAddr())
+	if err != nil {
+		return fmt.Errorf("dial front: %w", err)
+	}
+	defer srv.Close()
+
+	if _, err := srv.Write(read); err != nil {
+		return err
+	}
+	c.SetDeadline(time.Time{})
+	return s.relay(c, srv)
+}
@@ -0,0 +1,186 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// The obfuscated2 handshake is 64 bytes: 8 random, 32 key, 16 IV, then
+// the protocol tag, the DC id and 2 random bytes, encrypted with the key
+// and IV themselves.
+const (
+	handshakeLen = 64
+	keyOffset    = 8
+	ivOffset     = 40
+	tagOffset    = 56
+	dcOffset     = 60
+)
+
+// Transport protocol tags of the handshake
+var (
+	tagAbridged     = []byte{0xef, 0xef, 0xef, 0xef}
+	tagIntermediate = []byte{0xee, 0xee, 0xee, 0xee}
+	tagPadded       = []byte{0xdd, 0xdd, 0xdd, 0xdd}
+)
+
+var errBadHandshake = errors.New("mtproto: handshake does not match any secret")
+
+// clientHandshake is a parsed obfuscated2 handshake from a client
+type clientHandshake struct {
+	secret *Secret
+	tag    []byte
+	dc     int
+	// read decrypts client data, write encrypts data sent to the client
+	read, write cipher.Stream
+}
+
+// parseClientHandshake finds the secret the handshake was made with.
+// The returned streams are positioned after the handshake.
+func parseClientHandshake(init []byte, secrets []Secret) (*clientHandshake, error) {
+	reversed := make([]byte, tagOffset-keyOffset)
+	copy(reversed, init[keyOffset:tagOffset])
+	reverse(reversed)
+
+	decrypted := make([]byte, handshakeLen)
+	for i := range secrets {
+		sec := &secrets[i]
+		read := newCTR(secretKey(init[keyOffset:ivOffset], sec.Key[:]), init[ivOffset:tagOffset])
+		read.XORKeyStream(decrypted, init)
+
+		tag := decrypted[tagOffset:dcOffset]
+		if !bytes.Equal(tag, tagAbridged) && !bytes.Equal(tag, tagIntermediate) && !bytes.Equal(tag, tagPadded) {
+			continue
+		}
+
+		return &clientHandshake{
+			secret: sec,
+			tag:    append([]byte(nil), tag...),
+			dc:     int(int16(binary.LittleEndian.Uint16(decrypted[dcOffset:]))),
+			read:   read,
+			write:  newCTR(secretKey(reversed[:32], sec.Key[:]), reversed[32:]),
+		}, nil
+	}
+	return nil, errBadHandshake
+}
+
+// newDCHandshake returns a handshake for a connection to a Telegram DC
+// speaking the transport of tag. The streams are positioned after it.
+func newDCHandshake(tag []byte) (init []byte, read, write cipher.Stream, err error) {
+	init = make([]byte, handshakeLen)
+	for {
+		if _, err := rand.Read(init); err != nil {
+			return nil, nil, nil, err
+		}
+		if validDCHandshake(init) {
+			break
+		}
+	}
+	copy(init[tagOffset:], tag)
+
+	reversed := make([]byte, tagOffset-keyOffset)
+	copy(reversed, init[keyOffset:tagOffset])
+	reverse(reversed)
+
+	write = newCTR(init[keyOffset:ivOffset], init[ivOffset:tagOffset])
+	read = newCTR(reversed[:32], reversed[32:])
+
+	// Only the tail is sent encrypted, the key and IV travel in clear
+	encrypted := make([]byte, handshakeLen)
+	write.XORKeyStream(encrypted, init)
+	copy(init[tagOffset:], encrypted[tagOffset:])
+	return init, read, write, nil
+}
+
+// validDCHandshake reports whether random handshake bytes cannot be
+// mistaken for another protocol by the DC
+func validDCHandshake(init []byte) bool {
+	if init[0] == 0xef {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(init) {
+	case 0x44414548, // HEAD
+		0x54534f50, // POST
+		0x20544547, // GET
+		0x4954504f, // OPTI
+		0x02010316, // TLS handshake
+		0xdddddddd,
+		0xeeeeeeee:
+		return false
+	}
+	return binary.LittleEndian.Uint32(init[4:]) != 0
+}
+
+func secretKey(key, secret []byte) []byte {
+	h := sha256.New()
+	h.Write(key)
+	h.Write(secret)
+	return h.Sum(nil)
+}
+
+func newCTR(key, iv []byte) cipher.Stream {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		// key is always 32 bytes
+		panic(err)
+	}
+	return cipher.NewCTR(block, iv)
+}
+
+func reverse(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
+
+// obfuscatedConn encrypts and decrypts a connection with AES-CTR
+type obfuscatedConn struct {
+	net.Conn
+	read, write cipher.Stream
+
+	mu  sync.Mutex // guards buf and the write stream
+	buf []byte
+}
+
+func newObfuscatedConn(conn net.Conn, read, write cipher.Stream) *obfuscatedConn {
+	return &obfuscatedConn{Conn: conn, read: read, write: write}
+}
+
+func (c *obfuscatedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func (c *obfuscatedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// p belongs to the caller, encrypt into our own buffer
+	if cap(c.buf) < len(p) {
+		c.buf = make([]byte, len(p))
+	}
+	buf := c.buf[:len(p)]
+	c.write.XORKeyStream(buf, p)
+
+	n, err := c.Conn.Write(buf)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// CloseWithReason passes the close reason on to the wrapped connection
+func (c *obfuscatedConn) CloseWithReason(reason string) error {
+	if rc, ok := c.Conn.(interface{ CloseWithReason(string) error }); ok {
+		return rc.CloseWithReason(reason)
+	}
+	return c.Conn.Close()
+}
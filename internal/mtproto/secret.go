@@ -0,0 +1,59 @@
+package mtproto
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// secretLen is the length of the key shared with Telegram clients
+const secretLen = 16
+
+// Secret is a client secret. The name ends up as the session username, so
+// per-user quotas and rate limits apply to everyone sharing the secret.
+type Secret struct {
+	Name string
+	Key  [secretLen]byte
+}
+
+// ParseSecret parses a hex secret. The dd and ee prefixes of client links
+// are accepted, the domain of an ee secret is ignored in favour of the
+// one the server is configured with.
+func ParseSecret(name, s string) (Secret, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) > 2*secretLen && (strings.HasPrefix(s, "dd") || strings.HasPrefix(s, "ee")) {
+		s = s[2:]
+	}
+	if len(s) < 2*secretLen {
+		return Secret{}, fmt.Errorf("secret %q: want %d hex bytes", name, secretLen)
+	}
+	b, err := hex.DecodeString(s[:2*secretLen])
+	if err != nil {
+		return Secret{}, fmt.Errorf("secret %q: %w", name, err)
+	}
+
+	sec := Secret{Name: name}
+	copy(sec.Key[:], b)
+	return sec, nil
+}
+
+// ClientSecret returns the secret as entered in Telegram clients. With a
+// fake-TLS domain it is the ee form, otherwise the dd form that makes
+// clients pad their packets.
+func (s Secret) ClientSecret(domain string) string {
+	if domain != "" {
+		return "ee" + hex.EncodeToString(s.Key[:]) + hex.EncodeToString([]byte(domain))
+	}
+	return "dd" + hex.EncodeToString(s.Key[:])
+}
+
+// Link returns the tg://proxy link for the secret
+func (s Secret) Link(host string, port int, domain string) string {
+	v := url.Values{}
+	v.Set("server", host)
+	v.Set("port", strconv.Itoa(port))
+	v.Set("secret", s.ClientSecret(domain))
+	return "tg://proxy?" + v.Encode()
+}
@@ -0,0 +1,224 @@
+// Package policy decides which destinations proxy clients may reach.
+package policy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Policy decides whether client may reach host:port over network
+type Policy interface {
+	Allow(ctx context.Context, client, network, host string, port uint16) Decision
+}
+
+// Decision is the outcome of a policy check
+type Decision struct {
+	Allowed bool
+	// Rule describes the rule that produced the decision, if any
+	Rule string
+	// Reason is a human readable explanation of the decision
+	Reason string
+	// Addrs are the destination addresses that passed the check. For host
+	// names these are the resolved addresses, for IP literals the IP itself.
+	Addrs []net.IP
+	// Err is set when the decision could not be made, e.g. on DNS failure
+	Err error
+}
+
+// Error returns nil for allowed destinations, a *DeniedError for denied
+// ones and Err, wrapped with the reason, if the decision failed
+func (d Decision) Error() error {
+	if d.Err != nil {
+		return fmt.Errorf("%s: %w", d.Reason, d.Err)
+	}
+	if !d.Allowed {
+		return &DeniedError{Rule: d.Rule, Reason: d.Reason}
+	}
+	return nil
+}
+
+// DeniedError is returned for destinations denied by policy
+type DeniedError struct {
+	Rule   string
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return e.Reason
+}
+
+// NotAllowed marks the error as a policy denial for the SOCKS5 server,
+// which reports it as "connection not allowed by ruleset"
+func (e *DeniedError) NotAllowed() bool {
+	return true
+}
+
+// Request describes a single destination being checked
+type Request struct {
+	Client  string
+	Network string // "tcp" or "udp"
+	Host    string // requested host name, empty for IP literals
+	IP      net.IP
+	Port    uint16
+}
+
+// Resolver resolves host names to addresses. *net.Resolver implements it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Engine is a Policy built from deny and allow rules. Deny rules take
+// precedence over allow rules; a request matching no allow rule is denied.
+type Engine struct {
+	resolver Resolver
+
+	mu    sync.RWMutex
+	deny  []Rule
+	allow []Rule
+}
+
+// NewEngine creates an engine with the given rules. If resolver is nil,
+// net.DefaultResolver is used.
+func NewEngine(resolver Resolver, deny, allow []Rule) *Engine {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &Engine{
+		resolver: resolver,
+		deny:     deny,
+		allow:    allow,
+	}
+}
+
+// SetRules replaces the rule set
+func (e *Engine) SetRules(deny, allow []Rule) {
+	e.mu.Lock()
+	e.deny = deny
+	e.allow = allow
+	e.mu.Unlock()
+}
+
+// Allow implements Policy. Host names are resolved and every address is
+// checked on its own, so a deny rule for a CIDR also applies to names that
+// resolve into it.
+func (e *Engine) Allow(ctx context.Context, client, network, host string, port uint16) Decision {
+	req := Request{
+		Client:  client,
+		Network: normalizeNetwork(network),
+		Port:    port,
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		req.IP = ip
+		d := e.Evaluate(&req)
+		if d.Allowed {
+			d.Addrs = []net.IP{ip}
+		}
+		return d
+	}
+
+	req.Host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	// Deny by name before spending a DNS lookup on it
+	if d, ok := e.matchDeny(&req); ok {
+		return d
+	}
+
+	addrs, err := e.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return Decision{
+			Reason: fmt.Sprintf("failed to resolve %s", host),
+			Err:    err,
+		}
+	}
+
+	var last Decision
+	var allowed []net.IP
+	for _, addr := range addrs {
+		r := req
+		r.IP = addr.IP
+		d := e.Evaluate(&r)
+		if d.Allowed {
+			if len(allowed) == 0 {
+				last = d
+			}
+			allowed = append(allowed, addr.IP)
+			continue
+		}
+		if !last.Allowed {
+			last = d
+		}
+	}
+
+	if len(allowed) == 0 {
+		if last.Reason == "" {
+			last.Reason = fmt.Sprintf("%s has no addresses", host)
+		}
+		return last
+	}
+
+	last.Addrs = allowed
+	return last
+}
+
+// Evaluate checks a single fully populated request against the rules
+func (e *Engine) Evaluate(req *Request) Decision {
+	if d, ok := e.matchDeny(req); ok {
+		return d
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, rule := range e.allow {
+		if rule.Match(req) {
+			return Decision{
+				Allowed: true,
+				Rule:    rule.String(),
+				Reason:  "allowed by " + rule.String(),
+			}
+		}
+	}
+
+	return Decision{Reason: fmt.Sprintf("%s is not in the whitelist", describe(req))}
+}
+
+func (e *Engine) matchDeny(req *Request) (Decision, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, rule := range e.deny {
+		if rule.Match(req) {
+			return Decision{
+				Rule:   rule.String(),
+				Reason: "denied by " + rule.String(),
+			}, true
+		}
+	}
+	return Decision{}, false
+}
+
+func normalizeNetwork(network string) string {
+	switch network {
+	case "tcp4", "tcp6":
+		return "tcp"
+	case "udp4", "udp6":
+		return "udp"
+	}
+	return network
+}
+
+func describe(req *Request) string {
+	port := fmt.Sprintf("%d", req.Port)
+	switch {
+	case req.Host != "" && req.IP != nil:
+		return fmt.Sprintf("%s (%s)", net.JoinHostPort(req.Host, port), req.IP)
+	case req.IP != nil:
+		return net.JoinHostPort(req.IP.String(), port)
+	default:
+		return net.JoinHostPort(req.Host, port)
+	}
+}
@@ -0,0 +1,236 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Rule matches destination requests
+type Rule interface {
+	Match(req *Request) bool
+	String() string
+}
+
+// hostRule matches the requested host name exactly or by "*.suffix" wildcard
+type hostRule struct {
+	exact    map[string]struct{}
+	suffixes []string
+	patterns []string
+}
+
+// Host returns a rule matching host names. A pattern of the form
+// "*.example.com" matches every subdomain of example.com, but not
+// example.com itself.
+func Host(patterns ...string) Rule {
+	r := &hostRule{exact: make(map[string]struct{})}
+	for _, p := range patterns {
+		p = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(p)), ".")
+		if p == "" {
+			continue
+		}
+		r.patterns = append(r.patterns, p)
+		if suffix, ok := strings.CutPrefix(p, "*"); ok {
+			r.suffixes = append(r.suffixes, suffix)
+			continue
+		}
+		r.exact[p] = struct{}{}
+	}
+	return r
+}
+
+func (r *hostRule) Match(req *Request) bool {
+	if req.Host == "" {
+		return false
+	}
+	if _, ok := r.exact[req.Host]; ok {
+		return true
+	}
+	for _, suffix := range r.suffixes {
+		if strings.HasSuffix(req.Host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *hostRule) String() string {
+	return "host " + strings.Join(r.patterns, ",")
+}
+
+// cidrRule matches the destination IP against a set of networks
+type cidrRule []*net.IPNet
+
+// CIDR returns a rule matching destination addresses inside any of nets
+func CIDR(nets ...*net.IPNet) Rule {
+	return cidrRule(nets)
+}
+
+// ParseCIDR returns a CIDR rule for the given networks in CIDR notation
+func ParseCIDR(cidrs ...string) (Rule, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(c))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", c, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return CIDR(nets...), nil
+}
+
+func (r cidrRule) Match(req *Request) bool {
+	if req.IP == nil {
+		return false
+	}
+	for _, ipNet := range r {
+		if ipNet.Contains(req.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r cidrRule) String() string {
+	parts := make([]string, len(r))
+	for i, ipNet := range r {
+		parts[i] = ipNet.String()
+	}
+	return "cidr " + strings.Join(parts, ",")
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Lo, Hi uint16
+}
+
+// ParsePortRange parses "443" or "8000-9000"
+func ParsePortRange(s string) (PortRange, error) {
+	s = strings.TrimSpace(s)
+	lo, hi, isRange := strings.Cut(s, "-")
+	start, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	end := start
+	if isRange {
+		end, err = strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+		if err != nil {
+			return PortRange{}, fmt.Errorf("invalid port %q", s)
+		}
+	}
+	if end < start {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{Lo: uint16(start), Hi: uint16(end)}, nil
+}
+
+func (p PortRange) String() string {
+	if p.Lo == p.Hi {
+		return strconv.Itoa(int(p.Lo))
+	}
+	return fmt.Sprintf("%d-%d", p.Lo, p.Hi)
+}
+
+type portRule []PortRange
+
+// Ports returns a rule matching destination ports inside any of ranges
+func Ports(ranges ...PortRange) Rule {
+	return portRule(ranges)
+}
+
+func (r portRule) Match(req *Request) bool {
+	for _, p := range r {
+		if req.Port >= p.Lo && req.Port <= p.Hi {
+			return true
+		}
+	}
+	return false
+}
+
+func (r portRule) String() string {
+	parts := make([]string, len(r))
+	for i, p := range r {
+		parts[i] = p.String()
+	}
+	return "port " + strings.Join(parts, ",")
+}
+
+type networkRule []string
+
+// Network returns a rule matching the transport, "tcp" or "udp"
+func Network(networks ...string) Rule {
+	r := make(networkRule, 0, len(networks))
+	for _, n := range networks {
+		r = append(r, normalizeNetwork(strings.ToLower(strings.TrimSpace(n))))
+	}
+	return r
+}
+
+func (r networkRule) Match(req *Request) bool {
+	for _, n := range r {
+		if n == req.Network {
+			return true
+		}
+	}
+	return false
+}
+
+func (r networkRule) String() string {
+	return "network " + strings.Join(r, ",")
+}
+
+type allRule []Rule
+
+// All returns a rule matching when every one of rules matches
+func All(rules ...Rule) Rule {
+	if len(rules) == 1 {
+		return rules[0]
+	}
+	return allRule(rules)
+}
+
+func (r allRule) Match(req *Request) bool {
+	for _, rule := range r {
+		if !rule.Match(req) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r allRule) String() string {
+	return joinRules(r, " and ")
+}
+
+type anyRule []Rule
+
+// Any returns a rule matching when at least one of rules matches
+func Any(rules ...Rule) Rule {
+	if len(rules) == 1 {
+		return rules[0]
+	}
+	return anyRule(rules)
+}
+
+func (r anyRule) Match(req *Request) bool {
+	for _, rule := range r {
+		if rule.Match(req) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r anyRule) String() string {
+	return "(" + joinRules(r, " or ") + ")"
+}
+
+func joinRules(rules []Rule, sep string) string {
+	parts := make([]string, len(rules))
+	for i, rule := range rules {
+		parts[i] = rule.String()
+	}
+	return strings.Join(parts, sep)
+}
@@ -0,0 +1,143 @@
+package policy
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot is an immutable view of the whitelist. A new snapshot is built
+// on every refresh and swapped in atomically, so readers never observe a
+// half-updated whitelist.
+type Snapshot struct {
+	// Generation increases by one with every swapped-in snapshot
+	Generation uint64
+	// RefreshedAt is when the snapshot was built
+	RefreshedAt time.Time
+
+	// Hosts are matched by name
+	Hosts map[string]struct{}
+	// Resolved maps host names to the addresses they resolved to
+	Resolved map[string][]ResolvedIP
+	// Ranges are plain IP ranges
+	Ranges []*net.IPNet
+
+	ips map[string]time.Time // address -> latest expiry
+}
+
+// ResolvedIP is an address resolved from a whitelisted host name
+type ResolvedIP struct {
+	IP        net.IP
+	ExpiresAt time.Time
+}
+
+// Whitelist is an allow rule fed from the `whitelist` config section: host
+// names, the addresses they resolve to and plain IP ranges.
+type Whitelist struct {
+	current atomic.Pointer[Snapshot]
+}
+
+// NewWhitelist creates an empty whitelist
+func NewWhitelist() *Whitelist {
+	w := &Whitelist{}
+	w.current.Store(&Snapshot{
+		Hosts:    map[string]struct{}{},
+		Resolved: map[string][]ResolvedIP{},
+		ips:      map[string]time.Time{},
+	})
+	return w
+}
+
+// Snapshot returns the current snapshot
+func (w *Whitelist) Snapshot() *Snapshot {
+	return w.current.Load()
+}
+
+// Replace builds a new snapshot from hosts, resolved addresses and ranges
+// and swaps it in. Expired addresses are dropped.
+func (w *Whitelist) Replace(hosts []string, resolved map[string][]ResolvedIP, ranges []*net.IPNet) *Snapshot {
+	now := time.Now()
+	snap := &Snapshot{
+		RefreshedAt: now,
+		Hosts:       make(map[string]struct{}, len(hosts)),
+		Resolved:    make(map[string][]ResolvedIP, len(resolved)),
+		Ranges:      append([]*net.IPNet(nil), ranges...),
+		ips:         make(map[string]time.Time),
+	}
+
+	for _, h := range hosts {
+		snap.Hosts[normalizeHost(h)] = struct{}{}
+	}
+
+	for host, ips := range resolved {
+		var live []ResolvedIP
+		for _, r := range ips {
+			if !r.ExpiresAt.After(now) {
+				continue
+			}
+			live = append(live, r)
+			key := r.IP.String()
+			if r.ExpiresAt.After(snap.ips[key]) {
+				snap.ips[key] = r.ExpiresAt
+			}
+		}
+		if len(live) > 0 {
+			snap.Resolved[normalizeHost(host)] = live
+		}
+	}
+
+	for {
+		prev := w.current.Load()
+		snap.Generation = prev.Generation + 1
+		if w.current.CompareAndSwap(prev, snap) {
+			return snap
+		}
+	}
+}
+
+// IPCount returns the number of distinct resolved addresses
+func (s *Snapshot) IPCount() int {
+	return len(s.ips)
+}
+
+// ContainsIP reports whether ip is a resolved address that has not expired
+func (s *Snapshot) ContainsIP(ip net.IP) bool {
+	expiresAt, ok := s.ips[ip.String()]
+	return ok && time.Now().Before(expiresAt)
+}
+
+// Match implements Rule
+func (w *Whitelist) Match(req *Request) bool {
+	snap := w.current.Load()
+
+	if req.Host != "" {
+		if _, ok := snap.Hosts[req.Host]; ok {
+			return true
+		}
+	}
+
+	if req.IP == nil {
+		return false
+	}
+
+	if snap.ContainsIP(req.IP) {
+		return true
+	}
+
+	for _, ipNet := range snap.Ranges {
+		if ipNet.Contains(req.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// String implements Rule
+func (w *Whitelist) String() string {
+	return "whitelist"
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
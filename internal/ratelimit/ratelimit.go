@@ -0,0 +1,259 @@
+// Package ratelimit shapes proxied traffic with token buckets.
+//
+// Limits apply globally, per client IP (or per user when the user has an
+// override) and per connection. A connection waits on every bucket that
+// applies to it, so the strictest one wins.
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// minBurst keeps buckets large enough for a full UDP datagram and a
+// reasonable TCP read
+const minBurst = 64 << 10
+
+// Limits are rates in bytes per second. Zero means unlimited. Burst is the
+// bucket size; zero means one second worth of traffic.
+type Limits struct {
+	Upload   int64
+	Download int64
+	Burst    int64
+}
+
+// IsZero reports whether no limit is set
+func (l Limits) IsZero() bool {
+	return l.Upload <= 0 && l.Download <= 0
+}
+
+// Config holds all rate limits
+type Config struct {
+	Global        Limits
+	PerClient     Limits
+	PerConnection Limits
+	// PerUser replaces PerClient for connections of the given users
+	PerUser map[string]Limits
+}
+
+// bucket is a pair of token buckets for both directions. A nil limiter
+// means that direction is unlimited.
+type bucket struct {
+	up, down *rate.Limiter
+	refs     int
+}
+
+func newBucket(l Limits) *bucket {
+	return &bucket{
+		up:   newLimiter(l.Upload, l.Burst),
+		down: newLimiter(l.Download, l.Burst),
+	}
+}
+
+func newLimiter(bytesPerSec, burst int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burstFor(bytesPerSec, burst))
+}
+
+func burstFor(bytesPerSec, burst int64) int {
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	return int(max(burst, minBurst))
+}
+
+// retune applies l to the bucket in place. It fails if a direction would
+// switch between limited and unlimited, which needs a new bucket.
+func (b *bucket) retune(l Limits) bool {
+	if (b.up == nil) != (l.Upload <= 0) || (b.down == nil) != (l.Download <= 0) {
+		return false
+	}
+	if b.up != nil {
+		b.up.SetLimit(rate.Limit(l.Upload))
+		b.up.SetBurst(burstFor(l.Upload, l.Burst))
+	}
+	if b.down != nil {
+		b.down.SetLimit(rate.Limit(l.Download))
+		b.down.SetBurst(burstFor(l.Download, l.Burst))
+	}
+	return true
+}
+
+// Limiter hands out rate limited connections
+type Limiter struct {
+	mu      sync.Mutex
+	cfg     Config
+	global  *bucket
+	clients map[string]*bucket
+	users   map[string]*bucket
+}
+
+// New creates a limiter for cfg
+func New(cfg Config) *Limiter {
+	return &Limiter{
+		cfg:     cfg,
+		global:  newBucket(cfg.Global),
+		clients: make(map[string]*bucket),
+		users:   make(map[string]*bucket),
+	}
+}
+
+// Wrap returns conn shaped by the limits for clientIP and username.
+// Writes to conn count as upload, reads as download. Closing the returned
+// connection releases the shared buckets it holds.
+func (l *Limiter) Wrap(conn net.Conn, clientIP, username string) net.Conn {
+	var shared *bucket
+	var release func()
+
+	l.mu.Lock()
+	cfg, global := l.cfg, l.global
+	l.mu.Unlock()
+
+	if userLimits, ok := cfg.PerUser[username]; ok && username != "" {
+		shared, release = l.acquire(l.users, username, userLimits)
+	} else if !cfg.PerClient.IsZero() {
+		shared, release = l.acquire(l.clients, clientIP, cfg.PerClient)
+	}
+
+	buckets := []*bucket{global, shared}
+	if !cfg.PerConnection.IsZero() {
+		buckets = append(buckets, newBucket(cfg.PerConnection))
+	}
+
+	lc := &limitedConn{Conn: conn, release: release}
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		if b.up != nil {
+			lc.up = append(lc.up, b.up)
+		}
+		if b.down != nil {
+			lc.down = append(lc.down, b.down)
+		}
+	}
+	if len(lc.up) == 0 && len(lc.down) == 0 {
+		if release != nil {
+			release()
+		}
+		return conn
+	}
+
+	// Packet conns must read whole datagrams, only streams are chunked
+	if _, ok := conn.(net.PacketConn); !ok {
+		lc.maxRead = minBurst
+		for _, lim := range lc.down {
+			lc.maxRead = min(lc.maxRead, lim.Burst())
+		}
+	}
+
+	lc.ctx, lc.cancel = context.WithCancel(context.Background())
+	return lc
+}
+
+// acquire returns the shared bucket for key, creating it if needed
+func (l *Limiter) acquire(buckets map[string]*bucket, key string, limits Limits) (*bucket, func()) {
+	l.mu.Lock()
+	b, ok := buckets[key]
+	if !ok {
+		b = newBucket(limits)
+		buckets[key] = b
+	}
+	b.refs++
+	l.mu.Unlock()
+
+	return b, func() {
+		l.mu.Lock()
+		b.refs--
+		// SetConfig may have replaced the bucket of key meanwhile
+		if b.refs == 0 && buckets[key] == b {
+			delete(buckets, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// SetConfig replaces the limits. Shared buckets are retuned in place, so
+// open connections follow the new global, per-client and per-user rates;
+// their per-connection limits stay. Where a rate is added or removed
+// altogether, only new connections see the change.
+func (l *Limiter) SetConfig(cfg Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cfg = cfg
+	if !l.global.retune(cfg.Global) {
+		l.global = newBucket(cfg.Global)
+	}
+	for key, b := range l.clients {
+		if cfg.PerClient.IsZero() || !b.retune(cfg.PerClient) {
+			delete(l.clients, key)
+		}
+	}
+	for username, b := range l.users {
+		limits, ok := cfg.PerUser[username]
+		if !ok || !b.retune(limits) {
+			delete(l.users, username)
+		}
+	}
+}
+
+// limitedConn waits on its buckets before writes and after reads
+type limitedConn struct {
+	net.Conn
+	up, down []*rate.Limiter
+	maxRead  int
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if c.maxRead > 0 && len(p) > c.maxRead {
+		p = p[:c.maxRead]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		// The data is already here, a failed wait only means we are closing
+		_ = wait(c.ctx, c.down, n)
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	if err := wait(c.ctx, c.up, len(p)); err != nil {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		if c.release != nil {
+			c.release()
+		}
+	})
+	return c.Conn.Close()
+}
+
+// wait takes n tokens from every limiter, in chunks no larger than its burst
+func wait(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	for _, lim := range limiters {
+		for left := n; left > 0; {
+			chunk := min(left, lim.Burst())
+			if err := lim.WaitN(ctx, chunk); err != nil {
+				return err
+			}
+			left -= chunk
+		}
+	}
+	return nil
+}
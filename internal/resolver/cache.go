@@ -0,0 +1,66 @@
+package resolver
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// cache holds answers until their TTL expires
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+func newCache(size int) *cache {
+	return &cache{size: size, entries: make(map[string]cacheEntry)}
+}
+
+// get returns the cached addresses for key and their remaining TTL
+func (c *cache) get(key string) ([]net.IP, time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+	ttl := time.Until(e.expires)
+	if ttl <= 0 {
+		delete(c.entries, key)
+		return nil, 0, false
+	}
+	return e.ips, ttl, true
+}
+
+func (c *cache) put(key string, ips []net.IP, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		c.evict()
+	}
+	c.entries[key] = cacheEntry{ips: ips, expires: time.Now().Add(ttl)}
+}
+
+// evict drops expired entries. If that frees less than a tenth of the
+// cache, arbitrary entries go too, so a full cache is not scanned on every
+// insert.
+func (c *cache) evict() {
+	now := time.Now()
+	for key, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) <= c.size-c.size/10-1 {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,110 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// connectionAttemptDelay is how long a connection attempt runs alone
+// before the next address is tried as well (RFC 8305)
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// sortAddrs orders ips for happy eyeballs: the preferred family first,
+// then alternating between the families
+func sortAddrs(ips []net.IP, preferIPv6 bool) []net.IP {
+	var preferred, other []net.IP
+	for _, ip := range ips {
+		if (ip.To4() == nil) == preferIPv6 {
+			preferred = append(preferred, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(preferred) || i < len(other); i++ {
+		if i < len(preferred) {
+			sorted = append(sorted, preferred[i])
+		}
+		if i < len(other) {
+			sorted = append(sorted, other[i])
+		}
+	}
+	return sorted
+}
+
+// DialParallel connects to the first of ips that answers, happy eyeballs
+// style (RFC 8305): the addresses are tried in the preferred family
+// first, alternating with the other one, and the next attempt starts
+// whenever the previous one failed or ran for connectionAttemptDelay. It
+// returns the connection and its address; connections of the losing
+// attempts are closed.
+func DialParallel(ctx context.Context, ips []net.IP, preferIPv6 bool, dial func(ctx context.Context, ip net.IP) (net.Conn, error)) (net.Conn, net.IP, error) {
+	if len(ips) == 0 {
+		return nil, nil, errors.New("no addresses to dial")
+	}
+	ips = sortAddrs(ips, preferIPv6)
+	if len(ips) == 1 {
+		conn, err := dial(ctx, ips[0])
+		return conn, ips[0], err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		ip   net.IP
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next := 0
+	start := func() {
+		ip := ips[next]
+		next++
+		go func() {
+			conn, err := dial(ctx, ip)
+			results <- result{conn, ip, err}
+		}()
+	}
+
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+
+	start()
+	var firstErr error
+	for running := 1; running > 0; {
+		select {
+		case res := <-results:
+			running--
+			if res.err == nil {
+				// Close the connections of attempts that still succeed
+				pending := running
+				go func() {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}()
+				return res.conn, res.ip, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(ips) {
+				start()
+				running++
+				timer.Reset(connectionAttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				running++
+				timer.Reset(connectionAttemptDelay)
+			}
+		}
+	}
+	return nil, nil, firstErr
+}
@@ -0,0 +1,64 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soaska/proxy/internal/policy"
+)
+
+// Route resolves host names matching Rule with Resolver. Only the host
+// name of the request is set when the rule is evaluated.
+type Route struct {
+	Rule     policy.Rule
+	Resolver *Resolver
+}
+
+// Mux picks a resolver per host name, the first matching route winning
+type Mux struct {
+	mu       sync.RWMutex
+	fallback *Resolver
+	routes   []Route
+}
+
+// NewMux creates a mux resolving names without a matching route with
+// fallback
+func NewMux(fallback *Resolver, routes []Route) *Mux {
+	return &Mux{fallback: fallback, routes: routes}
+}
+
+// Update replaces the resolvers of m with those of other
+func (m *Mux) Update(other *Mux) {
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fallback = other.fallback
+	m.routes = other.routes
+}
+
+// For returns the resolver of host
+func (m *Mux) For(host string) *Resolver {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	req := &policy.Request{Host: strings.TrimSuffix(strings.ToLower(host), ".")}
+	for _, route := range m.routes {
+		if route.Rule.Match(req) {
+			return route.Resolver
+		}
+	}
+	return m.fallback
+}
+
+// LookupIPAddr implements policy.Resolver
+func (m *Mux) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return m.For(host).LookupIPAddr(ctx, host)
+}
+
+// LookupTTL resolves host like Resolver.LookupTTL
+func (m *Mux) LookupTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	return m.For(host).LookupTTL(ctx, host)
+}
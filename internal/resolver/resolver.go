@@ -0,0 +1,305 @@
+// Package resolver resolves host names over plain DNS, DNS over TLS or DNS
+// over HTTPS, caching answers for their record TTL. It replaces the system
+// resolver, whose answers for Telegram domains are poisoned by some ISPs.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// queryTimeout bounds a single query to one server
+	queryTimeout = 3 * time.Second
+	// negativeTTL caches names without records of a family
+	negativeTTL = 30 * time.Second
+	// defaultCacheSize is used when Config.CacheSize is zero
+	defaultCacheSize = 10000
+)
+
+// Config configures a Resolver
+type Config struct {
+	// Servers are queried in order until one answers. If empty, the
+	// nameservers from /etc/resolv.conf are used, falling back to the
+	// standard resolver if they all fail.
+	Servers []Server
+	// CacheSize is the maximum number of cached answers, negative
+	// disables the cache
+	CacheSize int
+	// MinTTL and MaxTTL clamp record TTLs, zero means no clamp
+	MinTTL time.Duration
+	MaxTTL time.Duration
+}
+
+// Resolver resolves host names to addresses. It is safe for concurrent
+// use.
+type Resolver struct {
+	servers []Server
+	system  bool
+	minTTL  time.Duration
+	maxTTL  time.Duration
+	cache   *cache
+}
+
+// New creates a resolver
+func New(cfg Config) *Resolver {
+	r := &Resolver{
+		servers: cfg.Servers,
+		minTTL:  cfg.MinTTL,
+		maxTTL:  cfg.MaxTTL,
+	}
+	if len(r.servers) == 0 {
+		r.servers = SystemServers()
+		r.system = true
+	}
+	size := cfg.CacheSize
+	if size == 0 {
+		size = defaultCacheSize
+	}
+	if size > 0 {
+		r.cache = newCache(size)
+	}
+	return r
+}
+
+// String returns the servers of the resolver
+func (r *Resolver) String() string {
+	names := make([]string, 0, len(r.servers))
+	for _, s := range r.servers {
+		names = append(names, s.String())
+	}
+	if r.system {
+		return "system (" + strings.Join(names, ", ") + ")"
+	}
+	return strings.Join(names, ", ")
+}
+
+// LookupIPAddr resolves host to its IPv6 and IPv4 addresses. It
+// implements policy.Resolver.
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, _, err := r.LookupTTL(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, nil
+}
+
+// LookupTTL resolves host and returns how long the answer stays valid,
+// which is zero when it came from the standard resolver. AAAA and A are
+// queried at once and both answers are returned; once one arrives the
+// other gets queryTimeout before the lookup returns without it. Dialers
+// order the families, see DialParallel.
+func (r *Resolver) LookupTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+	name := strings.TrimSuffix(strings.ToLower(host), ".") + "."
+
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	results := make(chan result, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA} {
+		go func() {
+			ips, ttl, err := r.lookup(ctx, name, qtype)
+			results <- result{ips, ttl, err}
+		}()
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	var errs []error
+	var delay <-chan time.Time
+	answered := 0
+collect:
+	for pending := 2; pending > 0; pending-- {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				errs = append(errs, res.err)
+				continue
+			}
+			answered++
+			ips = append(ips, res.ips...)
+			if len(res.ips) > 0 && (ttl == 0 || res.ttl < ttl) {
+				ttl = res.ttl
+			}
+			if len(ips) > 0 && delay == nil {
+				delay = time.After(queryTimeout)
+			}
+		case <-delay:
+			break collect
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+
+	if answered == 0 {
+		if r.system {
+			return lookupStandard(ctx, host)
+		}
+		return nil, 0, fmt.Errorf("resolve %s: %w", host, errors.Join(errs...))
+	}
+	if len(ips) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, ttl, nil
+}
+
+// lookup returns the records of one type, from the cache if possible
+func (r *Resolver) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	key := qtype.String() + " " + name
+	if r.cache != nil {
+		if ips, ttl, ok := r.cache.get(key); ok {
+			return ips, ttl, nil
+		}
+	}
+
+	// The query outlives the caller, so a late answer still fills the cache
+	qctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout*time.Duration(len(r.servers)))
+	defer cancel()
+	ips, ttl, err := r.query(qctx, name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ttl = r.clamp(ttl)
+	if len(ips) == 0 {
+		ttl = min(ttl, negativeTTL)
+	}
+	if r.cache != nil && ttl > 0 {
+		r.cache.put(key, ips, ttl)
+	}
+	return ips, ttl, nil
+}
+
+func (r *Resolver) clamp(ttl time.Duration) time.Duration {
+	if r.minTTL > 0 && ttl < r.minTTL {
+		ttl = r.minTTL
+	}
+	if r.maxTTL > 0 && ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	return ttl
+}
+
+// query asks the servers in order until one answers. NXDOMAIN is an
+// answer, without records.
+func (r *Resolver) query(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	query, err := buildQuery(n, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var errs []error
+	for _, server := range r.servers {
+		sctx, cancel := context.WithTimeout(ctx, queryTimeout)
+		resp, err := server.Exchange(sctx, query)
+		cancel()
+		if err == nil {
+			var ips []net.IP
+			var ttl time.Duration
+			ips, ttl, err = parseAnswer(resp, query, qtype)
+			if err == nil {
+				return ips, ttl, nil
+			}
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", server, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, errors.Join(errs...)
+}
+
+func buildQuery(name dnsmessage.Name, qtype dnsmessage.Type) ([]byte, error) {
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(maxUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+		Additionals: []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}},
+	}
+	return msg.Pack()
+}
+
+// parseAnswer extracts the addresses of qtype from resp and the smallest
+// record TTL. CNAME chains are followed by the recursive server, so every
+// address record of the answer section belongs to the name.
+func parseAnswer(resp, query []byte, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, 0, err
+	}
+	// DoH servers may answer with ID 0
+	if msg.ID != uint16(query[0])<<8|uint16(query[1]) && msg.ID != 0 {
+		return nil, 0, errors.New("DNS response ID mismatch")
+	}
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, negativeTTL, nil
+	default:
+		return nil, 0, fmt.Errorf("DNS query failed: %s", msg.RCode)
+	}
+
+	var ips []net.IP
+	var minTTL uint32
+	for _, rr := range msg.Answers {
+		if rr.Header.Type != qtype {
+			continue
+		}
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		default:
+			continue
+		}
+		if minTTL == 0 || rr.Header.TTL < minTTL {
+			minTTL = rr.Header.TTL
+		}
+	}
+	if len(ips) == 0 {
+		return nil, negativeTTL, nil
+	}
+	return ips, time.Duration(minTTL) * time.Second, nil
+}
+
+// lookupStandard resolves host with the standard resolver, which does not
+// expose TTLs
+func lookupStandard(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, 0, nil
+}
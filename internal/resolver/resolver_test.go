@@ -0,0 +1,94 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeServer answers A and AAAA queries, each after its own delay
+type fakeServer struct {
+	a, aaaa           net.IP
+	aDelay, aaaaDelay time.Duration
+}
+
+func (s *fakeServer) String() string { return "fake" }
+
+func (s *fakeServer) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil {
+		return nil, err
+	}
+	question := q.Questions[0]
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.ID, Response: true},
+		Questions: q.Questions,
+	}
+	hdr := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	delay := s.aDelay
+	switch question.Type {
+	case dnsmessage.TypeA:
+		resp.Answers = []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AResource{A: [4]byte(s.a.To4())}}}
+	case dnsmessage.TypeAAAA:
+		delay = s.aaaaDelay
+		resp.Answers = []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: [16]byte(s.aaaa.To16())}}}
+	}
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return resp.Pack()
+}
+
+// TestLookupTTLWaitsForBothFamilies checks a slow family is not dropped
+func TestLookupTTLWaitsForBothFamilies(t *testing.T) {
+	server := &fakeServer{
+		a:         net.ParseIP("192.0.2.1"),
+		aaaa:      net.ParseIP("2001:db8::1"),
+		aaaaDelay: 200 * time.Millisecond,
+	}
+	r := New(Config{Servers: []Server{server}, CacheSize: -1})
+
+	ips, ttl, err := r.LookupTTL(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(server.a) && !ips[1].Equal(server.a) {
+		t.Errorf("LookupTTL() = %v, want both %v and %v", ips, server.a, server.aaaa)
+	}
+	if ttl != time.Minute {
+		t.Errorf("LookupTTL() ttl = %v, want 1m", ttl)
+	}
+}
+
+func TestDialParallelOrder(t *testing.T) {
+	v4a, v4b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	v6a, v6b := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	ips := []net.IP{v4a, v4b, v6a, v6b}
+	tests := []struct {
+		preferIPv6 bool
+		want       []net.IP
+	}{
+		{true, []net.IP{v6a, v4a, v6b, v4b}},
+		{false, []net.IP{v4a, v6a, v4b, v6b}},
+	}
+	for _, tt := range tests {
+		var tried []net.IP
+		_, _, err := DialParallel(context.Background(), ips, tt.preferIPv6, func(ctx context.Context, ip net.IP) (net.Conn, error) {
+			tried = append(tried, ip)
+			return nil, errors.New("refused")
+		})
+		if err == nil {
+			t.Fatal("DialParallel() succeeded, want the dial error")
+		}
+		if !slices.EqualFunc(tried, tt.want, net.IP.Equal) {
+			t.Errorf("DialParallel(preferIPv6=%v) tried %v, want %v", tt.preferIPv6, tried, tt.want)
+		}
+	}
+}
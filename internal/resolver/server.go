@@ -0,0 +1,206 @@
+package resolver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	resolvConfPath = "/etc/resolv.conf"
+	maxUDPSize     = 1232
+)
+
+// Server exchanges raw DNS messages with a nameserver
+type Server interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// ParseServer parses a nameserver address:
+//
+//	1.1.1.1, udp://1.1.1.1:53   plain DNS over UDP, TCP for truncated answers
+//	tls://1.1.1.1:853           DNS over TLS, the host is the TLS server name
+//	https://1.1.1.1/dns-query   DNS over HTTPS
+func ParseServer(s string) (Server, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS server %q: %w", s, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid DNS server %q: no host", s)
+	}
+
+	withPort := func(port string) string {
+		if u.Port() != "" {
+			return u.Host
+		}
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	switch u.Scheme {
+	case "udp":
+		return &udpServer{addr: withPort("53")}, nil
+	case "tls":
+		return &tlsServer{addr: withPort("853"), serverName: u.Hostname()}, nil
+	case "https":
+		return &httpsServer{url: u.String(), client: &http.Client{Timeout: queryTimeout}}, nil
+	}
+	return nil, fmt.Errorf("invalid DNS server %q: unknown scheme %q", s, u.Scheme)
+}
+
+// SystemServers returns the nameservers from /etc/resolv.conf, or the
+// local resolver if there are none
+func SystemServers() []Server {
+	var servers []Server
+	if f, err := os.Open(resolvConfPath); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, &udpServer{addr: net.JoinHostPort(fields[1], "53")})
+			}
+		}
+		f.Close()
+	}
+	if len(servers) == 0 {
+		servers = []Server{&udpServer{addr: "127.0.0.1:53"}}
+	}
+	return servers
+}
+
+// udpServer is a plain nameserver, queried over TCP when the UDP answer
+// is truncated
+type udpServer struct {
+	addr string
+}
+
+func (s *udpServer) String() string { return "udp://" + s.addr }
+
+func (s *udpServer) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Skip stray datagrams, e.g. late answers to an earlier query
+		if n < 3 || !bytes.Equal(buf[:2], query[:2]) {
+			continue
+		}
+		if buf[2]&0x02 == 0 { // TC bit
+			return buf[:n], nil
+		}
+		break
+	}
+
+	tcp, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer tcp.Close()
+	setDeadline(ctx, tcp)
+	return exchangeStream(tcp, query)
+}
+
+// tlsServer speaks DNS over TLS (RFC 7858)
+type tlsServer struct {
+	addr       string
+	serverName string
+}
+
+func (s *tlsServer) String() string { return "tls://" + s.addr }
+
+func (s *tlsServer) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	d := tls.Dialer{Config: &tls.Config{ServerName: s.serverName, MinVersion: tls.VersionTLS12}}
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+	return exchangeStream(conn, query)
+}
+
+// httpsServer speaks DNS over HTTPS (RFC 8484)
+type httpsServer struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpsServer) String() string { return s.url }
+
+func (s *httpsServer) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// exchangeStream sends query with the length prefix of DNS over TCP and
+// reads the answer
+func exchangeStream(conn net.Conn, query []byte) ([]byte, error) {
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < 2 || !bytes.Equal(resp[:2], query[:2]) {
+		return nil, errors.New("DNS response ID mismatch")
+	}
+	return resp, nil
+}
+
+func setDeadline(ctx context.Context, conn net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(queryTimeout))
+	}
+}
@@ -0,0 +1,66 @@
+// Package session carries the values of a proxy session, like the client
+// address and the authenticated user, through the context handed to
+// dialers. Every listener protocol fills them the same way so the dial
+// path does not care which protocol a client used.
+package session
+
+import "context"
+
+// Protocols recorded for proxied connections
+const (
+	ProtocolSOCKS5  = "socks5"
+	ProtocolHTTP    = "http"
+	ProtocolMTProto = "mtproto"
+)
+
+type clientAddrKey struct{}
+
+type usernameKey struct{}
+
+type protocolKey struct{}
+
+// WithClientAddr returns ctx carrying the remote client address (host:port)
+func WithClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// ClientAddr returns the remote client address stored in ctx, or "" if
+// there is none
+func ClientAddr(ctx context.Context) string {
+	return value(ctx, clientAddrKey{})
+}
+
+// WithUsername returns ctx carrying the authenticated username. An empty
+// username leaves ctx as is.
+func WithUsername(ctx context.Context, username string) context.Context {
+	if username == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, usernameKey{}, username)
+}
+
+// Username returns the username the client authenticated with, or "" for
+// unauthenticated sessions
+func Username(ctx context.Context) string {
+	return value(ctx, usernameKey{})
+}
+
+// WithProtocol returns ctx carrying the protocol the client spoke
+func WithProtocol(ctx context.Context, protocol string) context.Context {
+	return context.WithValue(ctx, protocolKey{}, protocol)
+}
+
+// Protocol returns the protocol stored in ctx, or "" if there is none
+func Protocol(ctx context.Context) string {
+	return value(ctx, protocolKey{})
+}
+
+func value(ctx context.Context, key any) string {
+	if ctx == nil {
+		return ""
+	}
+	if v, ok := ctx.Value(key).(string); ok {
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,235 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// PeerWrapper may be implemented by listeners returned from Server.Listen
+// to wrap the accepted BIND peer, e.g. for accounting. Connections from
+// unexpected peers are closed without being wrapped.
+type PeerWrapper interface {
+	WrapPeer(conn net.Conn) net.Conn
+}
+
+// PeerAddrs may be implemented by listeners returned from Server.Listen
+// to name the addresses the BIND peer may connect from, typically the
+// ones DST.ADDR resolved to when the request was checked. Without it the
+// server resolves DST.ADDR itself.
+type PeerAddrs interface {
+	PeerAddrs() []net.IP
+}
+
+// bindAcceptTimeout is how long a BIND listener waits for the peer
+const bindAcceptTimeout = 2 * time.Minute
+
+// handleBind implements the BIND command of RFC 1928. The first reply
+// carries the address the server listens on, the second one the address
+// of the peer that connected to it.
+func (c *Conn) handleBind() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = c.context(ctx)
+
+	ln, err := c.srv.listen(ctx, c)
+	if err != nil {
+		res := errorResponse(replyForError(err))
+		buf, _ := res.marshal()
+		c.clientConn.Write(buf)
+		return err
+	}
+	defer ln.Close()
+
+	expected, err := c.expectedPeers(ctx, ln)
+	if err != nil {
+		res := errorResponse(replyForError(err))
+		buf, _ := res.marshal()
+		c.clientConn.Write(buf)
+		return err
+	}
+
+	// Replace a wildcard listen address with the one the client reached
+	// us on, clients cannot hand 0.0.0.0 to the peer
+	bindAddr := ln.Addr()
+	if tcpAddr, ok := bindAddr.(*net.TCPAddr); ok && tcpAddr.IP.IsUnspecified() {
+		if local, ok := c.clientConn.LocalAddr().(*net.TCPAddr); ok {
+			bindAddr = &net.TCPAddr{IP: local.IP, Port: tcpAddr.Port}
+		}
+	}
+	if err := c.writeAddrReply(bindAddr); err != nil {
+		return err
+	}
+
+	// The client stays quiet until the second reply. Watch its connection
+	// meanwhile so a client that goes away frees the port.
+	watch := c.watchClient(ln)
+	peer, err := acceptPeer(ln, expected)
+	early, gone := watch()
+	if gone {
+		if peer != nil {
+			peer.Close()
+		}
+		return fmt.Errorf("bind accept: %w", errClientGone)
+	}
+	if err != nil {
+		res := errorResponse(replyForError(err))
+		buf, _ := res.marshal()
+		c.clientConn.Write(buf)
+		return fmt.Errorf("bind accept: %w", err)
+	}
+	if pw, ok := ln.(PeerWrapper); ok {
+		peer = pw.WrapPeer(peer)
+	}
+	defer peer.Close()
+
+	// Nobody else may connect to this port anymore
+	ln.Close()
+
+	if err := c.writeAddrReply(peer.RemoteAddr()); err != nil {
+		return err
+	}
+	if len(early) > 0 {
+		if _, err := peer.Write(early); err != nil {
+			return err
+		}
+	}
+	return c.relay(peer)
+}
+
+var errClientGone = errors.New("client went away")
+
+// maxEarlyData caps what a client may send before the peer connects, a
+// client sending more is dropped
+const maxEarlyData = 64 << 10
+
+// watchClient reads the client connection in the background and closes ln
+// once the client hangs up. The returned stop func ends the watch and
+// reports the data the client sent early and whether it went away.
+func (c *Conn) watchClient(ln net.Listener) (stop func() (early []byte, gone bool)) {
+	var early []byte
+	var gone bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4096)
+		for {
+			n, err := c.clientConn.Read(buf)
+			early = append(early, buf[:n]...)
+			if err != nil {
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					gone = true
+					ln.Close()
+				}
+				return
+			}
+			if len(early) > maxEarlyData {
+				gone = true
+				ln.Close()
+				return
+			}
+		}
+	}()
+
+	return func() ([]byte, bool) {
+		c.clientConn.SetReadDeadline(time.Now())
+		<-done
+		c.clientConn.SetReadDeadline(time.Time{})
+		return early, gone
+	}
+}
+
+func (s *Server) listen(ctx context.Context, c *Conn) (net.Listener, error) {
+	if s.Listen != nil {
+		return s.Listen(ctx, "tcp", c.request.destination.hostPort())
+	}
+	host, _, err := net.SplitHostPort(c.clientConn.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	var lc net.ListenConfig
+	return lc.Listen(ctx, "tcp", net.JoinHostPort(host, "0"))
+}
+
+// expectedPeers returns the addresses the peer may connect from. A
+// request without a specific peer is refused, anyone could connect to
+// the port otherwise.
+func (c *Conn) expectedPeers(ctx context.Context, ln net.Listener) ([]net.IP, error) {
+	var addrs []net.IP
+	dst := c.request.destination
+	if pa, ok := ln.(PeerAddrs); ok {
+		addrs = pa.PeerAddrs()
+	} else if dst.addrType != domainName {
+		if ip := net.ParseIP(dst.addr); ip != nil {
+			addrs = []net.IP{ip}
+		}
+	} else {
+		resolved, err := net.DefaultResolver.LookupIPAddr(ctx, dst.addr)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range resolved {
+			addrs = append(addrs, addr.IP)
+		}
+	}
+
+	var ips []net.IP
+	for _, ip := range addrs {
+		if !ip.IsUnspecified() {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errNoBindPeer
+	}
+	return ips, nil
+}
+
+// acceptPeer accepts connections on ln until one comes from an expected
+// address. Others are closed right away.
+func acceptPeer(ln net.Listener, expected []net.IP) (net.Conn, error) {
+	if dl, ok := ln.(interface{ SetDeadline(time.Time) error }); ok {
+		dl.SetDeadline(time.Now().Add(bindAcceptTimeout))
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return nil, err
+		}
+		remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if ok {
+			for _, ip := range expected {
+				if ip.Equal(remote.IP) {
+					return conn, nil
+				}
+			}
+		}
+		conn.Close()
+	}
+}
+
+// writeAddrReply sends a success reply carrying addr
+func (c *Conn) writeAddrReply(addr net.Addr) error {
+	host, port, err := splitHostPort(addr.String())
+	if err != nil {
+		return err
+	}
+	res := &response{
+		reply: success,
+		bindAddr: socksAddr{
+			addrType: getAddrType(host),
+			addr:     host,
+			port:     port,
+		},
+	}
+	buf, err := res.marshal()
+	if err != nil {
+		return err
+	}
+	_, err = c.clientConn.Write(buf)
+	return err
+}
@@ -0,0 +1,151 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startServer serves SOCKS5 without auth on a loopback port
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.Serve(ln)
+	return ln.Addr().String()
+}
+
+// bindRequest sends a BIND for 127.0.0.1 and returns the port of the first
+// reply
+func bindRequest(t *testing.T, conn net.Conn) int {
+	t.Helper()
+	reply := sendBind(t, conn, net.IPv4(127, 0, 0, 1))
+	if reply[1] != byte(success) {
+		t.Fatalf("first BIND reply = %d, want success", reply[1])
+	}
+	return int(binary.BigEndian.Uint16(reply[8:]))
+}
+
+// sendBind sends a BIND for peer and returns the first reply
+func sendBind(t *testing.T, conn net.Conn, peer net.IP) []byte {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write([]byte{socks5Version, 1, noAuthRequired}); err != nil {
+		t.Fatal(err)
+	}
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		t.Fatal(err)
+	}
+
+	req := []byte{socks5Version, byte(bind), 0, byte(ipv4)}
+	req = append(req, peer.To4()...)
+	req = append(req, 0, 0)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestBindRelay(t *testing.T) {
+	addr := startServer(t, &Server{Logf: t.Logf})
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	port := bindRequest(t, client)
+
+	// Data sent before the peer connects reaches it once it does
+	if _, err := client.Write([]byte("early")); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != byte(success) {
+		t.Fatalf("second BIND reply = %d, want success", reply[1])
+	}
+
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(peer, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("early")) {
+		t.Fatalf("peer got %q, want %q", got, "early")
+	}
+	if _, err := peer.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	got = make([]byte, 4)
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("pong")) {
+		t.Fatalf("client got %q, want %q", got, "pong")
+	}
+}
+
+func TestBindAbandonedReleasesPort(t *testing.T) {
+	addr := startServer(t, &Server{Logf: t.Logf})
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := bindRequest(t, client)
+	client.Close()
+
+	// The listener closes well before the accept timeout
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err == nil {
+			ln.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("port %d still in use after the client left: %v", port, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBindWithoutPeerRefused(t *testing.T) {
+	addr := startServer(t, &Server{Logf: t.Logf})
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	reply := sendBind(t, client, net.IPv4zero)
+	if reply[1] != byte(connectionNotAllowed) {
+		t.Fatalf("BIND for 0.0.0.0 reply = %d, want %d", reply[1], connectionNotAllowed)
+	}
+}
@@ -0,0 +1,60 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// errUnsupportedAddrType is returned for requests with an unknown ATYP.
+var errUnsupportedAddrType = errors.New("unsupported address type")
+
+// errNoBindPeer is returned for BIND requests whose DST.ADDR names no
+// specific peer, which would let anyone connect to the port.
+var errNoBindPeer = errors.New("BIND request names no peer address")
+
+// notAllowedError is implemented by Dialer errors for destinations the
+// server refuses by policy, such as policy.DeniedError.
+type notAllowedError interface {
+	NotAllowed() bool
+}
+
+// replyForError maps a request or dial error to the SOCKS5 reply code
+// sent to the client.
+func replyForError(err error) replyCode {
+	var denied notAllowedError
+	if errors.As(err, &denied) && denied.NotAllowed() {
+		return connectionNotAllowed
+	}
+
+	switch {
+	case errors.Is(err, errNoBindPeer):
+		return connectionNotAllowed
+	case errors.Is(err, errUnsupportedAddrType):
+		return addrTypeNotSupported
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return connectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return hostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return networkUnreachable
+	case errors.Is(err, context.DeadlineExceeded):
+		return ttlExpired
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return ttlExpired
+		}
+		return hostUnreachable
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ttlExpired
+	}
+
+	return generalFailure
+}
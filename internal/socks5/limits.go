@@ -0,0 +1,186 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Reasons passed to Limits.OnReject.
+const (
+	RejectMaxConns      = "max connections reached"
+	RejectMaxConnsPerIP = "max connections per IP reached"
+	RejectConnRate      = "connection rate per IP exceeded"
+)
+
+// clientSweepInterval is how often idle per-IP entries are dropped
+const clientSweepInterval = time.Minute
+
+// Limits caps the connections accepted by Serve. Servers sharing a Limits
+// share its counters, so the caps hold across all their listeners. A nil
+// *Limits has no limits.
+type Limits struct {
+	// MaxConns limits the number of connections served at once.
+	// Zero means no limit.
+	MaxConns int
+	// MaxConnsPerIP limits concurrent connections from a single client IP.
+	// Zero means no limit.
+	MaxConnsPerIP int
+	// ConnRatePerIP limits new connections per second from a single client
+	// IP, allowing bursts of ConnBurstPerIP. Zero means no limit.
+	ConnRatePerIP  float64
+	ConnBurstPerIP int
+
+	// OnReject, if set, is called for every connection closed by the
+	// limits above, with one of the Reject* reasons.
+	OnReject func(remoteAddr net.Addr, reason string)
+
+	mu        sync.Mutex
+	active    int
+	clients   map[string]*clientConns
+	lastSweep time.Time
+}
+
+// clientConns is the state of a single client IP
+type clientConns struct {
+	active  int
+	accepts *rate.Limiter
+}
+
+func (l *Limits) enabled() bool {
+	return l != nil && (l.MaxConns > 0 || l.MaxConnsPerIP > 0 || l.ConnRatePerIP > 0)
+}
+
+// admit checks a freshly accepted connection against the limits. It
+// returns a release func to call once the connection is done, or the
+// reason the connection was rejected.
+func (l *Limits) admit(c net.Conn) (release func(), reason string) {
+	if !l.enabled() {
+		return func() {}, ""
+	}
+
+	ip := remoteIP(c.RemoteAddr())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.clients == nil {
+		l.clients = make(map[string]*clientConns)
+	}
+	if now.Sub(l.lastSweep) > clientSweepInterval {
+		l.sweep(now)
+	}
+
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientConns{}
+		if l.ConnRatePerIP > 0 {
+			burst := l.ConnBurstPerIP
+			if burst <= 0 {
+				burst = max(1, int(l.ConnRatePerIP))
+			}
+			client.accepts = rate.NewLimiter(rate.Limit(l.ConnRatePerIP), burst)
+		}
+		l.clients[ip] = client
+	}
+
+	// The rate is charged for rejected attempts too, so a client hammering
+	// the port stays throttled
+	if client.accepts != nil && !client.accepts.AllowN(now, 1) {
+		return nil, RejectConnRate
+	}
+	if l.MaxConns > 0 && l.active >= l.MaxConns {
+		return nil, RejectMaxConns
+	}
+	if l.MaxConnsPerIP > 0 && client.active >= l.MaxConnsPerIP {
+		return nil, RejectMaxConnsPerIP
+	}
+
+	l.active++
+	client.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.active--
+			client.active--
+			l.mu.Unlock()
+		})
+	}, ""
+}
+
+// sweep drops clients without connections whose accept bucket is full
+// again. Must be called with l.mu held.
+func (l *Limits) sweep(now time.Time) {
+	l.lastSweep = now
+	for ip, client := range l.clients {
+		if client.active > 0 {
+			continue
+		}
+		if client.accepts != nil && client.accepts.TokensAt(now) < float64(client.accepts.Burst()) {
+			continue
+		}
+		delete(l.clients, ip)
+	}
+}
+
+// Serve accepts connections on ln and runs handle for each in its own
+// goroutine, closing the connection once handle returns. Connections
+// over limits are closed right away. Running out of file descriptors
+// pauses accepting instead of shutting down, any other Accept error is
+// returned. The SOCKS5, HTTP and MTProto servers all accept through it.
+func Serve(ln net.Listener, limits *Limits, logf func(format string, args ...any), handle func(c net.Conn)) error {
+	defer ln.Close()
+	var backoff time.Duration
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			// Running out of file descriptors is temporary, wait for
+			// connections to close instead of shutting down
+			if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+				backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+				logf("accept error: %v; retrying in %v", err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+
+		release, reason := limits.admit(c)
+		if reason != "" {
+			c.Close()
+			if limits.OnReject != nil {
+				limits.OnReject(c.RemoteAddr(), reason)
+			}
+			continue
+		}
+
+		go func() {
+			defer release()
+			defer c.Close()
+			handle(c)
+		}()
+	}
+}
+
+// remoteIP returns the host part of addr
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
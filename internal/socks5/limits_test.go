@@ -0,0 +1,65 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestServeSharedLimits accepts on two listeners sharing one Limits, the
+// per-IP cap must hold across both
+func TestServeSharedLimits(t *testing.T) {
+	rejected := make(chan string, 1)
+	limits := &Limits{
+		MaxConnsPerIP: 1,
+		OnReject: func(_ net.Addr, reason string) {
+			rejected <- reason
+		},
+	}
+	hold := make(chan struct{})
+	defer close(hold)
+	handle := func(c net.Conn) {
+		c.Write([]byte{1})
+		<-hold
+	}
+
+	var addrs []string
+	for range 2 {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go Serve(ln, limits, t.Logf, handle)
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	first, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(first, make([]byte, 1)); err != nil {
+		t.Fatalf("first connection not served: %v", err)
+	}
+
+	second, err := net.Dial("tcp", addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := second.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("second connection served %d bytes, want it closed", n)
+	}
+	select {
+	case reason := <-rejected:
+		if reason != RejectMaxConnsPerIP {
+			t.Errorf("reject reason = %q, want %q", reason, RejectMaxConnsPerIP)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnReject not called")
+	}
+}
@@ -0,0 +1,120 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// spliceChunk is how much the splice relay moves before reporting the
+// bytes to the upstream's counter
+const spliceChunk = 64 << 10
+
+// trafficCounter is implemented by upstream wrappers that only count
+// traffic, like the stats tracker. The relay may bypass them through
+// NetConn to keep the splice(2) fast path and reports the bytes itself.
+// Wrappers that shape traffic must not implement it.
+type trafficCounter interface {
+	NetConn() net.Conn
+	AddBytesIn(n int64)
+	AddBytesOut(n int64)
+}
+
+// relay copies data between the client and srv until either side closes
+// or a session timeout fires
+func (c *Conn) relay(srv net.Conn) error {
+	reason, err := Relay(c.clientConn, srv, c.srv.sessionTimeouts())
+	// A timeout has already closed both sides, it is not a failure
+	if reason != "" {
+		c.logf("closing session from %s: %s", c.clientConn.RemoteAddr(), reason)
+		return nil
+	}
+	return err
+}
+
+// Relay copies data between client and srv until either side closes or
+// one of the timeouts fires, then closes srv with the reason. The client
+// is left to the caller unless a timeout closed it. Between two TCP
+// sockets the data is spliced, with srv bypassed if it only counts
+// traffic. Relay returns the timeout that ended the session, if any.
+func Relay(client, srv net.Conn, timeouts SessionTimeouts) (expired string, err error) {
+	toClient := func(wd *watchdog) error {
+		_, err := io.Copy(wd.writer(client), srv)
+		return err
+	}
+	toBackend := func(wd *watchdog) error {
+		_, err := io.Copy(wd.writer(srv), client)
+		return err
+	}
+	var progress func() int64
+
+	// Between two TCP sockets io.Copy uses splice, as long as it sees
+	// the sockets themselves
+	clientTCP, clientOK := client.(*net.TCPConn)
+	counter, counterOK := srv.(trafficCounter)
+	if spliceSupported && clientOK && counterOK {
+		if backend, ok := counter.NetConn().(*net.TCPConn); ok {
+			toClient = func(*watchdog) error {
+				return spliceCopy(clientTCP, backend, counter.AddBytesIn)
+			}
+			toBackend = func(*watchdog) error {
+				return spliceCopy(backend, clientTCP, counter.AddBytesOut)
+			}
+			progress = tcpProgress(clientTCP, backend)
+		}
+	}
+
+	wd := newWatchdog(timeouts, func(reason string) {
+		closeWithReason(srv, reason)
+		client.Close()
+	}, progress)
+	defer wd.stop()
+
+	type result struct {
+		reason string
+		err    error
+	}
+	errc := make(chan result, 2)
+	go func() {
+		err := toClient(wd)
+		if err != nil {
+			err = fmt.Errorf("from backend to client: %w", err)
+		}
+		errc <- result{CloseTarget, err}
+	}()
+	go func() {
+		err := toBackend(wd)
+		if err != nil {
+			err = fmt.Errorf("from client to backend: %w", err)
+		}
+		errc <- result{CloseClient, err}
+	}()
+	done := <-errc
+
+	if reason := wd.Reason(); reason != "" {
+		return reason, nil
+	}
+	closeWithReason(srv, done.reason)
+	return "", done.err
+}
+
+// spliceCopy copies src to dst in chunks of spliceChunk, calling count
+// after each. TCPConn.ReadFrom splices from a LimitedReader over a
+// TCPConn, so the data never enters userspace.
+func spliceCopy(dst, src *net.TCPConn, count func(int64)) error {
+	lr := &io.LimitedReader{R: src}
+	for {
+		lr.N = spliceChunk
+		n, err := dst.ReadFrom(lr)
+		if n > 0 {
+			count(n)
+		}
+		if err != nil {
+			return err
+		}
+		// A short chunk without error means EOF
+		if n < spliceChunk {
+			return nil
+		}
+	}
+}
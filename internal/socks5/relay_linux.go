@@ -0,0 +1,32 @@
+package socks5
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// spliceSupported reports whether io.Copy between TCP sockets uses splice
+const spliceSupported = true
+
+// tcpProgress returns a counter of the bytes the kernel has moved on the
+// given sockets. Spliced data is only reported in chunks, this lets the
+// idle timeout see traffic in between.
+func tcpProgress(conns ...*net.TCPConn) func() int64 {
+	return func() int64 {
+		var total int64
+		for _, conn := range conns {
+			raw, err := conn.SyscallConn()
+			if err != nil {
+				continue
+			}
+			raw.Control(func(fd uintptr) {
+				info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+				if err == nil {
+					total += int64(info.Bytes_acked + info.Bytes_received)
+				}
+			})
+		}
+		return total
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package socks5
+
+import "net"
+
+// spliceSupported reports whether io.Copy between TCP sockets uses splice
+const spliceSupported = false
+
+func tcpProgress(...*net.TCPConn) func() int64 {
+	return nil
+}
@@ -0,0 +1,48 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayIdleTimeout(t *testing.T) {
+	client, clientPeer := net.Pipe()
+	srv, srvPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer srvPeer.Close()
+
+	done := make(chan string, 1)
+	go func() {
+		expired, err := Relay(client, srv, SessionTimeouts{Idle: 50 * time.Millisecond})
+		if err != nil {
+			t.Errorf("Relay() error = %v", err)
+		}
+		done <- expired
+	}()
+
+	// Traffic keeps the session alive past the timeout
+	go func() {
+		buf := make([]byte, 4)
+		for {
+			if _, err := srvPeer.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	for range 4 {
+		if _, err := clientPeer.Write([]byte("ping")); err != nil {
+			t.Fatalf("session closed while active: %v", err)
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+
+	select {
+	case expired := <-done:
+		if expired != CloseIdleTimeout {
+			t.Errorf("Relay() expired = %q, want %q", expired, CloseIdleTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle session not closed")
+	}
+}
@@ -22,24 +22,31 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/soaska/proxy/internal/session"
 	"tailscale.com/types/logger"
 )
 
-// clientAddrContextKey is the context key used to propagate the SOCKS5 client address.
-type clientAddrContextKey struct{}
-
 // ClientAddr returns the remote client address (host:port) stored in the context.
 // It returns an empty string when the value is not available.
 func ClientAddr(ctx context.Context) string {
-	if ctx == nil {
-		return ""
-	}
-	if addr, ok := ctx.Value(clientAddrContextKey{}).(string); ok {
-		return addr
-	}
-	return ""
+	return session.ClientAddr(ctx)
+}
+
+// Username returns the username the client authenticated with.
+// It returns an empty string for unauthenticated sessions.
+func Username(ctx context.Context) string {
+	return session.Username(ctx)
+}
+
+// Authenticator verifies the credentials sent by clients with the
+// username/password method of RFC 1929.
+type Authenticator interface {
+	// Authenticate returns nil if the credentials are valid.
+	Authenticate(ctx context.Context, username, password string) error
 }
 
 // Authentication METHODs described in RFC 1928, section 3.
@@ -96,11 +103,8 @@ const (
 	addrTypeNotSupported replyCode = 8
 )
 
-// UDP conn default buffer size and read timeout.
-const (
-	bufferSize  = 8 * 1024
-	readTimeout = 5 * time.Second
-)
+// bufferSize is the largest UDP payload relayed.
+const bufferSize = 8 * 1024
 
 // Server is a SOCKS5 proxy server.
 type Server struct {
@@ -112,9 +116,52 @@ type Server struct {
 	// If nil, the net package's standard dialer is used.
 	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
 
+	// Listen optionally opens the listener for BIND requests. addr is the
+	// DST.ADDR of the request, the peer expected to connect. If nil, the
+	// server listens on the address the client connected to.
+	Listen func(ctx context.Context, network, addr string) (net.Listener, error)
+
+	// Authenticator, if set, verifies client credentials and takes
+	// precedence over Username and Password.
+	Authenticator Authenticator
+
 	// Username and Password, if set, are the credential clients must provide.
 	Username string
 	Password string
+
+	// Limits, if set, caps the accepted connections. It may be shared with
+	// other servers.
+	Limits *Limits
+
+	// HandshakeTimeout limits the time a client has to send its greeting,
+	// credentials and request. Zero means no limit.
+	HandshakeTimeout time.Duration
+	// IdleTimeout closes sessions without traffic in either direction for
+	// that long. Zero means no limit.
+	IdleTimeout time.Duration
+	// MaxLifetime closes sessions older than that. Zero means no limit.
+	MaxLifetime time.Duration
+
+	// UDPTargetTimeout closes the upstream socket of a UDP association to
+	// a target after that long without traffic. Zero means two minutes.
+	UDPTargetTimeout time.Duration
+
+	// UDPTracker, if set, accounts UDP association traffic per target.
+	UDPTracker UDPTracker
+}
+
+func (s *Server) needAuth() bool {
+	return s.Authenticator != nil || s.Username != "" || s.Password != ""
+}
+
+func (s *Server) authenticate(ctx context.Context, user, pwd string) error {
+	if s.Authenticator != nil {
+		return s.Authenticator.Authenticate(ctx, user, pwd)
+	}
+	if user != s.Username || pwd != s.Password {
+		return errors.New("invalid credentials")
+	}
+	return nil
 }
 
 func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -136,21 +183,12 @@ func (s *Server) logf(format string, args ...any) {
 
 // Serve accepts and handles incoming connections on the given listener.
 func (s *Server) Serve(l net.Listener) error {
-	defer l.Close()
-	for {
-		c, err := l.Accept()
-		if err != nil {
-			return err
+	return Serve(l, s.Limits, s.logf, func(c net.Conn) {
+		conn := &Conn{logf: s.logf, clientConn: c, srv: s}
+		if err := conn.Run(); err != nil {
+			s.logf("client connection failed: %v", err)
 		}
-		go func() {
-			defer c.Close()
-			conn := &Conn{logf: s.Logf, clientConn: c, srv: s}
-			err := conn.Run()
-			if err != nil {
-				s.logf("client connection failed: %v", err)
-			}
-		}()
-	}
+	})
 }
 
 // Conn is a SOCKS5 connection for client to reach
@@ -163,14 +201,23 @@ type Conn struct {
 	srv        *Server
 	clientConn net.Conn
 	request    *request
+	username   string
 
-	udpClientAddr  net.Addr
-	udpTargetConns map[socksAddr]net.Conn
+	udpClientAddr  atomic.Pointer[net.UDPAddr]
+	udpMu          sync.Mutex // guards udpTargetConns, udpDialing and udpClosed
+	udpTargetConns map[socksAddr]*udpTarget
+	udpDialing     map[socksAddr]bool
+	udpClosed      bool
+	udpWatchdog    *watchdog
 }
 
 // Run starts the new connection.
 func (c *Conn) Run() error {
-	needAuth := c.srv.Username != "" || c.srv.Password != ""
+	if c.srv.HandshakeTimeout > 0 {
+		c.clientConn.SetDeadline(time.Now().Add(c.srv.HandshakeTimeout))
+	}
+
+	needAuth := c.srv.needAuth()
 	authMethod := noAuthRequired
 	if needAuth {
 		authMethod = passwordAuth
@@ -187,28 +234,48 @@ func (c *Conn) Run() error {
 	}
 
 	user, pwd, err := parseClientAuth(c.clientConn)
-	if err != nil || user != c.srv.Username || pwd != c.srv.Password {
+	if err != nil {
 		c.clientConn.Write([]byte{1, 1}) // auth error
 		return err
 	}
+	if err := c.srv.authenticate(context.Background(), user, pwd); err != nil {
+		c.clientConn.Write([]byte{1, 1}) // auth error
+		return fmt.Errorf("authentication failed for user %q: %w", user, err)
+	}
 	c.clientConn.Write([]byte{1, 0}) // auth success
+	c.username = user
 
 	return c.handleRequest()
 }
 
+// context returns ctx populated with the session values
+func (c *Conn) context(ctx context.Context) context.Context {
+	ctx = session.WithClientAddr(ctx, c.clientConn.RemoteAddr().String())
+	ctx = session.WithUsername(ctx, c.username)
+	return session.WithProtocol(ctx, session.ProtocolSOCKS5)
+}
+
 func (c *Conn) handleRequest() error {
 	req, err := parseClientRequest(c.clientConn)
 	if err != nil {
-		res := errorResponse(generalFailure)
+		res := errorResponse(replyForError(err))
 		buf, _ := res.marshal()
 		c.clientConn.Write(buf)
 		return err
 	}
 
 	c.request = req
+
+	// The handshake is over, from here on the session timeouts apply
+	if c.srv.HandshakeTimeout > 0 {
+		c.clientConn.SetDeadline(time.Time{})
+	}
+
 	switch req.command {
 	case connect:
 		return c.handleTCP()
+	case bind:
+		return c.handleBind()
 	case udpAssociate:
 		return c.handleUDP()
 	default:
@@ -222,7 +289,7 @@ func (c *Conn) handleRequest() error {
 func (c *Conn) handleTCP() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	ctx = context.WithValue(ctx, clientAddrContextKey{}, c.clientConn.RemoteAddr().String())
+	ctx = c.context(ctx)
 
 	srv, err := c.srv.dial(
 		ctx,
@@ -230,7 +297,7 @@ func (c *Conn) handleTCP() error {
 		c.request.destination.hostPort(),
 	)
 	if err != nil {
-		res := errorResponse(generalFailure)
+		res := errorResponse(replyForError(err))
 		buf, _ := res.marshal()
 		c.clientConn.Write(buf)
 		return err
@@ -258,22 +325,7 @@ func (c *Conn) handleTCP() error {
 	}
 	c.clientConn.Write(buf)
 
-	errc := make(chan error, 2)
-	go func() {
-		_, err := io.Copy(c.clientConn, srv)
-		if err != nil {
-			err = fmt.Errorf("from backend to client: %w", err)
-		}
-		errc <- err
-	}()
-	go func() {
-		_, err := io.Copy(srv, c.clientConn)
-		if err != nil {
-			err = fmt.Errorf("from client to backend: %w", err)
-		}
-		errc <- err
-	}()
-	return <-errc
+	return c.relay(srv)
 }
 
 func (c *Conn) handleUDP() error {
@@ -283,8 +335,7 @@ func (c *Conn) handleUDP() error {
 	// to the association.
 	// @see Page 6, https://datatracker.ietf.org/doc/html/rfc1928.
 	//
-	// We do NOT limit the access from the client currently in this implementation.
-	_ = c.request.destination
+	// Access is limited in acceptUDPFrom.
 
 	addr := c.clientConn.LocalAddr()
 	host, _, err := net.SplitHostPort(addr.String())
@@ -323,157 +374,6 @@ func (c *Conn) handleUDP() error {
 	return c.transferUDP(c.clientConn, clientUDPConn)
 }
 
-func (c *Conn) transferUDP(associatedTCP net.Conn, clientConn net.PacketConn) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// client -> target
-	go func() {
-		defer cancel()
-
-		c.udpTargetConns = make(map[socksAddr]net.Conn)
-		// close all target udp connections when the client connection is closed
-		defer func() {
-			for _, conn := range c.udpTargetConns {
-				_ = conn.Close()
-			}
-		}()
-
-		buf := make([]byte, bufferSize)
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				err := c.handleUDPRequest(ctx, clientConn, buf)
-				if err != nil {
-					if isTimeout(err) {
-						continue
-					}
-					if errors.Is(err, net.ErrClosed) {
-						return
-					}
-					c.logf("udp transfer: handle udp request fail: %v", err)
-				}
-			}
-		}
-	}()
-
-	// A UDP association terminates when the TCP connection that the UDP
-	// ASSOCIATE request arrived on terminates. RFC1928
-	_, err := io.Copy(io.Discard, associatedTCP)
-	if err != nil {
-		err = fmt.Errorf("udp associated tcp conn: %w", err)
-	}
-	return err
-}
-
-func (c *Conn) getOrDialTargetConn(
-	ctx context.Context,
-	clientConn net.PacketConn,
-	targetAddr socksAddr,
-) (net.Conn, error) {
-	conn, exist := c.udpTargetConns[targetAddr]
-	if exist {
-		return conn, nil
-	}
-	conn, err := c.srv.dial(ctx, "udp", targetAddr.hostPort())
-	if err != nil {
-		return nil, err
-	}
-	c.udpTargetConns[targetAddr] = conn
-
-	// target -> client
-	go func() {
-		buf := make([]byte, bufferSize)
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				err := c.handleUDPResponse(clientConn, targetAddr, conn, buf)
-				if err != nil {
-					if isTimeout(err) {
-						continue
-					}
-					if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
-						return
-					}
-					c.logf("udp transfer: handle udp response fail: %v", err)
-				}
-			}
-		}
-	}()
-
-	return conn, nil
-}
-
-func (c *Conn) handleUDPRequest(
-	ctx context.Context,
-	clientConn net.PacketConn,
-	buf []byte,
-) error {
-	// add a deadline for the read to avoid blocking forever
-	_ = clientConn.SetReadDeadline(time.Now().Add(readTimeout))
-	n, addr, err := clientConn.ReadFrom(buf)
-	if err != nil {
-		return fmt.Errorf("read from client: %w", err)
-	}
-	c.udpClientAddr = addr
-	req, data, err := parseUDPRequest(buf[:n])
-	if err != nil {
-		return fmt.Errorf("parse udp request: %w", err)
-	}
-
-	targetConn, err := c.getOrDialTargetConn(ctx, clientConn, req.addr)
-	if err != nil {
-		return fmt.Errorf("dial target %s fail: %w", req.addr, err)
-	}
-
-	nn, err := targetConn.Write(data)
-	if err != nil {
-		return fmt.Errorf("write to target %s fail: %w", req.addr, err)
-	}
-	if nn != len(data) {
-		return fmt.Errorf("write to target %s fail: %w", req.addr, io.ErrShortWrite)
-	}
-	return nil
-}
-
-func (c *Conn) handleUDPResponse(
-	clientConn net.PacketConn,
-	targetAddr socksAddr,
-	targetConn net.Conn,
-	buf []byte,
-) error {
-	// add a deadline for the read to avoid blocking forever
-	_ = targetConn.SetReadDeadline(time.Now().Add(readTimeout))
-	n, err := targetConn.Read(buf)
-	if err != nil {
-		return fmt.Errorf("read from target: %w", err)
-	}
-	hdr := udpRequest{addr: targetAddr}
-	pkt, err := hdr.marshal()
-	if err != nil {
-		return fmt.Errorf("marshal udp request: %w", err)
-	}
-	data := append(pkt, buf[:n]...)
-	// use addr from client to send back
-	nn, err := clientConn.WriteTo(data, c.udpClientAddr)
-	if err != nil {
-		return fmt.Errorf("write to client: %w", err)
-	}
-	if nn != len(data) {
-		return fmt.Errorf("write to client: %w", io.ErrShortWrite)
-	}
-	return nil
-}
-
-func isTimeout(err error) bool {
-	terr, ok := errors.Unwrap(err).(interface{ Timeout() bool })
-	return ok && terr.Timeout()
-}
-
 func splitHostPort(hostport string) (host string, port uint16, err error) {
 	host, portStr, err := net.SplitHostPort(hostport)
 	if err != nil {
@@ -618,7 +518,7 @@ func parseSocksAddr(r io.Reader) (addr socksAddr, err error) {
 		}
 		destination = net.IP(ip[:]).String()
 	default:
-		return socksAddr{}, fmt.Errorf("unsupported address type")
+		return socksAddr{}, fmt.Errorf("%w %d", errUnsupportedAddrType, dstAddrType)
 	}
 	var portBytes [2]byte
 	_, err = io.ReadFull(r, portBytes[:])
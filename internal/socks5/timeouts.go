@@ -0,0 +1,168 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons passed to CloseWithReason when the server closes an upstream
+// connection.
+const (
+	CloseClient      = "client closed"
+	CloseTarget      = "target closed"
+	CloseIdleTimeout = "idle timeout"
+	CloseMaxLifetime = "max lifetime"
+	CloseAssociation = "association closed"
+)
+
+// reasonCloser is implemented by connections returned from Server.Dialer
+// that want to know why the server closed them.
+type reasonCloser interface {
+	CloseWithReason(reason string) error
+}
+
+// closeWithReason closes conn, passing reason along if conn supports it
+func closeWithReason(conn net.Conn, reason string) error {
+	if rc, ok := conn.(reasonCloser); ok {
+		return rc.CloseWithReason(reason)
+	}
+	return conn.Close()
+}
+
+// watchdog ends a session after the idle timeout without traffic or after
+// the max lifetime, whichever comes first.
+type watchdog struct {
+	idle   time.Duration
+	last   atomic.Int64 // unix nanos of the last activity
+	expire func(reason string)
+	reason atomic.Pointer[string]
+	once   sync.Once
+
+	// progress, if set, reports a counter that grows with traffic the
+	// watchdog does not see, like data moved by splice
+	progress     func() int64
+	lastProgress int64
+
+	mu       sync.Mutex // guards the timers, they may fire while being set
+	idleT    *time.Timer
+	lifetime *time.Timer
+}
+
+// SessionTimeouts end a relayed session, zero disables a timeout.
+type SessionTimeouts struct {
+	// Idle closes sessions without traffic in either direction for that
+	// long.
+	Idle time.Duration
+	// MaxLifetime closes sessions older than that.
+	MaxLifetime time.Duration
+}
+
+func (s *Server) sessionTimeouts() SessionTimeouts {
+	return SessionTimeouts{Idle: s.IdleTimeout, MaxLifetime: s.MaxLifetime}
+}
+
+// newWatchdog starts a watchdog calling expire at most once. progress is
+// optional. It returns nil if neither timeout is set.
+func newWatchdog(t SessionTimeouts, expire func(reason string), progress func() int64) *watchdog {
+	if t.Idle <= 0 && t.MaxLifetime <= 0 {
+		return nil
+	}
+
+	w := &watchdog{idle: t.Idle, expire: expire, progress: progress}
+	if progress != nil {
+		w.lastProgress = progress()
+	}
+	w.touch()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t.Idle > 0 {
+		w.idleT = time.AfterFunc(t.Idle, w.checkIdle)
+	}
+	if t.MaxLifetime > 0 {
+		w.lifetime = time.AfterFunc(t.MaxLifetime, func() { w.fire(CloseMaxLifetime) })
+	}
+	return w
+}
+
+// touch records activity. It is safe to call on a nil watchdog.
+func (w *watchdog) touch() {
+	if w != nil {
+		w.last.Store(time.Now().UnixNano())
+	}
+}
+
+// Reason returns why the watchdog fired, or "" if it has not
+func (w *watchdog) Reason() string {
+	if w == nil {
+		return ""
+	}
+	if r := w.reason.Load(); r != nil {
+		return *r
+	}
+	return ""
+}
+
+func (w *watchdog) checkIdle() {
+	if w.progress != nil {
+		if p := w.progress(); p != w.lastProgress {
+			w.lastProgress = p
+			w.touch()
+		}
+	}
+
+	idleFor := time.Since(time.Unix(0, w.last.Load()))
+	if idleFor < w.idle {
+		w.mu.Lock()
+		w.idleT.Reset(w.idle - idleFor)
+		w.mu.Unlock()
+		return
+	}
+	w.fire(CloseIdleTimeout)
+}
+
+func (w *watchdog) fire(reason string) {
+	w.once.Do(func() {
+		w.reason.Store(&reason)
+		w.stop()
+		w.expire(reason)
+	})
+}
+
+// stop cancels the timers. It is safe to call on a nil watchdog.
+func (w *watchdog) stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.idleT != nil {
+		w.idleT.Stop()
+	}
+	if w.lifetime != nil {
+		w.lifetime.Stop()
+	}
+}
+
+// writer returns dst touching the watchdog on writes. Without a watchdog
+// dst is returned as is, keeping io.Copy fast paths.
+func (w *watchdog) writer(dst io.Writer) io.Writer {
+	if w == nil {
+		return dst
+	}
+	return activityWriter{dst, w}
+}
+
+// activityWriter touches the watchdog on every write
+type activityWriter struct {
+	io.Writer
+	wd *watchdog
+}
+
+func (a activityWriter) Write(p []byte) (int, error) {
+	a.wd.touch()
+	return a.Writer.Write(p)
+}
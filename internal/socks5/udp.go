@@ -0,0 +1,437 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	xipv4 "golang.org/x/net/ipv4"
+	xipv6 "golang.org/x/net/ipv6"
+)
+
+// defaultUDPTargetTimeout is used when Server.UDPTargetTimeout is zero
+const defaultUDPTargetTimeout = 2 * time.Minute
+
+const (
+	// udpHeadroom fits the largest SOCKS5 UDP header: RSV, FRAG, ATYP,
+	// a domain name with its length byte and the port. Replies to the
+	// client are read behind it, so the header is prepended in place.
+	udpHeadroom = 2 + 1 + 1 + 1 + 255 + 2
+
+	// udpBatchSize is how many datagrams a single recvmmsg/sendmmsg moves
+	udpBatchSize = 8
+)
+
+// UDPFlow accounts the traffic between a UDP association and one target.
+type UDPFlow interface {
+	// AddBytesIn counts bytes received from the target.
+	AddBytesIn(n int64)
+	// AddBytesOut counts bytes sent to the target.
+	AddBytesOut(n int64)
+	// CloseWithReason is called once when the flow ends.
+	CloseWithReason(reason string) error
+}
+
+// UDPTracker accounts UDP association traffic per target.
+type UDPTracker interface {
+	// TrackUDP is called when an association starts sending to target
+	// through conn. It may return nil to skip accounting.
+	TrackUDP(ctx context.Context, target string, conn net.Conn) UDPFlow
+}
+
+// udpBatch is a set of datagram buffers with the messages pointing at
+// them. Batches are pooled, Telegram calls move many small packets.
+type udpBatch struct {
+	msgs []xipv4.Message
+	bufs [][]byte
+}
+
+var udpBatchPool = sync.Pool{
+	New: func() any {
+		b := &udpBatch{
+			msgs: make([]xipv4.Message, udpBatchSize),
+			bufs: make([][]byte, udpBatchSize),
+		}
+		for i := range b.bufs {
+			b.bufs[i] = make([]byte, udpHeadroom+bufferSize)
+			b.msgs[i].Buffers = make([][]byte, 1)
+		}
+		return b
+	},
+}
+
+func getUDPBatch() *udpBatch {
+	return udpBatchPool.Get().(*udpBatch)
+}
+
+func putUDPBatch(b *udpBatch) {
+	for i := range b.msgs {
+		b.msgs[i].Addr = nil
+		b.msgs[i].N = 0
+	}
+	udpBatchPool.Put(b)
+}
+
+// batchConn reads and writes several datagrams per system call.
+// *ipv4.PacketConn and *ipv6.PacketConn implement it; ipv6.Message is
+// the same type as xipv4.Message.
+type batchConn interface {
+	ReadBatch(ms []xipv4.Message, flags int) (int, error)
+	WriteBatch(ms []xipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn net.PacketConn) batchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return xipv6.NewPacketConn(conn)
+	}
+	return xipv4.NewPacketConn(conn)
+}
+
+// udpTarget is the upstream connection of an association to one target
+type udpTarget struct {
+	conn       net.Conn
+	flow       UDPFlow
+	header     []byte       // SOCKS5 UDP header for replies from this target
+	lastActive atomic.Int64 // unix nanos
+}
+
+func (t *udpTarget) touch() {
+	t.lastActive.Store(time.Now().UnixNano())
+}
+
+func (t *udpTarget) close(reason string) {
+	closeWithReason(t.conn, reason)
+	if t.flow != nil {
+		t.flow.CloseWithReason(reason)
+	}
+}
+
+func (s *Server) udpTargetTimeout() time.Duration {
+	if s.UDPTargetTimeout > 0 {
+		return s.UDPTargetTimeout
+	}
+	return defaultUDPTargetTimeout
+}
+
+func (c *Conn) transferUDP(associatedTCP net.Conn, clientConn net.PacketConn) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = c.context(ctx)
+
+	// Reads below block; closing the sockets is what stops them
+	defer clientConn.Close()
+
+	c.udpWatchdog = newWatchdog(c.srv.sessionTimeouts(), func(string) {
+		associatedTCP.Close()
+	}, nil)
+	defer c.udpWatchdog.stop()
+
+	c.udpTargetConns = make(map[socksAddr]*udpTarget)
+	c.udpDialing = make(map[socksAddr]bool)
+	client := newBatchConn(clientConn)
+
+	// client -> target
+	go func() {
+		defer cancel()
+
+		// close all target udp connections when the client connection is closed
+		defer func() {
+			reason := c.udpWatchdog.Reason()
+			if reason == "" {
+				reason = CloseAssociation
+			}
+			c.udpMu.Lock()
+			c.udpClosed = true
+			for addr, t := range c.udpTargetConns {
+				t.close(reason)
+				delete(c.udpTargetConns, addr)
+			}
+			c.udpMu.Unlock()
+		}()
+
+		batch := getUDPBatch()
+		defer putUDPBatch(batch)
+		for {
+			err := c.handleUDPRequests(ctx, client, batch)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				c.logf("udp transfer: handle udp request fail: %v", err)
+			}
+		}
+	}()
+
+	go c.expireUDPTargetsLoop(ctx)
+
+	// A UDP association terminates when the TCP connection that the UDP
+	// ASSOCIATE request arrived on terminates. RFC1928
+	_, err := io.Copy(io.Discard, associatedTCP)
+	if reason := c.udpWatchdog.Reason(); reason != "" {
+		c.logf("closing udp association from %s: %s", associatedTCP.RemoteAddr(), reason)
+		return nil
+	}
+	if err != nil {
+		err = fmt.Errorf("udp associated tcp conn: %w", err)
+	}
+	return err
+}
+
+// handleUDPRequests reads a batch of datagrams from the client and
+// forwards each to its target
+func (c *Conn) handleUDPRequests(ctx context.Context, client batchConn, batch *udpBatch) error {
+	for i := range batch.msgs {
+		batch.msgs[i].Buffers[0] = batch.bufs[i]
+	}
+	n, err := client.ReadBatch(batch.msgs, 0)
+	if err != nil {
+		return fmt.Errorf("read from client: %w", err)
+	}
+
+	for _, msg := range batch.msgs[:n] {
+		// Datagrams from anyone but the client are dropped silently
+		if !c.acceptUDPFrom(msg.Addr) {
+			continue
+		}
+		c.udpWatchdog.touch()
+		if err := c.forwardUDPRequest(ctx, client, msg.Buffers[0][:msg.N]); err != nil {
+			c.logf("udp transfer: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *Conn) forwardUDPRequest(ctx context.Context, client batchConn, pkt []byte) error {
+	req, data, err := parseUDPRequest(pkt)
+	if err != nil {
+		return fmt.Errorf("parse udp request: %w", err)
+	}
+	// An implementation that does not support fragmentation MUST drop
+	// any datagram whose FRAG field is other than X'00'. RFC1928
+	if req.frag != 0 {
+		return nil
+	}
+
+	c.udpMu.Lock()
+	target := c.udpTargetConns[req.addr]
+	dialing := c.udpDialing[req.addr]
+	if target == nil && !dialing {
+		c.udpDialing[req.addr] = true
+	}
+	c.udpMu.Unlock()
+
+	switch {
+	case target != nil:
+		return c.writeUDPTarget(req.addr, target, data)
+	case dialing:
+		// Dropped like on a congested link, the target is not there yet
+		return nil
+	}
+
+	// Dial in the background, a slow policy check, lookup or upstream must
+	// not hold up the datagrams to other targets. The batch buffers are
+	// reused, so the first datagram is copied.
+	first := append([]byte(nil), data...)
+	go func() {
+		target, err := c.dialUDPTarget(ctx, client, req.addr)
+		if err != nil {
+			c.udpMu.Lock()
+			delete(c.udpDialing, req.addr)
+			c.udpMu.Unlock()
+			c.logf("udp transfer: dial target %s fail: %v", req.addr, err)
+			return
+		}
+		if err := c.writeUDPTarget(req.addr, target, first); err != nil {
+			c.logf("udp transfer: %v", err)
+		}
+	}()
+	return nil
+}
+
+// writeUDPTarget sends a datagram to target
+func (c *Conn) writeUDPTarget(addr socksAddr, target *udpTarget, data []byte) error {
+	target.touch()
+	nn, err := target.conn.Write(data)
+	if err != nil {
+		// The target was closed under us, e.g. by a quota. Forget it so
+		// the next datagram dials again.
+		if errors.Is(err, net.ErrClosed) {
+			c.udpMu.Lock()
+			if c.udpTargetConns[addr] == target {
+				delete(c.udpTargetConns, addr)
+			}
+			c.udpMu.Unlock()
+			target.close(CloseTarget)
+		}
+		return fmt.Errorf("write to target %s fail: %w", addr, err)
+	}
+	if target.flow != nil {
+		target.flow.AddBytesOut(int64(nn))
+	}
+	if nn != len(data) {
+		return fmt.Errorf("write to target %s fail: %w", addr, io.ErrShortWrite)
+	}
+	return nil
+}
+
+// dialUDPTarget dials targetAddr and registers it with the association,
+// which then relays its replies to the client
+func (c *Conn) dialUDPTarget(
+	ctx context.Context,
+	client batchConn,
+	targetAddr socksAddr,
+) (*udpTarget, error) {
+	header, err := (&udpRequest{addr: targetAddr}).marshal()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.srv.dial(ctx, "udp", targetAddr.hostPort())
+	if err != nil {
+		return nil, err
+	}
+	t := &udpTarget{conn: conn, header: header}
+	if c.srv.UDPTracker != nil {
+		t.flow = c.srv.UDPTracker.TrackUDP(ctx, targetAddr.hostPort(), conn)
+	}
+	t.touch()
+
+	c.udpMu.Lock()
+	delete(c.udpDialing, targetAddr)
+	// The association ended while dialing
+	if c.udpClosed {
+		c.udpMu.Unlock()
+		t.close(CloseAssociation)
+		return nil, net.ErrClosed
+	}
+	c.udpTargetConns[targetAddr] = t
+	c.udpMu.Unlock()
+
+	// target -> client
+	go func() {
+		batch := getUDPBatch()
+		defer putUDPBatch(batch)
+
+		// Unwrapped sockets are read in batches too; wrappers like rate
+		// limiters must see every datagram
+		var upstream batchConn
+		if uc, ok := conn.(*net.UDPConn); ok {
+			upstream = newBatchConn(uc)
+		}
+
+		for {
+			err := c.handleUDPResponses(client, upstream, t, batch)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+					return
+				}
+				c.logf("udp transfer: handle udp response fail: %v", err)
+			}
+		}
+	}()
+
+	return t, nil
+}
+
+// handleUDPResponses reads datagrams from the target and sends them to
+// the client with the SOCKS5 header prepended in the headroom
+func (c *Conn) handleUDPResponses(client, upstream batchConn, target *udpTarget, batch *udpBatch) error {
+	for i := range batch.msgs {
+		batch.msgs[i].Buffers[0] = batch.bufs[i][udpHeadroom:]
+	}
+
+	var n int
+	var err error
+	if upstream != nil {
+		n, err = upstream.ReadBatch(batch.msgs, 0)
+	} else {
+		batch.msgs[0].N, err = target.conn.Read(batch.msgs[0].Buffers[0])
+		n = 1
+	}
+	if err != nil {
+		return fmt.Errorf("read from target: %w", err)
+	}
+	c.udpWatchdog.touch()
+	target.touch()
+
+	clientAddr := c.udpClientAddr.Load()
+	hdrLen := len(target.header)
+	var payload int64
+	for i := range batch.msgs[:n] {
+		msg := &batch.msgs[i]
+		payload += int64(msg.N)
+		start := udpHeadroom - hdrLen
+		copy(batch.bufs[i][start:], target.header)
+		msg.Buffers[0] = batch.bufs[i][start : udpHeadroom+msg.N]
+		msg.Addr = clientAddr
+	}
+	if target.flow != nil {
+		target.flow.AddBytesIn(payload)
+	}
+
+	for sent := 0; sent < n; {
+		nn, err := client.WriteBatch(batch.msgs[sent:n], 0)
+		if err != nil {
+			return fmt.Errorf("write to client: %w", err)
+		}
+		sent += nn
+	}
+	return nil
+}
+
+// acceptUDPFrom reports whether a datagram from addr belongs to the
+// association. Datagrams must come from the IP of the TCP client and, if
+// the request named one, from the declared port. Otherwise the first
+// datagram pins the port.
+//
+// The declared address is not used: clients behind NAT declare an
+// address we never see.
+func (c *Conn) acceptUDPFrom(addr net.Addr) bool {
+	from, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	if client := c.udpClientAddr.Load(); client != nil {
+		return client.IP.Equal(from.IP) && client.Port == from.Port
+	}
+
+	tcpClient, ok := c.clientConn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !tcpClient.IP.Equal(from.IP) {
+		return false
+	}
+	if port := c.request.destination.port; port != 0 && int(port) != from.Port {
+		return false
+	}
+
+	c.udpClientAddr.Store(from)
+	return true
+}
+
+// expireUDPTargetsLoop closes targets idle for longer than the UDP target
+// timeout until ctx is done
+func (c *Conn) expireUDPTargetsLoop(ctx context.Context) {
+	timeout := c.srv.udpTargetTimeout()
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.udpMu.Lock()
+			for addr, t := range c.udpTargetConns {
+				if now.Sub(time.Unix(0, t.lastActive.Load())) < timeout {
+					continue
+				}
+				t.close(CloseIdleTimeout)
+				delete(c.udpTargetConns, addr)
+			}
+			c.udpMu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpEcho echoes datagrams on a loopback port
+func udpEcho(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr)
+}
+
+// udpDatagram wraps data in the SOCKS5 UDP header for an IPv4 target
+func udpDatagram(target *net.UDPAddr, data []byte) []byte {
+	pkt := []byte{0, 0, 0, byte(ipv4)}
+	pkt = append(pkt, target.IP.To4()...)
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(target.Port))
+	return append(pkt, data...)
+}
+
+func TestUDPSlowDialDoesNotBlockOthers(t *testing.T) {
+	echo := udpEcho(t)
+	slow := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 9}
+
+	release := make(chan struct{})
+	defer close(release)
+	var d net.Dialer
+	addr := startServer(t, &Server{
+		Logf: t.Logf,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == slow.String() {
+				select {
+				case <-release:
+				case <-ctx.Done():
+				}
+			}
+			return d.DialContext(ctx, network, addr)
+		},
+	})
+
+	ctrl, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := ctrl.Write([]byte{socks5Version, 1, noAuthRequired}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(ctrl, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctrl.Write([]byte{socks5Version, byte(udpAssociate), 0, byte(ipv4), 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != byte(success) {
+		t.Fatalf("UDP ASSOCIATE reply = %d, want success", reply[1])
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:]))}
+
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write(udpDatagram(slow, []byte("stuck"))); err != nil {
+		t.Fatal(err)
+	}
+	want := udpDatagram(echo, []byte("ping"))
+	if _, err := client.Write(want); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("no reply while another target is dialing: %v", err)
+	}
+	if !bytes.Equal(buf[:n], want) {
+		t.Fatalf("reply = %x, want %x", buf[:n], want)
+	}
+}
@@ -3,7 +3,6 @@ package stats
 import (
 	"context"
 	"database/sql"
-	"fmt"
 	"log"
 	"sync"
 	"sync/atomic"
@@ -19,12 +18,20 @@ type StatsCollector struct {
 	activeConns     sync.Map // map[uint64]*ConnectionTracker
 	serverStartTime time.Time
 	retentionDays   int
+	quotas          *QuotaManager
 
 	// Atomic counters for fast access
 	activeCount atomic.Int32
 	totalConns  atomic.Int64
+
+	// Rejected connections not yet written to server_stats
+	rejectedPending atomic.Int64
 }
 
+// rejectedFlushInterval batches rejected connection counts, rejections
+// come in floods and must not cost a database write each
+const rejectedFlushInterval = 10 * time.Second
+
 // NewStatsCollector creates a new statistics collector
 func NewStatsCollector(db *sql.DB, geoipService *geoip.Service, retentionDays int) *StatsCollector {
 	if retentionDays < 0 {
@@ -43,13 +50,16 @@ func NewStatsCollector(db *sql.DB, geoipService *geoip.Service, retentionDays in
 
 	// Start background cleanup
 	go sc.cleanupLoop()
+	go sc.rejectedFlushLoop()
 
 	log.Println("[STATS] Stats collector initialized")
 	return sc
 }
 
 // TrackConnection creates a new connection tracker
-func (sc *StatsCollector) TrackConnection(ctx context.Context, clientIP, targetAddr string) *ConnectionTracker {
+func (sc *StatsCollector) TrackConnection(ctx context.Context, info ConnectionInfo) *ConnectionTracker {
+	clientIP := info.ClientIP
+
 	// Get GeoIP info
 	country := "Unknown"
 	city := ""
@@ -66,9 +76,10 @@ func (sc *StatsCollector) TrackConnection(ctx context.Context, clientIP, targetA
 	// Create connection record
 	connectedAt := time.Now()
 	result, err := sc.db.ExecContext(ctx,
-		`INSERT INTO connections (client_ip, target_addr, country, city, connected_at)
-		 VALUES (?, ?, ?, ?, ?)`,
-		clientIP, targetAddr, country, city, connectedAt,
+		`INSERT INTO connections (client_ip, username, target_addr, protocol, dc_id, country, city, connected_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		clientIP, nullString(info.Username), info.TargetAddr, nullString(info.Protocol), nullInt(info.DCID),
+		country, city, connectedAt,
 	)
 	if err != nil {
 		log.Printf("[STATS] Failed to insert connection: %v", err)
@@ -90,74 +101,64 @@ func (sc *StatsCollector) TrackConnection(ctx context.Context, clientIP, targetA
 		country:   country,
 		startTime: connectedAt,
 	}
+	if sc.quotas != nil {
+		tracker.quotaSubjects = sc.quotas.subjectsFor(ctx, info.Username, clientIP)
+	}
 
 	sc.activeConns.Store(tracker.id, tracker)
 
-	log.Printf("[STATS] New connection: %s -> %s (Country: %s, City: %s)",
-		clientIP, targetAddr, country, city)
+	if info.Username != "" {
+		log.Printf("[STATS] New connection: %s (user %s) -> %s (Country: %s, City: %s)",
+			clientIP, info.Username, info.TargetAddr, country, city)
+	} else {
+		log.Printf("[STATS] New connection: %s -> %s (Country: %s, City: %s)",
+			clientIP, info.TargetAddr, country, city)
+	}
 
 	return tracker
 }
 
-// GetPublicStats returns public statistics for API
-func (sc *StatsCollector) GetPublicStats(ctx context.Context) (*PublicStatsResponse, error) {
-	var serverStats ServerStats
-	err := sc.db.QueryRowContext(ctx,
-		`SELECT start_time, total_connections, total_bytes_in, total_bytes_out, updated_at
-		 FROM server_stats WHERE id = 1`,
-	).Scan(&serverStats.StartTime, &serverStats.TotalConnections,
-		&serverStats.TotalBytesIn, &serverStats.TotalBytesOut, &serverStats.UpdatedAt)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get server stats: %w", err)
+// RecordRejected counts a connection closed by the connection limits
+func (sc *StatsCollector) RecordRejected(clientIP, reason string) {
+	if sc.rejectedPending.Add(1) == 1 {
+		log.Printf("[STATS] Rejecting connections (first: %s, %s)", clientIP, reason)
 	}
+}
 
-	// Calculate uptime
-	uptime := time.Since(sc.serverStartTime).Seconds()
-
-	// Calculate total traffic in GB
-	totalBytes := serverStats.TotalBytesIn + serverStats.TotalBytesOut
-	totalTrafficGB := float64(totalBytes) / (1024 * 1024 * 1024)
-
-	// Get geo statistics
-	rows, err := sc.db.QueryContext(ctx,
-		`SELECT country, country_name, connections, total_bytes
-		 FROM geo_stats
-		 ORDER BY connections DESC
-		 LIMIT 20`,
+// flushRejected adds pending rejected connections to server_stats
+func (sc *StatsCollector) flushRejected() {
+	n := sc.rejectedPending.Swap(0)
+	if n == 0 {
+		return
+	}
+	_, err := sc.db.Exec(
+		`UPDATE server_stats SET total_rejected = total_rejected + ?, updated_at = datetime('now') WHERE id = 1`,
+		n,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get geo stats: %w", err)
+		log.Printf("[STATS] Failed to update rejected connections: %v", err)
+		return
 	}
-	defer rows.Close()
+	log.Printf("[STATS] Rejected %d connections by limits", n)
+}
 
-	var countries []CountryStats
-	var totalConnsForPercent int64
+func (sc *StatsCollector) rejectedFlushLoop() {
+	ticker := time.NewTicker(rejectedFlushInterval)
+	defer ticker.Stop()
 
-	// First pass: collect data and calculate total
-	for rows.Next() {
-		var cs CountryStats
-		if err := rows.Scan(&cs.Country, &cs.CountryName, &cs.Connections, new(int64)); err != nil {
-			continue
-		}
-		countries = append(countries, cs)
-		totalConnsForPercent += cs.Connections
+	for range ticker.C {
+		sc.flushRejected()
 	}
+}
 
-	// Second pass: calculate percentages
-	if totalConnsForPercent > 0 {
-		for i := range countries {
-			countries[i].Percentage = float64(countries[i].Connections) * 100.0 / float64(totalConnsForPercent)
-		}
-	}
+// SetQuotaManager enables quota accounting for new connections
+func (sc *StatsCollector) SetQuotaManager(qm *QuotaManager) {
+	sc.quotas = qm
+}
 
-	return &PublicStatsResponse{
-		UptimeSeconds:     int64(uptime),
-		TotalConnections:  serverStats.TotalConnections,
-		ActiveConnections: sc.activeCount.Load(),
-		TotalTrafficGB:    totalTrafficGB,
-		Countries:         countries,
-		UpdatedAt:         time.Now(),
-	}, nil
+// Quotas returns the quota manager, or nil if quotas are disabled
+func (sc *StatsCollector) Quotas() *QuotaManager {
+	return sc.quotas
 }
 
 // GetActiveConnections returns the number of active connections
@@ -246,12 +247,21 @@ func (sc *StatsCollector) cleanupExpiredConnections() {
 		log.Printf("[STATS] Failed to cleanup old connections: %v", err)
 		return
 	}
+	if _, err := sc.db.Exec(`DELETE FROM dc_latency WHERE probed_at < ?`, cutoff); err != nil {
+		log.Printf("[STATS] Failed to cleanup old DC probes: %v", err)
+		return
+	}
 	log.Printf("[STATS] Old connections cleaned up (retention=%d days)", sc.retentionDays)
 }
 
-// GetDB returns the database connection (for internal use)
-func (sc *StatsCollector) GetDB() *sql.DB {
-	return sc.db
+// nullString stores empty strings as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullInt stores zero as NULL
+func nullInt(n int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(n), Valid: n != 0}
 }
 
 // Close gracefully closes the stats collector
@@ -264,4 +274,10 @@ func (sc *StatsCollector) Close() {
 		}
 		return true
 	})
+
+	sc.flushRejected()
+
+	if sc.quotas != nil {
+		sc.quotas.Close()
+	}
 }
@@ -0,0 +1,77 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Dump is a copy of the stored statistics
+type Dump struct {
+	Server    ServerStats  `json:"server"`
+	Countries []GeoStats   `json:"countries"`
+	Users     []UserTotals `json:"users"`
+}
+
+// UserTotals is the traffic of one user over the retained connections
+type UserTotals struct {
+	Username    string `json:"username"`
+	Connections int64  `json:"connections"`
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+}
+
+// Dump reads the server totals, the per-country statistics and the
+// per-user traffic. It needs no running collector, so it works next to a
+// running proxy.
+func (q *Query) Dump(ctx context.Context) (*Dump, error) {
+	d := &Dump{Countries: []GeoStats{}, Users: []UserTotals{}}
+
+	err := q.db.QueryRowContext(ctx,
+		`SELECT start_time, total_connections, total_bytes_in, total_bytes_out, total_rejected, updated_at
+		 FROM server_stats WHERE id = 1`,
+	).Scan(&d.Server.StartTime, &d.Server.TotalConnections,
+		&d.Server.TotalBytesIn, &d.Server.TotalBytesOut, &d.Server.TotalRejected, &d.Server.UpdatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to get server stats: %w", err)
+	}
+
+	rows, err := q.db.QueryContext(ctx,
+		`SELECT country, COALESCE(country_name, ''), connections, total_bytes, last_updated
+		 FROM geo_stats
+		 ORDER BY connections DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get geo stats: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var g GeoStats
+		if err := rows.Scan(&g.Country, &g.CountryName, &g.Connections, &g.TotalBytes, &g.LastUpdated); err != nil {
+			return nil, fmt.Errorf("failed to scan geo stats: %w", err)
+		}
+		d.Countries = append(d.Countries, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = q.db.QueryContext(ctx,
+		`SELECT username, COUNT(*), SUM(bytes_in), SUM(bytes_out)
+		 FROM connections
+		 WHERE username IS NOT NULL AND username != ''
+		 GROUP BY username
+		 ORDER BY SUM(bytes_in + bytes_out) DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user traffic: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u UserTotals
+		if err := rows.Scan(&u.Username, &u.Connections, &u.BytesIn, &u.BytesOut); err != nil {
+			return nil, fmt.Errorf("failed to scan user traffic: %w", err)
+		}
+		d.Users = append(d.Users, u)
+	}
+	return d, rows.Err()
+}
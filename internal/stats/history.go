@@ -0,0 +1,223 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ConnectionFilter selects connections, zero fields match any
+type ConnectionFilter struct {
+	Country  string // ISO code
+	ClientIP string // substring
+	Target   string // substring of host:port
+	Protocol string
+	DCID     *int
+	Since    time.Time
+	Until    time.Time
+}
+
+// ConnectionRecord is a stored connection, finished or active
+type ConnectionRecord struct {
+	ID              int64      `json:"id"`
+	ClientIP        string     `json:"client_ip"`
+	TargetAddr      string     `json:"target_addr"`
+	Country         string     `json:"country"`
+	CountryName     string     `json:"country_name"`
+	City            string     `json:"city"`
+	BytesIn         int64      `json:"bytes_in"`
+	BytesOut        int64      `json:"bytes_out"`
+	BytesTotal      int64      `json:"bytes_total"`
+	ConnectedAt     time.Time  `json:"connected_at"`
+	DisconnectedAt  *time.Time `json:"disconnected_at,omitempty"`
+	DurationSeconds int64      `json:"duration_seconds"`
+	CloseReason     string     `json:"close_reason,omitempty"`
+	Protocol        string     `json:"protocol,omitempty"`
+	DCID            int        `json:"dc_id,omitempty"`
+	IsActive        bool       `json:"is_active"`
+}
+
+// ConnectionSummary is the totals of the connections matching a filter
+type ConnectionSummary struct {
+	TotalConnections       int64   `json:"total_connections"`
+	TotalDownloadBytes     int64   `json:"total_download_bytes"`
+	TotalUploadBytes       int64   `json:"total_upload_bytes"`
+	TotalBytes             int64   `json:"total_bytes"`
+	AverageDurationSeconds float64 `json:"average_duration_seconds"`
+}
+
+// DCTraffic is the connections to a Telegram DC
+type DCTraffic struct {
+	Connections       int64 `json:"connections"`
+	ActiveConnections int64 `json:"active_connections"`
+	TotalBytes        int64 `json:"total_bytes"`
+}
+
+// Connections returns a page of the connections matching f, newest
+// first, and the summary of all of them
+func (q *Query) Connections(ctx context.Context, f ConnectionFilter, limit, offset int) ([]ConnectionRecord, *ConnectionSummary, error) {
+	filters := []string{"1=1"}
+	var args []interface{}
+
+	if f.Country != "" {
+		filters = append(filters, "UPPER(c.country) = ?")
+		args = append(args, strings.ToUpper(f.Country))
+	}
+	if f.ClientIP != "" {
+		filters = append(filters, "c.client_ip LIKE ?")
+		args = append(args, "%"+f.ClientIP+"%")
+	}
+	if f.Target != "" {
+		filters = append(filters, "c.target_addr LIKE ?")
+		args = append(args, "%"+f.Target+"%")
+	}
+	if f.Protocol != "" {
+		filters = append(filters, "c.protocol = ?")
+		args = append(args, f.Protocol)
+	}
+	if f.DCID != nil {
+		filters = append(filters, "c.dc_id = ?")
+		args = append(args, *f.DCID)
+	}
+	if !f.Since.IsZero() {
+		filters = append(filters, "c.connected_at >= ?")
+		args = append(args, f.Since)
+	}
+	if !f.Until.IsZero() {
+		filters = append(filters, "c.connected_at <= ?")
+		args = append(args, f.Until)
+	}
+
+	whereClause := strings.Join(filters, " AND ")
+
+	summaryQuery := fmt.Sprintf(
+		`SELECT COUNT(*), COALESCE(SUM(bytes_in), 0), COALESCE(SUM(bytes_out), 0), COALESCE(AVG(duration), 0)
+		 FROM connections c
+		 WHERE %s`, whereClause)
+
+	var totalConnections int64
+	var totalDownload sql.NullInt64
+	var totalUpload sql.NullInt64
+	var avgDuration sql.NullFloat64
+
+	if err := q.db.QueryRowContext(ctx, summaryQuery, args...).Scan(&totalConnections, &totalDownload, &totalUpload, &avgDuration); err != nil {
+		return nil, nil, fmt.Errorf("failed to summarize connection history: %w", err)
+	}
+
+	summary := &ConnectionSummary{
+		TotalConnections:   totalConnections,
+		TotalDownloadBytes: totalDownload.Int64,
+		TotalUploadBytes:   totalUpload.Int64,
+		TotalBytes:         totalDownload.Int64 + totalUpload.Int64,
+	}
+	if avgDuration.Valid {
+		summary.AverageDurationSeconds = avgDuration.Float64
+	}
+
+	query := fmt.Sprintf(
+		`SELECT c.id,
+		        c.client_ip,
+		        c.target_addr,
+		        c.country,
+		        COALESCE(gs.country_name, c.country) AS country_name,
+		        COALESCE(c.city, '') AS city,
+		        c.bytes_in,
+		        c.bytes_out,
+		        c.connected_at,
+		        c.disconnected_at,
+		        c.duration,
+		        COALESCE(c.close_reason, '') AS close_reason,
+		        COALESCE(c.protocol, '') AS protocol,
+		        COALESCE(c.dc_id, 0) AS dc_id
+		   FROM connections c
+		   LEFT JOIN geo_stats gs ON gs.country = c.country
+		   WHERE %s
+		   ORDER BY c.connected_at DESC
+		   LIMIT ? OFFSET ?`, whereClause)
+
+	rows, err := q.db.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query connection history: %w", err)
+	}
+	defer rows.Close()
+
+	var connections []ConnectionRecord
+	for rows.Next() {
+		var entry ConnectionRecord
+		var disconnectedAt sql.NullTime
+		var duration sql.NullInt64
+
+		if err := rows.Scan(
+			&entry.ID,
+			&entry.ClientIP,
+			&entry.TargetAddr,
+			&entry.Country,
+			&entry.CountryName,
+			&entry.City,
+			&entry.BytesIn,
+			&entry.BytesOut,
+			&entry.ConnectedAt,
+			&disconnectedAt,
+			&duration,
+			&entry.CloseReason,
+			&entry.Protocol,
+			&entry.DCID,
+		); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan connection history row: %w", err)
+		}
+
+		if disconnectedAt.Valid {
+			entry.DisconnectedAt = &disconnectedAt.Time
+		} else {
+			entry.IsActive = true
+		}
+
+		if duration.Valid {
+			entry.DurationSeconds = duration.Int64
+		} else if entry.IsActive {
+			entry.DurationSeconds = int64(time.Since(entry.ConnectedAt).Seconds())
+		}
+
+		entry.BytesTotal = entry.BytesIn + entry.BytesOut
+
+		connections = append(connections, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read connection history: %w", err)
+	}
+
+	return connections, summary, nil
+}
+
+// DCTraffic returns the connections by Telegram DC ID. Connections to
+// Telegram addresses outside the DC table are under 0.
+func (q *Query) DCTraffic(ctx context.Context) (map[int]DCTraffic, error) {
+	rows, err := q.db.QueryContext(ctx,
+		`SELECT COALESCE(dc_id, 0),
+		        COUNT(*),
+		        SUM(CASE WHEN disconnected_at IS NULL THEN 1 ELSE 0 END),
+		        COALESCE(SUM(bytes_in + bytes_out), 0)
+		 FROM connections
+		 GROUP BY COALESCE(dc_id, 0)`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DC stats: %w", err)
+	}
+	defer rows.Close()
+
+	usage := make(map[int]DCTraffic)
+	for rows.Next() {
+		var id int
+		var t DCTraffic
+		if err := rows.Scan(&id, &t.Connections, &t.ActiveConnections, &t.TotalBytes); err != nil {
+			return nil, fmt.Errorf("failed to scan DC stats row: %w", err)
+		}
+		usage[id] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read DC stats: %w", err)
+	}
+	return usage, nil
+}
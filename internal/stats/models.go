@@ -2,10 +2,20 @@ package stats
 
 import "time"
 
+// ConnectionInfo describes a new proxied connection
+type ConnectionInfo struct {
+	ClientIP   string
+	Username   string
+	TargetAddr string
+	Protocol   string // "socks5", "http" or "mtproto"
+	DCID       int    // Telegram DC of the target, 0 if it is none
+}
+
 // ConnectionStats represents a single connection record
 type ConnectionStats struct {
 	ID             int64      `db:"id"`
 	ClientIP       string     `db:"client_ip"`
+	Username       string     `db:"username"`
 	TargetAddr     string     `db:"target_addr"`
 	Country        string     `db:"country"`
 	City           string     `db:"city"`
@@ -14,25 +24,29 @@ type ConnectionStats struct {
 	ConnectedAt    time.Time  `db:"connected_at"`
 	DisconnectedAt *time.Time `db:"disconnected_at"`
 	Duration       int64      `db:"duration"`
+	CloseReason    string     `db:"close_reason"`
+	Protocol       string     `db:"protocol"`
+	DCID           int        `db:"dc_id"`
 }
 
 // ServerStats represents overall server statistics
 type ServerStats struct {
-	ID               int64     `db:"id"`
-	StartTime        time.Time `db:"start_time"`
-	TotalConnections int64     `db:"total_connections"`
-	TotalBytesIn     int64     `db:"total_bytes_in"`
-	TotalBytesOut    int64     `db:"total_bytes_out"`
-	UpdatedAt        time.Time `db:"updated_at"`
+	ID               int64     `db:"id" json:"-"`
+	StartTime        time.Time `db:"start_time" json:"start_time"`
+	TotalConnections int64     `db:"total_connections" json:"total_connections"`
+	TotalBytesIn     int64     `db:"total_bytes_in" json:"total_bytes_in"`
+	TotalBytesOut    int64     `db:"total_bytes_out" json:"total_bytes_out"`
+	TotalRejected    int64     `db:"total_rejected" json:"total_rejected"`
+	UpdatedAt        time.Time `db:"updated_at" json:"updated_at"`
 }
 
 // GeoStats represents geographical statistics
 type GeoStats struct {
-	Country     string    `db:"country"`
-	CountryName string    `db:"country_name"`
-	Connections int64     `db:"connections"`
-	TotalBytes  int64     `db:"total_bytes"`
-	LastUpdated time.Time `db:"last_updated"`
+	Country     string    `db:"country" json:"country"`
+	CountryName string    `db:"country_name" json:"country_name"`
+	Connections int64     `db:"connections" json:"connections"`
+	TotalBytes  int64     `db:"total_bytes" json:"total_bytes"`
+	LastUpdated time.Time `db:"last_updated" json:"last_updated"`
 }
 
 // SpeedTestResult represents a speedtest result
@@ -54,6 +68,7 @@ type PublicStatsResponse struct {
 	UptimeSeconds     int64          `json:"uptime_seconds"`
 	TotalConnections  int64          `json:"total_connections"`
 	ActiveConnections int32          `json:"active_connections"`
+	RejectedConns     int64          `json:"rejected_connections"`
 	TotalTrafficGB    float64        `json:"total_traffic_gb"`
 	Countries         []CountryStats `json:"countries"`
 	UpdatedAt         time.Time      `json:"updated_at"`
@@ -0,0 +1,637 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNoCountryData is returned by CountryDetail for a country without
+// connections
+var ErrNoCountryData = errors.New("no data for specified country")
+
+// Query reads the stored statistics for the API, the bot and the CLI
+type Query struct {
+	db *sql.DB
+	// live adds the uptime, active connections and pending rejections,
+	// nil when reading the database of another process
+	live *StatsCollector
+}
+
+// NewQuery creates a query over a stats database without a collector,
+// uptime and active connections read as zero
+func NewQuery(db *sql.DB) *Query {
+	return &Query{db: db}
+}
+
+// Query returns the query over the collector's database
+func (sc *StatsCollector) Query() *Query {
+	return &Query{db: sc.db, live: sc}
+}
+
+// TrafficSummary is the traffic since the start with its averages
+type TrafficSummary struct {
+	TotalTrafficGB         float64 `json:"total_traffic_gb"`
+	DownloadGB             float64 `json:"download_gb"`
+	UploadGB               float64 `json:"upload_gb"`
+	DownloadPercent        float64 `json:"download_percent"`
+	UploadPercent          float64 `json:"upload_percent"`
+	UptimeSeconds          int64   `json:"uptime_seconds"`
+	TotalConnections       int64   `json:"total_connections"`
+	ActiveConnections      int32   `json:"active_connections"`
+	TrafficPerHourGB       float64 `json:"traffic_per_hour_gb"`
+	TrafficPerDayGB        float64 `json:"traffic_per_day_gb"`
+	TrafficPerConnectionMB float64 `json:"traffic_per_connection_mb"`
+	AvgDurationSeconds     float64 `json:"avg_duration_seconds"`
+}
+
+// CountryUsage is the connections and traffic of a country
+type CountryUsage struct {
+	Country     string  `json:"country"`
+	CountryName string  `json:"country_name"`
+	Connections int64   `json:"connections"`
+	TotalBytes  int64   `json:"total_bytes"`
+	Percentage  float64 `json:"percentage"`
+}
+
+// CountryBreakdown is the countries with the most connections
+type CountryBreakdown struct {
+	Countries        []CountryUsage `json:"countries"`
+	TotalConnections int64          `json:"total_connections"`
+}
+
+// RecentConnection is a finished connection
+type RecentConnection struct {
+	Country         string    `json:"country"`
+	CountryName     string    `json:"country_name"`
+	City            string    `json:"city"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	BytesIn         int64     `json:"bytes_in"`
+	BytesOut        int64     `json:"bytes_out"`
+	DurationSeconds int64     `json:"duration_seconds"`
+}
+
+// HourlyStat is the connections started in an hour of the day, "00"-"23"
+// in UTC
+type HourlyStat struct {
+	Hour        string `json:"hour"`
+	Connections int64  `json:"connections"`
+}
+
+// TodayStats is the connections of the current UTC day
+type TodayStats struct {
+	TotalConnections int64        `json:"total_connections"`
+	TotalBytes       int64        `json:"total_bytes"`
+	Hourly           []HourlyStat `json:"hourly"`
+}
+
+// DailyStat is the connections started on a day, "2006-01-02"
+type DailyStat struct {
+	Day         string `json:"day"`
+	Connections int64  `json:"connections"`
+	TotalBytes  int64  `json:"total_bytes"`
+}
+
+// WeekStats is the connections of the last 7 days
+type WeekStats struct {
+	TotalConnections int64       `json:"total_connections"`
+	TotalBytes       int64       `json:"total_bytes"`
+	AveragePerDay    float64     `json:"average_per_day"`
+	Daily            []DailyStat `json:"daily"`
+}
+
+// PeakUsage is the busiest hour of the day, day and country
+type PeakUsage struct {
+	PeakHour               string `json:"peak_hour"`
+	PeakHourConnections    int64  `json:"peak_hour_connections"`
+	PeakDay                string `json:"peak_day"`
+	PeakDayConnections     int64  `json:"peak_day_connections"`
+	BusiestCountry         string `json:"busiest_country"`
+	BusiestCountryName     string `json:"busiest_country_name"`
+	BusiestCountrySessions int64  `json:"busiest_country_sessions"`
+}
+
+// Comparison is today against yesterday and the last 7 days against the
+// 7 before
+type Comparison struct {
+	TodayConnections     int64 `json:"today_connections"`
+	TodayBytes           int64 `json:"today_bytes"`
+	YesterdayConnections int64 `json:"yesterday_connections"`
+	YesterdayBytes       int64 `json:"yesterday_bytes"`
+	ThisWeekConnections  int64 `json:"this_week_connections"`
+	ThisWeekBytes        int64 `json:"this_week_bytes"`
+	LastWeekConnections  int64 `json:"last_week_connections"`
+	LastWeekBytes        int64 `json:"last_week_bytes"`
+}
+
+// CountryDetail is the totals and the last connections of a country
+type CountryDetail struct {
+	Country          string             `json:"country"`
+	CountryName      string             `json:"country_name"`
+	TotalConnections int64              `json:"total_connections"`
+	TotalBytes       int64              `json:"total_bytes"`
+	Recent           []RecentConnection `json:"recent"`
+}
+
+// Snapshot is the public statistics with the top countries
+type Snapshot struct {
+	Timestamp    time.Time            `json:"timestamp"`
+	Stats        *PublicStatsResponse `json:"stats"`
+	TopCountries []CountryUsage       `json:"top_countries"`
+}
+
+// ServerInfo is the server overview
+type ServerInfo struct {
+	UptimeSeconds     int64         `json:"uptime_seconds"`
+	ActiveConnections int32         `json:"active_connections"`
+	TotalConnections  int64         `json:"total_connections"`
+	RejectedConns     int64         `json:"rejected_connections"`
+	TotalTrafficGB    float64       `json:"total_traffic_gb"`
+	DownloadGB        float64       `json:"download_gb"`
+	UploadGB          float64       `json:"upload_gb"`
+	DatabaseSizeBytes int64         `json:"database_size_bytes"`
+	CountriesServed   int64         `json:"countries_served"`
+	TopCountry        *CountryUsage `json:"top_country,omitempty"`
+	UpdatedAt         time.Time     `json:"updated_at"`
+}
+
+// PublicStats returns the public statistics
+func (q *Query) PublicStats(ctx context.Context) (*PublicStatsResponse, error) {
+	var serverStats ServerStats
+	err := q.db.QueryRowContext(ctx,
+		`SELECT start_time, total_connections, total_bytes_in, total_bytes_out, total_rejected, updated_at
+		 FROM server_stats WHERE id = 1`,
+	).Scan(&serverStats.StartTime, &serverStats.TotalConnections,
+		&serverStats.TotalBytesIn, &serverStats.TotalBytesOut, &serverStats.TotalRejected, &serverStats.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server stats: %w", err)
+	}
+
+	// Calculate total traffic in GB
+	totalBytes := serverStats.TotalBytesIn + serverStats.TotalBytesOut
+	totalTrafficGB := bytesToGB(totalBytes)
+
+	// Get geo statistics
+	rows, err := q.db.QueryContext(ctx,
+		`SELECT country, country_name, connections, total_bytes
+		 FROM geo_stats
+		 ORDER BY connections DESC
+		 LIMIT 20`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get geo stats: %w", err)
+	}
+	defer rows.Close()
+
+	var countries []CountryStats
+	var totalConnsForPercent int64
+
+	// First pass: collect data and calculate total
+	for rows.Next() {
+		var cs CountryStats
+		if err := rows.Scan(&cs.Country, &cs.CountryName, &cs.Connections, new(int64)); err != nil {
+			continue
+		}
+		countries = append(countries, cs)
+		totalConnsForPercent += cs.Connections
+	}
+
+	// Second pass: calculate percentages
+	if totalConnsForPercent > 0 {
+		for i := range countries {
+			countries[i].Percentage = float64(countries[i].Connections) * 100.0 / float64(totalConnsForPercent)
+		}
+	}
+
+	resp := &PublicStatsResponse{
+		TotalConnections: serverStats.TotalConnections,
+		RejectedConns:    serverStats.TotalRejected,
+		TotalTrafficGB:   totalTrafficGB,
+		Countries:        countries,
+		UpdatedAt:        time.Now(),
+	}
+	if q.live != nil {
+		resp.UptimeSeconds = int64(time.Since(q.live.serverStartTime).Seconds())
+		resp.ActiveConnections = q.live.activeCount.Load()
+		resp.RejectedConns += q.live.rejectedPending.Load()
+	}
+	return resp, nil
+}
+
+// Traffic returns the traffic totals and averages since the start
+func (q *Query) Traffic(ctx context.Context) (*TrafficSummary, error) {
+	publicStats, err := q.PublicStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	downloadBytes, uploadBytes, err := q.serverTotals(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server totals: %w", err)
+	}
+
+	totalBytes := downloadBytes + uploadBytes
+	totalTrafficGB := bytesToGB(totalBytes)
+	downloadGB := bytesToGB(downloadBytes)
+	uploadGB := bytesToGB(uploadBytes)
+
+	trafficPerHourGB := 0.0
+	trafficPerDayGB := 0.0
+	if publicStats.UptimeSeconds > 0 {
+		hours := float64(publicStats.UptimeSeconds) / 3600
+		if hours > 0 {
+			trafficPerHourGB = totalTrafficGB / hours
+			trafficPerDayGB = trafficPerHourGB * 24
+		}
+	}
+
+	trafficPerConnectionMB := 0.0
+	if publicStats.TotalConnections > 0 {
+		trafficPerConnectionMB = totalTrafficGB * 1024 / float64(publicStats.TotalConnections)
+	}
+
+	downloadPercent := 0.0
+	uploadPercent := 0.0
+	if totalBytes > 0 {
+		downloadPercent = float64(downloadBytes) * 100 / float64(totalBytes)
+		uploadPercent = float64(uploadBytes) * 100 / float64(totalBytes)
+	}
+
+	var avgDuration sql.NullFloat64
+	if err := q.db.QueryRowContext(ctx, `SELECT AVG(duration) FROM connections WHERE duration > 0`).Scan(&avgDuration); err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to compute average duration: %w", err)
+	}
+
+	return &TrafficSummary{
+		TotalTrafficGB:         totalTrafficGB,
+		DownloadGB:             downloadGB,
+		UploadGB:               uploadGB,
+		DownloadPercent:        downloadPercent,
+		UploadPercent:          uploadPercent,
+		UptimeSeconds:          publicStats.UptimeSeconds,
+		TotalConnections:       publicStats.TotalConnections,
+		ActiveConnections:      publicStats.ActiveConnections,
+		TrafficPerHourGB:       trafficPerHourGB,
+		TrafficPerDayGB:        trafficPerDayGB,
+		TrafficPerConnectionMB: trafficPerConnectionMB,
+		AvgDurationSeconds:     avgDuration.Float64,
+	}, nil
+}
+
+// Countries returns the limit countries with the most connections
+func (q *Query) Countries(ctx context.Context, limit int) (*CountryBreakdown, error) {
+	publicStats, err := q.PublicStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	countries, err := q.countryUsage(ctx, limit, publicStats.TotalConnections)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch country stats: %w", err)
+	}
+
+	return &CountryBreakdown{
+		Countries:        countries,
+		TotalConnections: publicStats.TotalConnections,
+	}, nil
+}
+
+// Recent returns the last limit finished connections
+func (q *Query) Recent(ctx context.Context, limit int) ([]RecentConnection, error) {
+	connections, err := q.recentConnections(ctx, limit, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch recent connections: %w", err)
+	}
+	return connections, nil
+}
+
+// Today returns the connections of the UTC day of now by hour
+func (q *Query) Today(ctx context.Context, now time.Time) (*TodayStats, error) {
+	var resp TodayStats
+	if err := q.db.QueryRowContext(ctx,
+		`SELECT COUNT(*), COALESCE(SUM(bytes_in + bytes_out), 0)
+		 FROM connections
+		 WHERE DATE(connected_at) = DATE(?)`, sqlTime(now),
+	).Scan(&resp.TotalConnections, &resp.TotalBytes); err != nil {
+		return nil, fmt.Errorf("failed to get today's stats: %w", err)
+	}
+
+	rows, err := q.db.QueryContext(ctx,
+		`SELECT strftime('%H', connected_at) as hour, COUNT(*)
+		 FROM connections
+		 WHERE DATE(connected_at) = DATE(?)
+		 GROUP BY hour
+		 ORDER BY hour DESC`, sqlTime(now))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hourly stats: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h HourlyStat
+		if err := rows.Scan(&h.Hour, &h.Connections); err == nil {
+			resp.Hourly = append(resp.Hourly, h)
+		}
+	}
+	return &resp, nil
+}
+
+// Week returns the connections of the 7 days before now by day
+func (q *Query) Week(ctx context.Context, now time.Time) (*WeekStats, error) {
+	var resp WeekStats
+	if err := q.db.QueryRowContext(ctx,
+		`SELECT COUNT(*), COALESCE(SUM(bytes_in + bytes_out), 0)
+		 FROM connections
+		 WHERE connected_at >= datetime(?, '-7 days')`, sqlTime(now),
+	).Scan(&resp.TotalConnections, &resp.TotalBytes); err != nil {
+		return nil, fmt.Errorf("failed to get weekly stats: %w", err)
+	}
+
+	rows, err := q.db.QueryContext(ctx,
+		`SELECT DATE(connected_at) as day, COUNT(*), COALESCE(SUM(bytes_in + bytes_out), 0)
+		 FROM connections
+		 WHERE connected_at >= datetime(?, '-7 days')
+		 GROUP BY day
+		 ORDER BY day DESC`, sqlTime(now))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get daily breakdown: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d DailyStat
+		if err := rows.Scan(&d.Day, &d.Connections, &d.TotalBytes); err == nil {
+			resp.Daily = append(resp.Daily, d)
+		}
+	}
+
+	if resp.TotalConnections > 0 {
+		resp.AveragePerDay = float64(resp.TotalConnections) / 7.0
+	}
+	return &resp, nil
+}
+
+// Peak returns the busiest hour of the day, day and country among the
+// connections of the last window, or of all time if window is 0
+func (q *Query) Peak(ctx context.Context, window time.Duration) (*PeakUsage, error) {
+	// Connections before since are left out
+	since := "0000-00-00"
+	if window > 0 {
+		since = sqlTime(time.Now().Add(-window))
+	}
+
+	var resp PeakUsage
+	err := q.db.QueryRowContext(ctx,
+		`SELECT strftime('%H', connected_at) as hour, COUNT(*) as count
+		 FROM connections
+		 WHERE connected_at >= ?
+		 GROUP BY hour
+		 ORDER BY count DESC
+		 LIMIT 1`, since,
+	).Scan(&resp.PeakHour, &resp.PeakHourConnections)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to get peak hour: %w", err)
+	}
+
+	err = q.db.QueryRowContext(ctx,
+		`SELECT DATE(connected_at) as day, COUNT(*) as count
+		 FROM connections
+		 WHERE connected_at >= ?
+		 GROUP BY day
+		 ORDER BY count DESC
+		 LIMIT 1`, since,
+	).Scan(&resp.PeakDay, &resp.PeakDayConnections)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to get peak day: %w", err)
+	}
+
+	// geo_stats keeps the countries of connections past the retention
+	if window > 0 {
+		err = q.db.QueryRowContext(ctx,
+			`SELECT c.country, COALESCE(gs.country_name, c.country), COUNT(*) as count
+			 FROM connections c
+			 LEFT JOIN geo_stats gs ON gs.country = c.country
+			 WHERE c.connected_at >= ? AND COALESCE(c.country, '') != ''
+			 GROUP BY c.country
+			 ORDER BY count DESC
+			 LIMIT 1`, since,
+		).Scan(&resp.BusiestCountry, &resp.BusiestCountryName, &resp.BusiestCountrySessions)
+	} else {
+		err = q.db.QueryRowContext(ctx,
+			`SELECT country, country_name, connections
+			 FROM geo_stats
+			 ORDER BY connections DESC
+			 LIMIT 1`,
+		).Scan(&resp.BusiestCountry, &resp.BusiestCountryName, &resp.BusiestCountrySessions)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to get busiest country: %w", err)
+	}
+
+	return &resp, nil
+}
+
+// Compare compares the UTC day of now with the day before, and the 7 days
+// before now with the 7 days before them
+func (q *Query) Compare(ctx context.Context, now time.Time) (*Comparison, error) {
+	var resp Comparison
+	periods := []struct {
+		name               string
+		where              string
+		connections, bytes *int64
+	}{
+		{"today", `DATE(connected_at) = DATE(?1)`, &resp.TodayConnections, &resp.TodayBytes},
+		{"yesterday", `DATE(connected_at) = DATE(?1, '-1 day')`, &resp.YesterdayConnections, &resp.YesterdayBytes},
+		{"this week", `connected_at >= datetime(?1, '-7 days')`, &resp.ThisWeekConnections, &resp.ThisWeekBytes},
+		{"last week", `connected_at >= datetime(?1, '-14 days')
+		   AND connected_at < datetime(?1, '-7 days')`, &resp.LastWeekConnections, &resp.LastWeekBytes},
+	}
+	for _, p := range periods {
+		if err := q.db.QueryRowContext(ctx,
+			`SELECT COUNT(*), COALESCE(SUM(bytes_in + bytes_out), 0)
+			 FROM connections
+			 WHERE `+p.where, sqlTime(now),
+		).Scan(p.connections, p.bytes); err != nil {
+			return nil, fmt.Errorf("failed to get %s stats: %w", p.name, err)
+		}
+	}
+	return &resp, nil
+}
+
+// CountryDetail returns the totals and the last connections of a country
+// by its ISO code
+func (q *Query) CountryDetail(ctx context.Context, code string) (*CountryDetail, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	resp := CountryDetail{Country: code}
+
+	err := q.db.QueryRowContext(ctx,
+		`SELECT country_name, connections, total_bytes
+		 FROM geo_stats
+		 WHERE country = ?`,
+		code,
+	).Scan(&resp.CountryName, &resp.TotalConnections, &resp.TotalBytes)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoCountryData
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch country stats: %w", err)
+	}
+
+	recent, err := q.recentConnections(ctx, 5, code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch recent country connections: %w", err)
+	}
+	resp.Recent = recent
+
+	return &resp, nil
+}
+
+// Snapshot returns the public statistics with the top 10 countries
+func (q *Query) Snapshot(ctx context.Context) (*Snapshot, error) {
+	publicStats, err := q.PublicStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	topCountries, err := q.countryUsage(ctx, 10, publicStats.TotalConnections)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch top countries: %w", err)
+	}
+
+	return &Snapshot{
+		Timestamp:    time.Now().UTC(),
+		Stats:        publicStats,
+		TopCountries: topCountries,
+	}, nil
+}
+
+// Info returns the server overview: uptime, traffic, database size and
+// countries
+func (q *Query) Info(ctx context.Context) (*ServerInfo, error) {
+	publicStats, err := q.PublicStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	downloadBytes, uploadBytes, err := q.serverTotals(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server totals: %w", err)
+	}
+
+	var dbSizeBytes sql.NullInt64
+	if err := q.db.QueryRowContext(ctx,
+		`SELECT page_count * page_size
+		 FROM pragma_page_count(), pragma_page_size()`).
+		Scan(&dbSizeBytes); err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to get database size: %w", err)
+	}
+
+	var countriesServed sql.NullInt64
+	if err := q.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM geo_stats WHERE connections > 0`).Scan(&countriesServed); err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to count countries: %w", err)
+	}
+
+	var topCountry *CountryUsage
+	top, err := q.countryUsage(ctx, 1, publicStats.TotalConnections)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch top country: %w", err)
+	}
+	if len(top) > 0 {
+		topCountry = &top[0]
+	}
+
+	return &ServerInfo{
+		UptimeSeconds:     publicStats.UptimeSeconds,
+		ActiveConnections: publicStats.ActiveConnections,
+		TotalConnections:  publicStats.TotalConnections,
+		RejectedConns:     publicStats.RejectedConns,
+		TotalTrafficGB:    bytesToGB(downloadBytes + uploadBytes),
+		DownloadGB:        bytesToGB(downloadBytes),
+		UploadGB:          bytesToGB(uploadBytes),
+		DatabaseSizeBytes: dbSizeBytes.Int64,
+		CountriesServed:   countriesServed.Int64,
+		TopCountry:        topCountry,
+		UpdatedAt:         publicStats.UpdatedAt,
+	}, nil
+}
+
+func (q *Query) serverTotals(ctx context.Context) (int64, int64, error) {
+	var totalBytesIn, totalBytesOut sql.NullInt64
+	err := q.db.QueryRowContext(ctx,
+		`SELECT total_bytes_in, total_bytes_out FROM server_stats WHERE id = 1`,
+	).Scan(&totalBytesIn, &totalBytesOut)
+	if err != nil {
+		return 0, 0, err
+	}
+	return totalBytesIn.Int64, totalBytesOut.Int64, nil
+}
+
+func (q *Query) countryUsage(ctx context.Context, limit int, totalConnections int64) ([]CountryUsage, error) {
+	rows, err := q.db.QueryContext(ctx,
+		`SELECT country, country_name, connections, total_bytes
+		 FROM geo_stats
+		 ORDER BY connections DESC
+		 LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var countries []CountryUsage
+	for rows.Next() {
+		var usage CountryUsage
+		if err := rows.Scan(&usage.Country, &usage.CountryName, &usage.Connections, &usage.TotalBytes); err == nil {
+			if totalConnections > 0 {
+				usage.Percentage = float64(usage.Connections) * 100 / float64(totalConnections)
+			}
+			countries = append(countries, usage)
+		}
+	}
+	return countries, nil
+}
+
+// recentConnections returns the last finished connections, of one
+// country unless country is empty
+func (q *Query) recentConnections(ctx context.Context, limit int, country string) ([]RecentConnection, error) {
+	rows, err := q.db.QueryContext(ctx,
+		`SELECT c.country,
+		        COALESCE(gs.country_name, c.country) as country_name,
+		        COALESCE(c.city, ''),
+		        c.connected_at,
+		        c.bytes_in,
+		        c.bytes_out,
+		        c.duration
+		 FROM connections c
+		 LEFT JOIN geo_stats gs ON gs.country = c.country
+		 WHERE c.disconnected_at IS NOT NULL
+		   AND (?1 = '' OR UPPER(c.country) = ?1)
+		 ORDER BY c.connected_at DESC
+		 LIMIT ?2`, country, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var connections []RecentConnection
+	for rows.Next() {
+		var entry RecentConnection
+		if err := rows.Scan(&entry.Country, &entry.CountryName, &entry.City, &entry.ConnectedAt, &entry.BytesIn, &entry.BytesOut, &entry.DurationSeconds); err == nil {
+			connections = append(connections, entry)
+		}
+	}
+
+	return connections, nil
+}
+
+// sqlTime formats t for the SQLite date functions, which work in UTC
+func sqlTime(t time.Time) string {
+	return t.UTC().Format(time.DateTime)
+}
+
+func bytesToGB(b int64) float64 {
+	return float64(b) / (1024 * 1024 * 1024)
+}
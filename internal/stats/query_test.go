@@ -0,0 +1,317 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soaska/proxy/internal/database"
+)
+
+// now is the reference time of the fixture rows
+var now = time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+type fixture struct {
+	country     string
+	connectedAt time.Time
+	bytesIn     int64
+	bytesOut    int64
+}
+
+// fixtures sit on both sides of the day and week boundaries of now
+var fixtures = []fixture{
+	{"DE", time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC), 100, 50},   // start of today
+	{"DE", time.Date(2026, 3, 10, 11, 30, 0, 0, time.UTC), 10, 10},  // today
+	{"US", time.Date(2026, 3, 9, 23, 59, 59, 0, time.UTC), 1000, 0}, // end of yesterday
+	{"FR", time.Date(2026, 3, 3, 12, 0, 0, 0, time.UTC), 5, 5},      // exactly 7 days ago
+	{"FR", time.Date(2026, 3, 3, 11, 59, 59, 0, time.UTC), 7, 0},    // just before the week
+	{"US", time.Date(2026, 2, 24, 12, 0, 0, 0, time.UTC), 1, 1},     // exactly 14 days ago
+	{"US", time.Date(2026, 2, 24, 11, 59, 59, 0, time.UTC), 2, 2},   // before the last week
+}
+
+// newTestQuery returns a query over an in-memory database holding rows
+func newTestQuery(t *testing.T, rows []fixture) (*Query, *sql.DB) {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	db, err := database.InitDB("file:" + name + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	exec := func(query string, args ...any) {
+		t.Helper()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, geo := range []struct {
+		country, name string
+		connections   int64
+	}{{"DE", "Germany", 2}, {"US", "United States", 3}, {"FR", "France", 2}} {
+		exec(`INSERT INTO geo_stats (country, country_name, connections, total_bytes) VALUES (?, ?, ?, 0)`,
+			geo.country, geo.name, geo.connections)
+	}
+	for _, f := range rows {
+		exec(`INSERT INTO connections (client_ip, target_addr, country, bytes_in, bytes_out, connected_at, disconnected_at, duration)
+		      VALUES ('192.0.2.1', '149.154.167.51:443', ?, ?, ?, ?, ?, 60)`,
+			f.country, f.bytesIn, f.bytesOut, f.connectedAt, f.connectedAt.Add(time.Minute))
+	}
+	return NewQuery(db), db
+}
+
+func TestToday(t *testing.T) {
+	q, _ := newTestQuery(t, fixtures)
+	tests := []struct {
+		name string
+		now  time.Time
+		want *TodayStats
+	}{
+		{"midday", now, &TodayStats{
+			TotalConnections: 2,
+			TotalBytes:       170,
+			Hourly:           []HourlyStat{{"11", 1}, {"00", 1}},
+		}},
+		{"last second of the day before", time.Date(2026, 3, 9, 23, 59, 59, 0, time.UTC), &TodayStats{
+			TotalConnections: 1,
+			TotalBytes:       1000,
+			Hourly:           []HourlyStat{{"23", 1}},
+		}},
+		{"other time zone", now.In(time.FixedZone("UTC+14", 14*3600)), &TodayStats{
+			TotalConnections: 2,
+			TotalBytes:       170,
+			Hourly:           []HourlyStat{{"11", 1}, {"00", 1}},
+		}},
+		{"empty day", time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC), &TodayStats{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := q.Today(context.Background(), tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Today() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeek(t *testing.T) {
+	q, _ := newTestQuery(t, fixtures)
+	tests := []struct {
+		name string
+		now  time.Time
+		want *WeekStats
+	}{
+		{"boundary included", now, &WeekStats{
+			TotalConnections: 4,
+			TotalBytes:       1180,
+			AveragePerDay:    4.0 / 7,
+			Daily: []DailyStat{
+				{"2026-03-10", 2, 170},
+				{"2026-03-09", 1, 1000},
+				{"2026-03-03", 1, 10},
+			},
+		}},
+		{"boundary passed", now.Add(time.Second), &WeekStats{
+			TotalConnections: 3,
+			TotalBytes:       1170,
+			AveragePerDay:    3.0 / 7,
+			Daily: []DailyStat{
+				{"2026-03-10", 2, 170},
+				{"2026-03-09", 1, 1000},
+			},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := q.Week(context.Background(), tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Week() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	q, _ := newTestQuery(t, fixtures)
+	tests := []struct {
+		name string
+		now  time.Time
+		want *Comparison
+	}{
+		{"fixtures", now, &Comparison{
+			TodayConnections:     2,
+			TodayBytes:           170,
+			YesterdayConnections: 1,
+			YesterdayBytes:       1000,
+			ThisWeekConnections:  4,
+			ThisWeekBytes:        1180,
+			LastWeekConnections:  2,
+			LastWeekBytes:        9,
+		}},
+		{"next day", now.Add(24 * time.Hour), &Comparison{
+			YesterdayConnections: 2,
+			YesterdayBytes:       170,
+			ThisWeekConnections:  3,
+			ThisWeekBytes:        1170,
+			LastWeekConnections:  2,
+			LastWeekBytes:        17,
+		}},
+		{"a month later", now.Add(30 * 24 * time.Hour), &Comparison{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := q.Compare(context.Background(), tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != *tt.want {
+				t.Errorf("Compare() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeak(t *testing.T) {
+	// Peak windows end at the current time, so are the rows: three old
+	// US connections and two recent JP ones in another hour
+	recent := time.Now().UTC().Add(-time.Minute)
+	old := recent.Add(-30*24*time.Hour - 6*time.Hour)
+	q, db := newTestQuery(t, []fixture{
+		{"US", old, 1, 1},
+		{"US", old, 1, 1},
+		{"US", old, 1, 1},
+		{"JP", recent, 1, 1},
+		{"JP", recent, 1, 1},
+	})
+	if _, err := db.Exec(`INSERT INTO geo_stats (country, country_name, connections, total_bytes) VALUES ('JP', 'Japan', 2, 0)`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		want   *PeakUsage
+	}{
+		{"all time", 0, &PeakUsage{
+			PeakHour:               old.Format("15"),
+			PeakHourConnections:    3,
+			PeakDay:                old.Format(time.DateOnly),
+			PeakDayConnections:     3,
+			BusiestCountry:         "US",
+			BusiestCountryName:     "United States",
+			BusiestCountrySessions: 3,
+		}},
+		{"last day", 24 * time.Hour, &PeakUsage{
+			PeakHour:               recent.Format("15"),
+			PeakHourConnections:    2,
+			PeakDay:                recent.Format(time.DateOnly),
+			PeakDayConnections:     2,
+			BusiestCountry:         "JP",
+			BusiestCountryName:     "Japan",
+			BusiestCountrySessions: 2,
+		}},
+		{"nothing in the window", 10 * time.Second, &PeakUsage{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := q.Peak(context.Background(), tt.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != *tt.want {
+				t.Errorf("Peak(%v) = %+v, want %+v", tt.window, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountryDetail(t *testing.T) {
+	q, _ := newTestQuery(t, fixtures)
+	tests := []struct {
+		code       string
+		err        error
+		wantCount  int64
+		wantRecent int
+	}{
+		{"de", nil, 2, 2},
+		{" FR ", nil, 2, 2},
+		{"ZZ", ErrNoCountryData, 0, 0},
+		{"", ErrNoCountryData, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			got, err := q.CountryDetail(context.Background(), tt.code)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("CountryDetail(%q) error = %v, want %v", tt.code, err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			want := strings.ToUpper(strings.TrimSpace(tt.code))
+			if got.Country != want || got.TotalConnections != tt.wantCount || len(got.Recent) != tt.wantRecent {
+				t.Errorf("CountryDetail(%q) = %+v, want %s with %d connections and %d recent", tt.code, got, want, tt.wantCount, tt.wantRecent)
+			}
+			for _, r := range got.Recent {
+				if r.Country != want {
+					t.Errorf("CountryDetail(%q) lists a connection from %s", tt.code, r.Country)
+				}
+			}
+		})
+	}
+}
+
+// TestJSONKeys pins the keys the API has always served
+func TestJSONKeys(t *testing.T) {
+	tests := []struct {
+		value any
+		keys  string
+	}{
+		{TodayStats{}, "hourly total_bytes total_connections"},
+		{HourlyStat{}, "connections hour"},
+		{WeekStats{}, "average_per_day daily total_bytes total_connections"},
+		{DailyStat{}, "connections day total_bytes"},
+		{PeakUsage{}, "busiest_country busiest_country_name busiest_country_sessions peak_day peak_day_connections peak_hour peak_hour_connections"},
+		{Comparison{}, "last_week_bytes last_week_connections this_week_bytes this_week_connections today_bytes today_connections yesterday_bytes yesterday_connections"},
+		{CountryDetail{}, "country country_name recent total_bytes total_connections"},
+		{RecentConnection{}, "bytes_in bytes_out city connected_at country country_name duration_seconds"},
+		{CountryBreakdown{}, "countries total_connections"},
+		{CountryUsage{}, "connections country country_name percentage total_bytes"},
+		{TrafficSummary{}, "active_connections avg_duration_seconds download_gb download_percent total_connections total_traffic_gb traffic_per_connection_mb traffic_per_day_gb traffic_per_hour_gb upload_gb upload_percent uptime_seconds"},
+		{Snapshot{}, "stats timestamp top_countries"},
+		{ServerInfo{TopCountry: &CountryUsage{}}, "active_connections countries_served database_size_bytes download_gb rejected_connections top_country total_connections total_traffic_gb updated_at upload_gb uptime_seconds"},
+		{PublicStatsResponse{}, "active_connections countries rejected_connections total_connections total_traffic_gb updated_at uptime_seconds"},
+	}
+	for _, tt := range tests {
+		name := reflect.TypeOf(tt.value).Name()
+		t.Run(name, func(t *testing.T) {
+			data, err := json.Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m map[string]any
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for key := range m {
+				keys = append(keys, key)
+			}
+			slices.Sort(keys)
+			if got := strings.Join(keys, " "); got != tt.keys {
+				t.Errorf("%s keys = %s, want %s", name, got, tt.keys)
+			}
+		})
+	}
+}
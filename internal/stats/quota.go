@@ -0,0 +1,509 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Quota subject types
+const (
+	SubjectUser = "user"
+	SubjectIP   = "ip"
+)
+
+// limitsRefresh is how often per-subject limits are reloaded from the
+// database, so quotas changed by another process eventually apply.
+const limitsRefresh = time.Minute
+
+// subjectIdle is how long an unused subject stays in memory
+const subjectIdle = time.Hour
+
+// ErrQuotaExceeded is returned when a user or client IP has used up a quota
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+// QuotaLimits are byte limits per period. Zero means unlimited.
+type QuotaLimits struct {
+	DailyBytes   int64 `json:"daily_bytes"`
+	MonthlyBytes int64 `json:"monthly_bytes"`
+	TotalBytes   int64 `json:"total_bytes"`
+}
+
+// IsZero reports whether no limit is set
+func (l QuotaLimits) IsZero() bool {
+	return l.DailyBytes <= 0 && l.MonthlyBytes <= 0 && l.TotalBytes <= 0
+}
+
+// Quota is a quota configured for a single user or client IP
+type Quota struct {
+	SubjectType string `json:"subject_type"`
+	Subject     string `json:"subject"`
+	QuotaLimits
+}
+
+// QuotaUsage is a quota together with the traffic used so far
+type QuotaUsage struct {
+	Quota
+	DailyUsed   int64 `json:"daily_used"`
+	MonthlyUsed int64 `json:"monthly_used"`
+	TotalUsed   int64 `json:"total_used"`
+	Exceeded    bool  `json:"exceeded"`
+}
+
+type subjectKey struct {
+	kind, name string
+}
+
+// subjectUsage holds in-memory counters for one subject. Bytes are added
+// to the counters immediately and to pending, which is flushed to the
+// quota_usage table periodically.
+type subjectUsage struct {
+	mu sync.Mutex
+
+	loaded       bool
+	conns        int // open connections holding this entry
+	limits       QuotaLimits
+	limitsLoaded time.Time
+	lastUsed     time.Time
+
+	day, month                       string
+	dayBytes, monthBytes, totalBytes int64
+	pending                          map[string]int64 // period -> bytes
+}
+
+// QuotaManager enforces daily, monthly and total byte quotas per user and
+// per client IP. Usage is persisted in SQLite.
+type QuotaManager struct {
+	db       *sql.DB
+	defaults map[string]QuotaLimits
+
+	mu       sync.Mutex
+	subjects map[subjectKey]*subjectUsage
+
+	done chan struct{}
+}
+
+// NewQuotaManager creates a quota manager. perUser and perClient are the
+// defaults for subjects without an explicit quota.
+func NewQuotaManager(db *sql.DB, perUser, perClient QuotaLimits, flushInterval time.Duration) *QuotaManager {
+	if flushInterval <= 0 {
+		flushInterval = 30 * time.Second
+	}
+
+	qm := &QuotaManager{
+		db: db,
+		defaults: map[string]QuotaLimits{
+			SubjectUser: perUser,
+			SubjectIP:   perClient,
+		},
+		subjects: make(map[subjectKey]*subjectUsage),
+		done:     make(chan struct{}),
+	}
+
+	go qm.flushLoop(flushInterval)
+
+	log.Println("[QUOTA] Quota manager initialized")
+	return qm
+}
+
+// QuotaError is returned by Check for subjects over their quota. It
+// matches ErrQuotaExceeded with errors.Is.
+type QuotaError struct {
+	SubjectType string
+	Subject     string
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%v for %s %s", ErrQuotaExceeded, e.SubjectType, e.Subject)
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// NotAllowed makes the SOCKS5 server reply "connection not allowed by
+// ruleset" instead of a general failure
+func (e *QuotaError) NotAllowed() bool {
+	return true
+}
+
+// Check returns a *QuotaError if username or clientIP has no traffic left
+func (qm *QuotaManager) Check(ctx context.Context, username, clientIP string) error {
+	for _, key := range quotaSubjects(username, clientIP) {
+		su, err := qm.subject(ctx, key)
+		if err != nil {
+			return err
+		}
+		if su.exceeded(time.Now()) {
+			return &QuotaError{SubjectType: key.kind, Subject: key.name}
+		}
+	}
+	return nil
+}
+
+// account adds n bytes to each subject and reports whether any of them
+// has exceeded its quota
+func (qm *QuotaManager) account(subjects []*subjectUsage, n int64) bool {
+	now := time.Now()
+	exceeded := false
+	for _, su := range subjects {
+		if su.add(now, n) {
+			exceeded = true
+		}
+	}
+	return exceeded
+}
+
+// subjectsFor returns the usage entries for a new connection
+func (qm *QuotaManager) subjectsFor(ctx context.Context, username, clientIP string) []*subjectUsage {
+	var subjects []*subjectUsage
+	for _, key := range quotaSubjects(username, clientIP) {
+		su, err := qm.subject(ctx, key)
+		if err != nil {
+			log.Printf("[QUOTA] Failed to load usage for %s %s: %v", key.kind, key.name, err)
+			continue
+		}
+		su.mu.Lock()
+		su.conns++
+		su.mu.Unlock()
+		subjects = append(subjects, su)
+	}
+	return subjects
+}
+
+func quotaSubjects(username, clientIP string) []subjectKey {
+	var keys []subjectKey
+	if username != "" {
+		keys = append(keys, subjectKey{SubjectUser, username})
+	}
+	if clientIP != "" && clientIP != "unknown" {
+		keys = append(keys, subjectKey{SubjectIP, clientIP})
+	}
+	return keys
+}
+
+// subject returns the in-memory usage for key, loading it on first use
+func (qm *QuotaManager) subject(ctx context.Context, key subjectKey) (*subjectUsage, error) {
+	qm.mu.Lock()
+	su, ok := qm.subjects[key]
+	if !ok {
+		su = &subjectUsage{pending: make(map[string]int64)}
+		qm.subjects[key] = su
+	}
+	qm.mu.Unlock()
+
+	su.mu.Lock()
+	defer su.mu.Unlock()
+
+	now := time.Now()
+	su.lastUsed = now
+
+	if !su.loaded {
+		if err := qm.loadUsage(ctx, key, su, now); err != nil {
+			return nil, err
+		}
+		su.loaded = true
+	}
+
+	if now.Sub(su.limitsLoaded) > limitsRefresh {
+		limits, err := qm.loadLimits(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		su.limits = limits
+		su.limitsLoaded = now
+	}
+
+	return su, nil
+}
+
+// release drops the connection references taken by subjectsFor
+func (qm *QuotaManager) release(subjects []*subjectUsage) {
+	for _, su := range subjects {
+		su.mu.Lock()
+		su.conns--
+		su.mu.Unlock()
+	}
+}
+
+func (qm *QuotaManager) loadUsage(ctx context.Context, key subjectKey, su *subjectUsage, now time.Time) error {
+	su.day, su.month = dayPeriod(now), monthPeriod(now)
+
+	rows, err := qm.db.QueryContext(ctx,
+		`SELECT period, bytes FROM quota_usage
+		 WHERE subject_type = ? AND subject = ? AND period IN (?, ?, 'total')`,
+		key.kind, key.name, su.day, su.month,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to load quota usage: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var period string
+		var bytes int64
+		if err := rows.Scan(&period, &bytes); err != nil {
+			return fmt.Errorf("failed to scan quota usage: %w", err)
+		}
+		switch period {
+		case su.day:
+			su.dayBytes = bytes
+		case su.month:
+			su.monthBytes = bytes
+		case "total":
+			su.totalBytes = bytes
+		}
+	}
+	return rows.Err()
+}
+
+func (qm *QuotaManager) loadLimits(ctx context.Context, key subjectKey) (QuotaLimits, error) {
+	var limits QuotaLimits
+	err := qm.db.QueryRowContext(ctx,
+		`SELECT daily_bytes, monthly_bytes, total_bytes FROM quotas
+		 WHERE subject_type = ? AND subject = ?`,
+		key.kind, key.name,
+	).Scan(&limits.DailyBytes, &limits.MonthlyBytes, &limits.TotalBytes)
+	if err == sql.ErrNoRows {
+		return qm.defaults[key.kind], nil
+	}
+	if err != nil {
+		return QuotaLimits{}, fmt.Errorf("failed to load quota: %w", err)
+	}
+	return limits, nil
+}
+
+// add records n bytes and reports whether a quota is now exceeded
+func (su *subjectUsage) add(now time.Time, n int64) bool {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+
+	su.roll(now)
+	su.dayBytes += n
+	su.monthBytes += n
+	su.totalBytes += n
+	su.pending[su.day] += n
+	su.pending[su.month] += n
+	su.pending["total"] += n
+	su.lastUsed = now
+
+	return su.overLimit()
+}
+
+func (su *subjectUsage) exceeded(now time.Time) bool {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+
+	su.roll(now)
+	return su.overLimit()
+}
+
+// roll resets the counters when a new day or month starts
+func (su *subjectUsage) roll(now time.Time) {
+	if day := dayPeriod(now); day != su.day {
+		su.day = day
+		su.dayBytes = 0
+	}
+	if month := monthPeriod(now); month != su.month {
+		su.month = month
+		su.monthBytes = 0
+	}
+}
+
+func (su *subjectUsage) overLimit() bool {
+	l := su.limits
+	return (l.DailyBytes > 0 && su.dayBytes >= l.DailyBytes) ||
+		(l.MonthlyBytes > 0 && su.monthBytes >= l.MonthlyBytes) ||
+		(l.TotalBytes > 0 && su.totalBytes >= l.TotalBytes)
+}
+
+func dayPeriod(t time.Time) string {
+	return "day:" + t.Format("2006-01-02")
+}
+
+func monthPeriod(t time.Time) string {
+	return "month:" + t.Format("2006-01")
+}
+
+// SetQuota creates or replaces the quota of a subject
+func (qm *QuotaManager) SetQuota(ctx context.Context, q Quota) error {
+	if q.SubjectType != SubjectUser && q.SubjectType != SubjectIP {
+		return fmt.Errorf("invalid subject type %q", q.SubjectType)
+	}
+	if q.Subject == "" {
+		return fmt.Errorf("subject is required")
+	}
+
+	_, err := qm.db.ExecContext(ctx,
+		`INSERT INTO quotas (subject_type, subject, daily_bytes, monthly_bytes, total_bytes, updated_at)
+		 VALUES (?, ?, ?, ?, ?, datetime('now'))
+		 ON CONFLICT(subject_type, subject) DO UPDATE SET
+		     daily_bytes = excluded.daily_bytes,
+		     monthly_bytes = excluded.monthly_bytes,
+		     total_bytes = excluded.total_bytes,
+		     updated_at = excluded.updated_at`,
+		q.SubjectType, q.Subject, q.DailyBytes, q.MonthlyBytes, q.TotalBytes,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save quota: %w", err)
+	}
+
+	qm.invalidate(subjectKey{q.SubjectType, q.Subject})
+	return nil
+}
+
+// DeleteQuota removes the explicit quota of a subject; defaults apply again
+func (qm *QuotaManager) DeleteQuota(ctx context.Context, subjectType, subject string) error {
+	if _, err := qm.db.ExecContext(ctx,
+		`DELETE FROM quotas WHERE subject_type = ? AND subject = ?`, subjectType, subject,
+	); err != nil {
+		return fmt.Errorf("failed to delete quota: %w", err)
+	}
+
+	qm.invalidate(subjectKey{subjectType, subject})
+	return nil
+}
+
+// ResetUsage clears the recorded usage of a subject
+func (qm *QuotaManager) ResetUsage(ctx context.Context, subjectType, subject string) error {
+	if _, err := qm.db.ExecContext(ctx,
+		`DELETE FROM quota_usage WHERE subject_type = ? AND subject = ?`, subjectType, subject,
+	); err != nil {
+		return fmt.Errorf("failed to reset quota usage: %w", err)
+	}
+
+	qm.mu.Lock()
+	if su, ok := qm.subjects[subjectKey{subjectType, subject}]; ok {
+		su.mu.Lock()
+		su.dayBytes, su.monthBytes, su.totalBytes = 0, 0, 0
+		su.pending = make(map[string]int64)
+		su.mu.Unlock()
+	}
+	qm.mu.Unlock()
+	return nil
+}
+
+// ListQuotas returns all explicit quotas with their current usage
+func (qm *QuotaManager) ListQuotas(ctx context.Context) ([]QuotaUsage, error) {
+	// Make sure the usage below includes recent traffic
+	qm.Flush()
+
+	now := time.Now()
+	rows, err := qm.db.QueryContext(ctx,
+		`SELECT q.subject_type, q.subject, q.daily_bytes, q.monthly_bytes, q.total_bytes,
+		        COALESCE(SUM(CASE WHEN u.period = ? THEN u.bytes END), 0),
+		        COALESCE(SUM(CASE WHEN u.period = ? THEN u.bytes END), 0),
+		        COALESCE(SUM(CASE WHEN u.period = 'total' THEN u.bytes END), 0)
+		 FROM quotas q
+		 LEFT JOIN quota_usage u ON u.subject_type = q.subject_type AND u.subject = q.subject
+		 GROUP BY q.subject_type, q.subject
+		 ORDER BY q.subject_type, q.subject`,
+		dayPeriod(now), monthPeriod(now),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list quotas: %w", err)
+	}
+	defer rows.Close()
+
+	var quotas []QuotaUsage
+	for rows.Next() {
+		var qu QuotaUsage
+		if err := rows.Scan(&qu.SubjectType, &qu.Subject,
+			&qu.DailyBytes, &qu.MonthlyBytes, &qu.TotalBytes,
+			&qu.DailyUsed, &qu.MonthlyUsed, &qu.TotalUsed); err != nil {
+			return nil, fmt.Errorf("failed to scan quota: %w", err)
+		}
+		qu.Exceeded = (qu.DailyBytes > 0 && qu.DailyUsed >= qu.DailyBytes) ||
+			(qu.MonthlyBytes > 0 && qu.MonthlyUsed >= qu.MonthlyBytes) ||
+			(qu.TotalBytes > 0 && qu.TotalUsed >= qu.TotalBytes)
+		quotas = append(quotas, qu)
+	}
+	return quotas, rows.Err()
+}
+
+func (qm *QuotaManager) invalidate(key subjectKey) {
+	qm.mu.Lock()
+	su, ok := qm.subjects[key]
+	qm.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	su.mu.Lock()
+	su.limitsLoaded = time.Time{}
+	su.mu.Unlock()
+}
+
+// Flush writes pending usage to the database and forgets idle subjects
+func (qm *QuotaManager) Flush() {
+	qm.mu.Lock()
+	subjects := make(map[subjectKey]*subjectUsage, len(qm.subjects))
+	for key, su := range qm.subjects {
+		subjects[key] = su
+	}
+	qm.mu.Unlock()
+
+	now := time.Now()
+	for key, su := range subjects {
+		su.mu.Lock()
+		pending := su.pending
+		su.pending = make(map[string]int64)
+		idle := su.conns == 0 && now.Sub(su.lastUsed) > subjectIdle
+		su.mu.Unlock()
+
+		for period, bytes := range pending {
+			if bytes == 0 {
+				continue
+			}
+			_, err := qm.db.Exec(
+				`INSERT INTO quota_usage (subject_type, subject, period, bytes, updated_at)
+				 VALUES (?, ?, ?, ?, datetime('now'))
+				 ON CONFLICT(subject_type, subject, period) DO UPDATE SET
+				     bytes = bytes + excluded.bytes,
+				     updated_at = excluded.updated_at`,
+				key.kind, key.name, period, bytes,
+			)
+			if err != nil {
+				log.Printf("[QUOTA] Failed to flush usage for %s %s: %v", key.kind, key.name, err)
+				// Put it back for the next flush
+				su.mu.Lock()
+				su.pending[period] += bytes
+				su.mu.Unlock()
+			}
+		}
+
+		if idle {
+			qm.mu.Lock()
+			su.mu.Lock()
+			if len(su.pending) == 0 && su.conns == 0 && now.Sub(su.lastUsed) > subjectIdle {
+				delete(qm.subjects, key)
+			}
+			su.mu.Unlock()
+			qm.mu.Unlock()
+		}
+	}
+}
+
+func (qm *QuotaManager) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			qm.Flush()
+		case <-qm.done:
+			return
+		}
+	}
+}
+
+// Close stops the flush loop and writes pending usage
+func (qm *QuotaManager) Close() {
+	close(qm.done)
+	qm.Flush()
+}
@@ -2,12 +2,16 @@ package stats
 
 import (
 	"context"
+	"io"
 	"log"
 	"net"
 	"sync/atomic"
 	"time"
 )
 
+// CloseQuotaExceeded is the close reason of connections cut by a quota
+const CloseQuotaExceeded = "quota exceeded"
+
 // ConnectionTracker tracks statistics for a single connection
 type ConnectionTracker struct {
 	id        uint64
@@ -17,24 +21,72 @@ type ConnectionTracker struct {
 	bytesOut  atomic.Int64
 	startTime time.Time
 	closed    atomic.Bool
+	reason    atomic.Pointer[string]
+
+	// quota subjects charged for the traffic of this connection
+	quotaSubjects []*subjectUsage
+	quotaCut      atomic.Bool
+	cutConn       atomic.Value // io.Closer closed when a quota runs out
 }
 
-// WrapConnection wraps a net.Conn to track traffic
+// WrapConnection wraps a net.Conn to track traffic. Closing the returned
+// connection finalizes the tracker.
 func (ct *ConnectionTracker) WrapConnection(conn net.Conn) net.Conn {
+	ct.Attach(conn)
 	return &trackedConn{
 		Conn:    conn,
 		tracker: ct,
 	}
 }
 
+// Attach sets the connection to cut once a quota is exhausted, for
+// traffic counted with AddBytesIn/AddBytesOut instead of WrapConnection
+func (ct *ConnectionTracker) Attach(conn io.Closer) {
+	ct.cutConn.Store(conn)
+}
+
 // AddBytesIn adds to the bytes in counter
 func (ct *ConnectionTracker) AddBytesIn(n int64) {
 	ct.bytesIn.Add(n)
+	ct.chargeQuota(n)
 }
 
 // AddBytesOut adds to the bytes out counter
 func (ct *ConnectionTracker) AddBytesOut(n int64) {
 	ct.bytesOut.Add(n)
+	ct.chargeQuota(n)
+}
+
+// chargeQuota adds traffic to the quotas of this connection and cuts the
+// connection once one of them is exhausted
+func (ct *ConnectionTracker) chargeQuota(n int64) {
+	if len(ct.quotaSubjects) == 0 {
+		return
+	}
+	if !ct.collector.quotas.account(ct.quotaSubjects, n) {
+		return
+	}
+	if !ct.quotaCut.CompareAndSwap(false, true) {
+		return
+	}
+
+	log.Printf("[QUOTA] Connection %d exceeded its traffic quota, closing", ct.id)
+	ct.setReason(CloseQuotaExceeded)
+	if conn, ok := ct.cutConn.Load().(io.Closer); ok {
+		conn.Close()
+	}
+}
+
+// setReason records why the connection was closed. The first reason wins.
+func (ct *ConnectionTracker) setReason(reason string) {
+	ct.reason.CompareAndSwap(nil, &reason)
+}
+
+// CloseWithReason finalizes the connection tracking, recording reason
+func (ct *ConnectionTracker) CloseWithReason(reason string) error {
+	ct.setReason(reason)
+	ct.Close(context.Background())
+	return nil
 }
 
 // Close finalizes the connection tracking
@@ -48,12 +100,17 @@ func (ct *ConnectionTracker) Close(ctx context.Context) {
 	duration := int64(time.Since(ct.startTime).Seconds())
 	totalBytes := bytesIn + bytesOut
 
+	var reason string
+	if r := ct.reason.Load(); r != nil {
+		reason = *r
+	}
+
 	// Update database
 	_, err := ct.collector.db.ExecContext(ctx,
 		`UPDATE connections
-		 SET bytes_in = ?, bytes_out = ?, disconnected_at = ?, duration = ?
+		 SET bytes_in = ?, bytes_out = ?, disconnected_at = ?, duration = ?, close_reason = ?
 		 WHERE id = ?`,
-		bytesIn, bytesOut, time.Now(), duration, ct.id,
+		bytesIn, bytesOut, time.Now(), duration, nullString(reason), ct.id,
 	)
 	if err != nil {
 		log.Printf("[STATS] Failed to update connection stats: %v", err)
@@ -64,9 +121,12 @@ func (ct *ConnectionTracker) Close(ctx context.Context) {
 	ct.collector.updateServerStats(0, bytesIn, bytesOut)
 	ct.collector.updateGeoStats(ct.country, totalBytes, false)
 	ct.collector.activeConns.Delete(ct.id)
+	if len(ct.quotaSubjects) > 0 {
+		ct.collector.quotas.release(ct.quotaSubjects)
+	}
 
-	log.Printf("[STATS] Connection closed: ID=%d, Duration=%ds, In=%d, Out=%d",
-		ct.id, duration, bytesIn, bytesOut)
+	log.Printf("[STATS] Connection closed: ID=%d, Duration=%ds, In=%d, Out=%d, Reason=%s",
+		ct.id, duration, bytesIn, bytesOut, reason)
 }
 
 // trackedConn wraps a connection to track bytes transferred
@@ -90,3 +150,33 @@ func (tc *trackedConn) Write(p []byte) (n int, err error) {
 	}
 	return
 }
+
+// NetConn returns the wrapped connection. The SOCKS5 relay uses it for
+// splice and reports the bytes through AddBytesIn and AddBytesOut.
+func (tc *trackedConn) NetConn() net.Conn {
+	return tc.Conn
+}
+
+// AddBytesIn counts bytes read from the connection outside of Read
+func (tc *trackedConn) AddBytesIn(n int64) {
+	tc.tracker.AddBytesIn(n)
+}
+
+// AddBytesOut counts bytes written to the connection outside of Write
+func (tc *trackedConn) AddBytesOut(n int64) {
+	tc.tracker.AddBytesOut(n)
+}
+
+// CloseWithReason closes the connection and records reason in the
+// connections table
+func (tc *trackedConn) CloseWithReason(reason string) error {
+	tc.tracker.setReason(reason)
+	return tc.Close()
+}
+
+// Close closes the connection and finalizes its tracker
+func (tc *trackedConn) Close() error {
+	err := tc.Conn.Close()
+	tc.tracker.Close(context.Background())
+	return err
+}
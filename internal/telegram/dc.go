@@ -0,0 +1,215 @@
+// Package telegram knows the Telegram data centers: their endpoint
+// addresses and the address ranges they serve from.
+package telegram
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultDC serves clients asking for a DC we do not know, e.g. a CDN
+const DefaultDC = 2
+
+// DCPort is the port DC endpoints listen on
+const DCPort = 443
+
+// DC is a Telegram data center
+type DC struct {
+	ID int `yaml:"id" json:"id"`
+	// Endpoint addresses clients connect to
+	IPv4 []string `yaml:"ipv4" json:"ipv4"`
+	IPv6 []string `yaml:"ipv6" json:"ipv6"`
+	// Ranges classified as this DC, endpoints are included implicitly
+	CIDRs []string `yaml:"cidrs" json:"cidrs"`
+}
+
+// defaultDCs covers the Telegram ranges of config.example.yml, see
+// https://core.telegram.org/resources/cidr.txt. Ranges that overlap are
+// told apart by the longest prefix, so the endpoints of DC 3 and DC 4
+// win over the /22s of their neighbours.
+var defaultDCs = []DC{
+	{
+		ID:    1,
+		IPv4:  []string{"149.154.175.50"},
+		IPv6:  []string{"2001:b28:f23d:f001::a"},
+		CIDRs: []string{"149.154.172.0/22", "2001:b28:f23d:f001::/64"},
+	},
+	{
+		ID:   2,
+		IPv4: []string{"149.154.167.51"},
+		IPv6: []string{"2001:67c:4e8:f002::a"},
+		CIDRs: []string{
+			"149.154.160.0/21", "149.154.168.0/22", "95.161.64.0/20",
+			"2001:67c:4e8:f002::/64",
+		},
+	},
+	{
+		ID:    3,
+		IPv4:  []string{"149.154.175.100"},
+		IPv6:  []string{"2001:b28:f23d:f003::a"},
+		CIDRs: []string{"2001:b28:f23d:f003::/64"},
+	},
+	{
+		ID:   4,
+		IPv4: []string{"149.154.167.91", "149.154.167.92"},
+		IPv6: []string{"2001:67c:4e8:f004::a"},
+		CIDRs: []string{
+			"91.108.4.0/22", "91.108.8.0/22", "91.108.12.0/22", "91.108.16.0/22", "91.108.20.0/22",
+			"2001:67c:4e8:f004::/64",
+		},
+	},
+	{
+		ID:   5,
+		IPv4: []string{"91.108.56.130"},
+		IPv6: []string{"2001:b28:f23f:f005::a"},
+		CIDRs: []string{
+			"91.108.56.0/23", "91.108.58.0/23", "91.105.192.0/23",
+			"2001:b28:f23f::/48",
+		},
+	},
+}
+
+type dcPrefix struct {
+	prefix netip.Prefix
+	id     int
+}
+
+// DCMap maps DC ids to endpoints and addresses to DC ids. It is safe for
+// concurrent use and can be replaced from a file at runtime.
+type DCMap struct {
+	mu       sync.RWMutex
+	dcs      []DC
+	byID     map[int]DC
+	prefixes []dcPrefix // longest first
+}
+
+// NewDCMap returns a map with the built-in table
+func NewDCMap() *DCMap {
+	m := &DCMap{}
+	if err := m.Set(defaultDCs); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Set replaces the table
+func (m *DCMap) Set(dcs []DC) error {
+	byID := make(map[int]DC, len(dcs))
+	var prefixes []dcPrefix
+	for _, dc := range dcs {
+		if dc.ID <= 0 {
+			return fmt.Errorf("invalid DC id %d", dc.ID)
+		}
+		if _, ok := byID[dc.ID]; ok {
+			return fmt.Errorf("duplicate DC %d", dc.ID)
+		}
+		byID[dc.ID] = dc
+
+		for _, s := range append(append([]string{}, dc.IPv4...), dc.IPv6...) {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return fmt.Errorf("DC %d: %w", dc.ID, err)
+			}
+			prefixes = append(prefixes, dcPrefix{netip.PrefixFrom(addr, addr.BitLen()), dc.ID})
+		}
+		for _, s := range dc.CIDRs {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return fmt.Errorf("DC %d: %w", dc.ID, err)
+			}
+			prefixes = append(prefixes, dcPrefix{prefix.Masked(), dc.ID})
+		}
+	}
+	sort.SliceStable(prefixes, func(i, j int) bool {
+		return prefixes[i].prefix.Bits() > prefixes[j].prefix.Bits()
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dcs = append([]DC(nil), dcs...)
+	m.byID = byID
+	m.prefixes = prefixes
+	return nil
+}
+
+// dcFile is the format of files read by Load
+type dcFile struct {
+	DCs []DC `yaml:"dcs"`
+}
+
+// Load replaces the table with the one in a YAML file
+func (m *DCMap) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var f dcFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(f.DCs) == 0 {
+		return fmt.Errorf("%s lists no DCs", path)
+	}
+	return m.Set(f.DCs)
+}
+
+// DCs returns the table sorted by id
+func (m *DCMap) DCs() []DC {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	dcs := append([]DC(nil), m.dcs...)
+	sort.Slice(dcs, func(i, j int) bool { return dcs[i].ID < dcs[j].ID })
+	return dcs
+}
+
+// Lookup returns the DC ip belongs to, or 0 if it is not a known DC address
+func (m *DCMap) Lookup(ip net.IP) int {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return 0
+	}
+	addr = addr.Unmap()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, p := range m.prefixes {
+		if p.prefix.Contains(addr) {
+			return p.id
+		}
+	}
+	return 0
+}
+
+// Addr returns the endpoint of DC id. Media DCs have negative ids and
+// share the endpoints of the regular ones; unknown ids get DefaultDC.
+// It falls back to the other family if the DC has no endpoint in the
+// preferred one.
+func (m *DCMap) Addr(id int, preferIPv6 bool) string {
+	if id < 0 {
+		id = -id
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	dc, ok := m.byID[id]
+	if !ok {
+		dc = m.byID[DefaultDC]
+	}
+	first, second := dc.IPv4, dc.IPv6
+	if preferIPv6 {
+		first, second = second, first
+	}
+	for _, ips := range [][]string{first, second} {
+		if len(ips) > 0 {
+			return net.JoinHostPort(ips[0], strconv.Itoa(DCPort))
+		}
+	}
+	return ""
+}
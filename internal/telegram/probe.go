@@ -0,0 +1,120 @@
+package telegram
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// probeTimeout bounds a single latency probe
+const probeTimeout = 5 * time.Second
+
+// Probe is the result of connecting to a DC endpoint
+type Probe struct {
+	DCID     int       `json:"dc_id"`
+	Addr     string    `json:"addr"`
+	RTTMs    float64   `json:"rtt_ms,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	ProbedAt time.Time `json:"probed_at"`
+}
+
+// Prober measures the TCP connect time to every DC endpoint
+type Prober struct {
+	db   *sql.DB
+	dcs  *DCMap
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// NewProber creates a prober. dial should leave from the same addresses
+// as proxied traffic but not be accounted as a proxied connection.
+func NewProber(db *sql.DB, dcs *DCMap, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *Prober {
+	return &Prober{db: db, dcs: dcs, dial: dial}
+}
+
+// Run probes all DCs every interval until ctx is done
+func (p *Prober) Run(ctx context.Context, interval time.Duration) {
+	p.ProbeAll(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.ProbeAll(ctx)
+		}
+	}
+}
+
+// ProbeAll probes every endpoint once and stores the results
+func (p *Prober) ProbeAll(ctx context.Context) []Probe {
+	var probes []Probe
+	for _, dc := range p.dcs.DCs() {
+		for _, ip := range append(append([]string{}, dc.IPv4...), dc.IPv6...) {
+			probes = append(probes, p.probe(ctx, dc.ID, net.JoinHostPort(ip, strconv.Itoa(DCPort))))
+		}
+	}
+
+	for _, probe := range probes {
+		_, err := p.db.ExecContext(ctx,
+			`INSERT INTO dc_latency (dc_id, addr, rtt_ms, error, probed_at) VALUES (?, ?, ?, ?, ?)`,
+			probe.DCID, probe.Addr, nullFloat(probe.RTTMs, probe.Error == ""), nullString(probe.Error), probe.ProbedAt,
+		)
+		if err != nil {
+			log.Printf("[DC] Failed to save probe of %s: %v", probe.Addr, err)
+		}
+	}
+	return probes
+}
+
+func (p *Prober) probe(ctx context.Context, id int, addr string) Probe {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	probe := Probe{DCID: id, Addr: addr, ProbedAt: time.Now()}
+	conn, err := p.dial(ctx, "tcp", addr)
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	conn.Close()
+	probe.RTTMs = float64(time.Since(probe.ProbedAt).Microseconds()) / 1000
+	return probe
+}
+
+// GetLatest returns the most recent probe of every endpoint
+func (p *Prober) GetLatest(ctx context.Context) ([]Probe, error) {
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT l.dc_id, l.addr, COALESCE(l.rtt_ms, 0), COALESCE(l.error, ''), l.probed_at
+		 FROM dc_latency l
+		 JOIN (SELECT addr, MAX(probed_at) AS probed_at FROM dc_latency GROUP BY addr) latest
+		   ON latest.addr = l.addr AND latest.probed_at = l.probed_at
+		 ORDER BY l.dc_id, l.addr`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var probes []Probe
+	for rows.Next() {
+		var probe Probe
+		if err := rows.Scan(&probe.DCID, &probe.Addr, &probe.RTTMs, &probe.Error, &probe.ProbedAt); err != nil {
+			return nil, err
+		}
+		probes = append(probes, probe)
+	}
+	return probes, rows.Err()
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullFloat(f float64, valid bool) sql.NullFloat64 {
+	return sql.NullFloat64{Float64: f, Valid: valid}
+}
@@ -0,0 +1,91 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// httpConnect dials through an HTTP proxy with the CONNECT method
+type httpConnect struct {
+	address  string
+	username string
+	password string
+	forward  DialFunc
+}
+
+func (h *httpConnect) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("http upstream: network %s is not supported", network)
+	}
+
+	conn, err := h.forward(ctx, "tcp", h.address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Abort the handshake when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	br, err := h.handshake(conn, addr)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+func (h *httpConnect) handshake(conn net.Conn, addr string) (*bufio.Reader, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if h.username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(h.username + ":" + h.password))
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, proxyErrorf("http upstream: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, proxyErrorf("http upstream: read response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return nil, proxyErrorf("http upstream: %s", resp.Status)
+	}
+	// Other failures are the proxy reporting on the destination
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http upstream: CONNECT %s: %s", addr, resp.Status)
+	}
+	return br, nil
+}
+
+// bufferedConn returns bytes the proxy sent after its response first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
+}
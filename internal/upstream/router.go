@@ -0,0 +1,266 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/soaska/proxy/internal/policy"
+)
+
+// Route sends destinations matching Rule through Via, in order of
+// preference. With a HealthTarget the upstreams of the route are ordered
+// by their health checks to it instead of the shared target.
+type Route struct {
+	Rule         policy.Rule
+	Via          []string
+	HealthTarget string
+}
+
+// Router picks upstreams for destinations and fails over between them
+type Router struct {
+	mu        sync.RWMutex
+	upstreams map[string]*Upstream
+	order     []*Upstream
+	routes    []Route
+	fallback  []string
+}
+
+// NewRouter creates a router with the direct upstream and no routes
+func NewRouter(direct *Upstream) *Router {
+	r := &Router{}
+	r.Set([]*Upstream{direct}, nil, nil)
+	return r
+}
+
+// Set replaces the upstreams and routes. Destinations matching no route
+// use fallback, or the direct upstream if it is empty. Every name must
+// refer to one of upstreams.
+func (r *Router) Set(upstreams []*Upstream, routes []Route, fallback []string) error {
+	byName := make(map[string]*Upstream, len(upstreams))
+	for _, u := range upstreams {
+		if _, ok := byName[u.Name]; ok {
+			return fmt.Errorf("duplicate upstream %q", u.Name)
+		}
+		byName[u.Name] = u
+	}
+	if len(fallback) == 0 {
+		fallback = []string{Direct}
+	}
+	check := func(names []string) error {
+		if len(names) == 0 {
+			return errors.New("route has no upstreams")
+		}
+		for _, name := range names {
+			if _, ok := byName[name]; !ok {
+				return fmt.Errorf("unknown upstream %q", name)
+			}
+		}
+		return nil
+	}
+	for i, route := range routes {
+		if err := check(route.Via); err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
+		}
+	}
+	if err := check(fallback); err != nil {
+		return fmt.Errorf("default route: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.upstreams = byName
+	r.order = upstreams
+	r.routes = routes
+	r.fallback = fallback
+	return nil
+}
+
+// Update replaces the upstreams and routes of r with those of other
+func (r *Router) Update(other *Router) {
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.upstreams = other.upstreams
+	r.order = other.order
+	r.routes = other.routes
+	r.fallback = other.fallback
+}
+
+// Upstreams returns all upstreams
+func (r *Router) Upstreams() []*Upstream {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*Upstream(nil), r.order...)
+}
+
+// Candidates returns the upstreams for req that can carry its network:
+// healthy ones in order of preference, then unhealthy ones as a last
+// resort
+func (r *Router) Candidates(req *policy.Request) []*Upstream {
+	r.mu.RLock()
+	names, target := r.fallback, ""
+	for _, route := range r.routes {
+		if route.Rule.Match(req) {
+			names, target = route.Via, route.HealthTarget
+			break
+		}
+	}
+	var healthy, unhealthy []*Upstream
+	for _, name := range names {
+		u := r.upstreams[name]
+		if !u.Supports(req.Network) {
+			continue
+		}
+		if u.HealthyFor(target) {
+			healthy = append(healthy, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+	r.mu.RUnlock()
+	return append(healthy, unhealthy...)
+}
+
+// Dial dials addr for req through the first upstream that succeeds. It
+// moves on to the next one when a proxy itself cannot be reached, or when
+// the direct path times out or has no route to the destination. The
+// destination refusing the connection is reported as is.
+func (r *Router) Dial(ctx context.Context, req *policy.Request, network, addr string) (net.Conn, *Upstream, error) {
+	candidates := r.Candidates(req)
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("no upstream for %s", network)
+	}
+
+	var errs []error
+	for i, u := range candidates {
+		conn, err := r.dialVia(ctx, u, i+1 < len(candidates), network, addr)
+		if err == nil {
+			return conn, u, nil
+		}
+		errs = append(errs, fmt.Errorf("via %s: %w", u.Name, err))
+		if ctx.Err() != nil || !shouldFailover(u, err) {
+			break
+		}
+		if i+1 < len(candidates) {
+			log.Printf("[UPSTREAM] Dialing %s via %s failed, trying %s: %v", addr, u.Name, candidates[i+1].Name, err)
+		}
+	}
+	if len(errs) == 1 {
+		return nil, nil, errors.Unwrap(errs[0])
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// dialVia dials addr through u. A direct attempt with other upstreams
+// left gets half of the time, so timing out still leaves them a chance.
+func (r *Router) dialVia(ctx context.Context, u *Upstream, more bool, network, addr string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok && more && u.Type == TypeDirect {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.Now().Add(time.Until(deadline)/2))
+		defer cancel()
+	}
+	return u.DialContext(ctx, network, addr)
+}
+
+// shouldFailover reports whether the next upstream is worth trying after
+// err through u. A proxy failing itself is. On the direct path a timeout
+// or an unreachable network may be local routing trouble another upstream
+// avoids, while a refused or reset connection means the destination
+// answered.
+func shouldFailover(u *Upstream, err error) bool {
+	if isProxyError(err) {
+		return true
+	}
+	if u.Type != TypeDirect {
+		return false
+	}
+	if errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// RunHealthChecks dials target through every upstream each interval until
+// ctx is done, and the health targets of routes through their upstreams.
+// An upstream is healthy while its last check succeeded.
+func (r *Router) RunHealthChecks(ctx context.Context, target string, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.CheckAll(ctx, target, timeout)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// healthCheck is a target to check through an upstream
+type healthCheck struct {
+	u      *Upstream
+	target string
+	route  bool // a route's own target rather than the shared one
+}
+
+// CheckAll runs one health check of every upstream concurrently
+func (r *Router) CheckAll(ctx context.Context, target string, timeout time.Duration) {
+	r.mu.RLock()
+	var checks []healthCheck
+	for _, u := range r.order {
+		checks = append(checks, healthCheck{u, target, false})
+	}
+	seen := make(map[healthCheck]bool)
+	for _, route := range r.routes {
+		if route.HealthTarget == "" {
+			continue
+		}
+		for _, name := range route.Via {
+			hc := healthCheck{r.upstreams[name], route.HealthTarget, true}
+			if !seen[hc] {
+				seen[hc] = true
+				checks = append(checks, hc)
+			}
+		}
+	}
+	r.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, hc := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hc.run(ctx, timeout)
+		}()
+	}
+	wg.Wait()
+}
+
+func (hc healthCheck) run(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := hc.u.DialContext(ctx, "tcp", hc.target)
+	if err != nil && ctx.Err() != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+	var rtt time.Duration
+	if err == nil {
+		conn.Close()
+		rtt = time.Since(start)
+	}
+	if hc.route {
+		hc.u.setTargetHealth(hc.target, err, rtt)
+	} else {
+		hc.u.setHealth(err, rtt)
+	}
+}
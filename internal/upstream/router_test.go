@@ -0,0 +1,140 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/soaska/proxy/internal/policy"
+)
+
+// testUpstream is an upstream whose dials fail with err, or succeed if nil
+func testUpstream(name, typ string, err error) *Upstream {
+	return &Upstream{Name: name, Type: typ, healthy: true, dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if err != nil {
+			return nil, err
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	}}
+}
+
+func dialError(errno syscall.Errno) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+}
+
+func TestDialFailover(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    *Upstream
+		failover bool
+	}{
+		{"direct unreachable network", testUpstream(Direct, TypeDirect, dialError(syscall.ENETUNREACH)), true},
+		{"direct unreachable host", testUpstream(Direct, TypeDirect, dialError(syscall.EHOSTUNREACH)), true},
+		{"direct timeout", testUpstream(Direct, TypeDirect, &net.OpError{Op: "dial", Net: "tcp", Err: context.DeadlineExceeded}), true},
+		{"direct refused", testUpstream(Direct, TypeDirect, dialError(syscall.ECONNREFUSED)), false},
+		{"direct reset", testUpstream(Direct, TypeDirect, dialError(syscall.ECONNRESET)), false},
+		{"proxy unreachable", testUpstream("first", TypeSOCKS5, proxyErrorf("dial proxy: %w", dialError(syscall.ECONNREFUSED))), true},
+		{"destination refused through proxy", testUpstream("first", TypeSOCKS5, errors.New("socks5 upstream: CONNECT: connection refused")), false},
+		{"destination unreachable through proxy", testUpstream("first", TypeSOCKS5, dialError(syscall.EHOSTUNREACH)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backup := testUpstream("backup", TypeSOCKS5, nil)
+			r := &Router{}
+			if err := r.Set([]*Upstream{tt.first, backup}, nil, []string{tt.first.Name, backup.Name}); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			conn, u, err := r.Dial(ctx, &policy.Request{Network: "tcp"}, "tcp", "192.0.2.1:443")
+			if tt.failover {
+				if err != nil || u != backup {
+					t.Fatalf("Dial() = %v, %v, want a connection via backup", u, err)
+				}
+				conn.Close()
+				return
+			}
+			if err == nil {
+				conn.Close()
+				t.Fatalf("Dial() connected via %s, want the error of %s", u.Name, tt.first.Name)
+			}
+		})
+	}
+}
+
+// TestDialDirectTimeoutLeavesTime checks a hanging direct dial gives the
+// next upstream part of the deadline
+func TestDialDirectTimeoutLeavesTime(t *testing.T) {
+	direct := NewDirect(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+	})
+	backup := testUpstream("backup", TypeSOCKS5, nil)
+	r := &Router{}
+	if err := r.Set([]*Upstream{direct, backup}, nil, []string{Direct, backup.Name}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	conn, u, err := r.Dial(ctx, &policy.Request{Network: "tcp"}, "tcp", "192.0.2.1:443")
+	if err != nil || u != backup {
+		t.Fatalf("Dial() = %v, %v, want a connection via backup", u, err)
+	}
+	conn.Close()
+}
+
+// TestCandidatesRouteHealth checks a route health target failing reorders
+// only that route
+func TestCandidatesRouteHealth(t *testing.T) {
+	const dc4 = "149.154.167.51:443"
+	direct := NewDirect(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == dc4 {
+			return nil, dialError(syscall.ETIMEDOUT)
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	})
+	backup := testUpstream("backup", TypeSOCKS5, nil)
+
+	rule, err := policy.ParseCIDR("149.154.167.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Router{}
+	routes := []Route{{Rule: rule, Via: []string{Direct, backup.Name}, HealthTarget: dc4}}
+	if err := r.Set([]*Upstream{direct, backup}, routes, []string{Direct, backup.Name}); err != nil {
+		t.Fatal(err)
+	}
+
+	toDC4 := &policy.Request{Network: "tcp", IP: net.ParseIP("149.154.167.51"), Port: 443}
+	other := &policy.Request{Network: "tcp", IP: net.ParseIP("149.154.175.50"), Port: 443}
+	names := func(req *policy.Request) []string {
+		var names []string
+		for _, u := range r.Candidates(req) {
+			names = append(names, u.Name)
+		}
+		return names
+	}
+	if got := names(toDC4); !slices.Equal(got, []string{Direct, "backup"}) {
+		t.Fatalf("Candidates before checks = %v, want direct first", got)
+	}
+
+	r.CheckAll(context.Background(), "149.154.175.50:443", time.Second)
+	if got := names(toDC4); !slices.Equal(got, []string{"backup", Direct}) {
+		t.Errorf("Candidates for the degraded DC = %v, want backup first", got)
+	}
+	if got := names(other); !slices.Equal(got, []string{Direct, "backup"}) {
+		t.Errorf("Candidates for another DC = %v, want direct first", got)
+	}
+	if st := direct.Status(); !st.Healthy || len(st.Targets) != 1 || st.Targets[0].Healthy {
+		t.Errorf("direct status = %+v, want healthy with %s down", st, dc4)
+	}
+}
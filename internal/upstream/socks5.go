@@ -0,0 +1,169 @@
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 authentication methods and commands, RFC 1928 and RFC 1929
+const (
+	socksVersion  = 5
+	socksNoAuth   = 0
+	socksUserPass = 2
+	socksConnect  = 1
+)
+
+// socksReplies are the failure replies of RFC 1928
+var socksReplies = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5Connect dials through a SOCKS5 proxy with the CONNECT command
+type socks5Connect struct {
+	address  string
+	username string
+	password string
+	forward  DialFunc
+}
+
+func (s *socks5Connect) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks5 upstream: network %s is not supported", network)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 upstream: invalid port %q", portStr)
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("socks5 upstream: host name too long: %s", host)
+	}
+
+	conn, err := s.forward(ctx, "tcp", s.address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Abort the handshake when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	err = s.handshake(conn, host, uint16(port))
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (s *socks5Connect) handshake(conn net.Conn, host string, port uint16) error {
+	method := byte(socksNoAuth)
+	if s.username != "" {
+		method = socksUserPass
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return proxyErrorf("socks5 upstream: %w", err)
+	}
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return proxyErrorf("socks5 upstream: read greeting: %w", err)
+	}
+	if b[0] != socksVersion {
+		return proxyErrorf("socks5 upstream: unexpected protocol version %d", b[0])
+	}
+	if b[1] != method {
+		return proxyErrorf("socks5 upstream: no acceptable authentication method")
+	}
+
+	if method == socksUserPass {
+		if len(s.username) > 255 || len(s.password) > 255 {
+			return proxyErrorf("socks5 upstream: username or password too long")
+		}
+		req := []byte{1, byte(len(s.username))}
+		req = append(req, s.username...)
+		req = append(req, byte(len(s.password)))
+		req = append(req, s.password...)
+		if _, err := conn.Write(req); err != nil {
+			return proxyErrorf("socks5 upstream: %w", err)
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return proxyErrorf("socks5 upstream: read auth reply: %w", err)
+		}
+		if b[1] != 0 {
+			return proxyErrorf("socks5 upstream: authentication failed")
+		}
+	}
+
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		return proxyErrorf("socks5 upstream: %w", err)
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return proxyErrorf("socks5 upstream: read reply: %w", err)
+	}
+	if hdr[0] != socksVersion {
+		return proxyErrorf("socks5 upstream: unexpected protocol version %d", hdr[0])
+	}
+	// The proxy is fine, it could not reach the destination
+	if hdr[1] != 0 {
+		reason, ok := socksReplies[hdr[1]]
+		if !ok {
+			reason = "reply " + strconv.Itoa(int(hdr[1]))
+		}
+		return fmt.Errorf("socks5 upstream: CONNECT %s: %s", net.JoinHostPort(host, strconv.Itoa(int(port))), reason)
+	}
+
+	// Skip the bound address
+	var n int
+	switch hdr[3] {
+	case 1:
+		n = net.IPv4len
+	case 4:
+		n = net.IPv6len
+	case 3:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return proxyErrorf("socks5 upstream: read reply: %w", err)
+		}
+		n = int(b[0])
+	default:
+		return proxyErrorf("socks5 upstream: unknown address type %d", hdr[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, n+2)); err != nil {
+		return proxyErrorf("socks5 upstream: read reply: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+//go:build tailscale
+
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tsnet"
+)
+
+// TailscaleSupported reports whether the binary can join a tailnet
+const TailscaleSupported = true
+
+// tailnetNodes keeps the nodes across config reloads, a node is only
+// restarted when its settings change
+var tailnetNodes = struct {
+	sync.Mutex
+	m map[string]*tailnetNode
+}{m: make(map[string]*tailnetNode)}
+
+// tailnetNode is a userspace tailscale node dialing into its tailnet,
+// or through an exit node to anywhere
+type tailnetNode struct {
+	cfg Config
+	srv *tsnet.Server
+
+	mu    sync.Mutex // serializes bringing the node up
+	ready bool
+}
+
+// newTailscale returns the dial func of the node for cfg, starting one
+// if needed
+func newTailscale(cfg Config) (DialFunc, error) {
+	var exitNode netip.Addr
+	if cfg.ExitNode != "" {
+		var err error
+		if exitNode, err = netip.ParseAddr(cfg.ExitNode); err != nil {
+			return nil, fmt.Errorf("invalid exit node %q: %w", cfg.ExitNode, err)
+		}
+	}
+
+	tailnetNodes.Lock()
+	defer tailnetNodes.Unlock()
+	node := tailnetNodes.m[cfg.Name]
+	if node != nil && node.cfg != cfg {
+		log.Printf("[UPSTREAM] %s: settings changed, restarting the tailscale node", cfg.Name)
+		node.srv.Close()
+		node = nil
+	}
+	if node == nil {
+		node = &tailnetNode{cfg: cfg, srv: &tsnet.Server{
+			Dir:        cfg.StateDir,
+			Hostname:   cfg.Hostname,
+			AuthKey:    cfg.AuthKey,
+			ControlURL: cfg.ControlURL,
+			UserLogf: func(format string, args ...any) {
+				log.Printf("[UPSTREAM] "+cfg.Name+": "+format, args...)
+			},
+		}}
+		tailnetNodes.m[cfg.Name] = node
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return node.dial(ctx, exitNode, network, addr)
+	}, nil
+}
+
+func (n *tailnetNode) dial(ctx context.Context, exitNode netip.Addr, network, addr string) (net.Conn, error) {
+	if err := n.up(ctx, exitNode); err != nil {
+		return nil, proxyErrorf("tailscale upstream: %w", err)
+	}
+	conn, err := n.srv.Dial(ctx, network, addr)
+	if err == nil {
+		return conn, nil
+	}
+
+	// A node that dropped off the tailnet is the upstream's fault
+	if lc, lerr := n.srv.LocalClient(); lerr == nil {
+		if st, serr := lc.StatusWithoutPeers(ctx); serr == nil && st.BackendState != ipn.Running.String() {
+			return nil, proxyErrorf("tailscale upstream: node is %s: %w", st.BackendState, err)
+		}
+	}
+	return nil, fmt.Errorf("tailscale upstream: %w", err)
+}
+
+// up starts the node and selects the exit node once
+func (n *tailnetNode) up(ctx context.Context, exitNode netip.Addr) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ready {
+		return nil
+	}
+	if _, err := n.srv.Up(ctx); err != nil {
+		return err
+	}
+	if exitNode.IsValid() {
+		lc, err := n.srv.LocalClient()
+		if err != nil {
+			return err
+		}
+		_, err = lc.EditPrefs(ctx, &ipn.MaskedPrefs{
+			Prefs:         ipn.Prefs{ExitNodeIP: exitNode},
+			ExitNodeIPSet: true,
+		})
+		if err != nil {
+			return fmt.Errorf("set exit node %s: %w", exitNode, err)
+		}
+	}
+	log.Printf("[UPSTREAM] %s joined the tailnet", n.cfg.Name)
+	n.ready = true
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !tailscale
+
+package upstream
+
+import "errors"
+
+// TailscaleSupported reports whether the binary can join a tailnet
+const TailscaleSupported = false
+
+// errNoTailscale is returned for tailscale upstreams in builds without it
+var errNoTailscale = errors.New("built without tailscale support, rebuild with -tags tailscale")
+
+func newTailscale(Config) (DialFunc, error) {
+	return nil, errNoTailscale
+}
@@ -0,0 +1,291 @@
+// Package upstream routes outgoing connections through parent proxies.
+// An Upstream is the direct path, a SOCKS5 or HTTP CONNECT proxy, or a
+// userspace tailscale node (built with -tags tailscale); a Router picks
+// upstreams per destination and fails over between them based on health
+// checks.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DialFunc dials a network address
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Upstream types
+const (
+	TypeDirect    = "direct"
+	TypeSOCKS5    = "socks5"
+	TypeHTTP      = "http"
+	TypeTailscale = "tailscale"
+)
+
+// Direct is the name of the implicit direct upstream
+const Direct = "direct"
+
+// Config describes a parent proxy
+type Config struct {
+	Name     string
+	Type     string // socks5, http or tailscale
+	Address  string // host:port of the proxy, not used by tailscale
+	Username string
+	Password string
+
+	// Tailscale node settings. The node keeps its identity in StateDir,
+	// AuthKey is only needed to register it. With ExitNode, the tailnet IP
+	// of an exit node, destinations outside the tailnet are reachable too.
+	StateDir   string
+	Hostname   string
+	AuthKey    string
+	ControlURL string
+	ExitNode   string
+}
+
+// Upstream is a path to destinations: the direct one or a parent proxy
+type Upstream struct {
+	Name    string
+	Type    string
+	Address string
+
+	dial DialFunc
+
+	mu        sync.Mutex
+	healthy   bool
+	lastErr   string
+	rtt       time.Duration
+	checkedAt time.Time
+	targets   map[string]*targetHealth // by route health target
+}
+
+// targetHealth is the last health check of a route's own target
+type targetHealth struct {
+	healthy   bool
+	lastErr   string
+	rtt       time.Duration
+	checkedAt time.Time
+}
+
+// Status is the health of an upstream
+type Status struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Address   string    `json:"address,omitempty"`
+	Healthy   bool      `json:"healthy"`
+	LastError string    `json:"last_error,omitempty"`
+	RTTMs     float64   `json:"rtt_ms,omitempty"`
+	CheckedAt time.Time `json:"checked_at,omitzero"`
+	// Targets are the health checks of route health targets
+	Targets []TargetStatus `json:"targets,omitempty"`
+}
+
+// TargetStatus is the health of an upstream for a route health target
+type TargetStatus struct {
+	Target    string    `json:"target"`
+	Healthy   bool      `json:"healthy"`
+	LastError string    `json:"last_error,omitempty"`
+	RTTMs     float64   `json:"rtt_ms,omitempty"`
+	CheckedAt time.Time `json:"checked_at,omitzero"`
+}
+
+// NewDirect creates the direct upstream, which dials with dial
+func NewDirect(dial DialFunc) *Upstream {
+	return &Upstream{Name: Direct, Type: TypeDirect, dial: dial, healthy: true}
+}
+
+// New creates a parent proxy upstream. The proxy itself is reached with
+// forward.
+func New(cfg Config, forward DialFunc) (*Upstream, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("upstream has no name")
+	}
+	if cfg.Name == Direct {
+		return nil, fmt.Errorf("upstream name %q is reserved", Direct)
+	}
+	if cfg.Type == TypeTailscale {
+		dial, err := newTailscale(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", cfg.Name, err)
+		}
+		return &Upstream{Name: cfg.Name, Type: cfg.Type, Address: cfg.ExitNode, dial: dial, healthy: true}, nil
+	}
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		return nil, fmt.Errorf("upstream %s: invalid address %q: %w", cfg.Name, cfg.Address, err)
+	}
+
+	u := &Upstream{Name: cfg.Name, Type: cfg.Type, Address: cfg.Address, healthy: true}
+	forward = proxyDial(forward)
+
+	switch cfg.Type {
+	case TypeSOCKS5:
+		s := &socks5Connect{address: cfg.Address, username: cfg.Username, password: cfg.Password, forward: forward}
+		u.dial = s.DialContext
+	case TypeHTTP:
+		h := &httpConnect{address: cfg.Address, username: cfg.Username, password: cfg.Password, forward: forward}
+		u.dial = h.DialContext
+	default:
+		return nil, fmt.Errorf("upstream %s: %w", cfg.Name, UnknownTypeError(cfg.Type))
+	}
+	return u, nil
+}
+
+// UnknownTypeError is the error for an unsupported upstream type
+func UnknownTypeError(typ string) error {
+	if strings.EqualFold(typ, "wireguard") {
+		return fmt.Errorf("type %q is not supported, use a tailscale upstream or a socks5 one to a userspace WireGuard client", typ)
+	}
+	return fmt.Errorf("unknown type %q, expected socks5, http or tailscale", typ)
+}
+
+// DialContext dials addr through the upstream. Failing to reach the proxy
+// itself is the upstream's fault, unlike errors for the destination, so
+// it marks the upstream down at once.
+func (u *Upstream) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := u.dial(ctx, network, addr)
+	if err != nil && ctx.Err() == nil && isProxyError(err) {
+		u.setHealth(err, 0)
+	}
+	return conn, err
+}
+
+// Supports reports whether the upstream can carry network. Parent proxies
+// only relay TCP, a tailscale node carries UDP as well.
+func (u *Upstream) Supports(network string) bool {
+	if u.Type == TypeDirect || u.Type == TypeTailscale {
+		return true
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return true
+	}
+	return false
+}
+
+// Healthy reports the result of the last health check
+func (u *Upstream) Healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy
+}
+
+// HealthyFor reports whether the upstream is healthy and its last check
+// of a route health target succeeded. An empty or unchecked target only
+// takes the upstream itself into account.
+func (u *Upstream) HealthyFor(target string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if t := u.targets[target]; t != nil && !t.healthy {
+		return false
+	}
+	return u.healthy
+}
+
+// Status returns the current health of the upstream
+func (u *Upstream) Status() Status {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	st := Status{
+		Name:      u.Name,
+		Type:      u.Type,
+		Address:   u.Address,
+		Healthy:   u.healthy,
+		LastError: u.lastErr,
+		RTTMs:     float64(u.rtt.Microseconds()) / 1000,
+		CheckedAt: u.checkedAt,
+	}
+	for target, t := range u.targets {
+		st.Targets = append(st.Targets, TargetStatus{
+			Target:    target,
+			Healthy:   t.healthy,
+			LastError: t.lastErr,
+			RTTMs:     float64(t.rtt.Microseconds()) / 1000,
+			CheckedAt: t.checkedAt,
+		})
+	}
+	slices.SortFunc(st.Targets, func(a, b TargetStatus) int {
+		return strings.Compare(a.Target, b.Target)
+	})
+	return st
+}
+
+func (u *Upstream) setHealth(err error, rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch {
+	case err != nil && u.healthy:
+		log.Printf("[UPSTREAM] %s is down: %v", u.Name, err)
+	case err == nil && !u.healthy:
+		log.Printf("[UPSTREAM] %s is up again", u.Name)
+	}
+	u.healthy = err == nil
+	u.rtt = rtt
+	u.checkedAt = time.Now()
+	u.lastErr = ""
+	if err != nil {
+		u.lastErr = err.Error()
+	}
+}
+
+func (u *Upstream) setTargetHealth(target string, err error, rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.targets == nil {
+		u.targets = make(map[string]*targetHealth)
+	}
+	t := u.targets[target]
+	if t == nil {
+		t = &targetHealth{healthy: true}
+		u.targets[target] = t
+	}
+	switch {
+	case err != nil && t.healthy:
+		log.Printf("[UPSTREAM] %s is down for %s: %v", u.Name, target, err)
+	case err == nil && !t.healthy:
+		log.Printf("[UPSTREAM] %s is up again for %s", u.Name, target)
+	}
+	t.healthy = err == nil
+	t.rtt = rtt
+	t.checkedAt = time.Now()
+	t.lastErr = ""
+	if err != nil {
+		t.lastErr = err.Error()
+	}
+}
+
+// proxyDial marks errors dialing the proxy as proxy errors
+func proxyDial(forward DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := forward(ctx, network, addr)
+		if err != nil {
+			return nil, proxyErrorf("dial proxy: %w", err)
+		}
+		return conn, nil
+	}
+}
+
+// proxyError is a failure to reach or talk to the proxy itself, as
+// opposed to the proxy failing to reach the destination
+type proxyError struct {
+	err error
+}
+
+func proxyErrorf(format string, args ...any) error {
+	return &proxyError{err: fmt.Errorf(format, args...)}
+}
+
+func (e *proxyError) Error() string { return e.err.Error() }
+func (e *proxyError) Unwrap() error { return e.err }
+
+// isProxyError reports whether err came from reaching the proxy rather
+// than the destination
+func isProxyError(err error) bool {
+	var pe *proxyError
+	return errors.As(err, &pe)
+}
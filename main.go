@@ -2,31 +2,48 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
-	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
-	"github.com/c-robinson/iplib"
-	"golang.org/x/sys/unix"
-
 	"github.com/soaska/proxy/internal/socks5"
 
 	"github.com/soaska/proxy/internal/api"
+	"github.com/soaska/proxy/internal/auth"
+	"github.com/soaska/proxy/internal/bot"
 	"github.com/soaska/proxy/internal/database"
+	"github.com/soaska/proxy/internal/egress"
 	"github.com/soaska/proxy/internal/geoip"
+	"github.com/soaska/proxy/internal/httpproxy"
+	"github.com/soaska/proxy/internal/mtproto"
+	"github.com/soaska/proxy/internal/policy"
+	"github.com/soaska/proxy/internal/ratelimit"
+	"github.com/soaska/proxy/internal/resolver"
+	"github.com/soaska/proxy/internal/session"
 	"github.com/soaska/proxy/internal/speedtest"
 	"github.com/soaska/proxy/internal/stats"
+	"github.com/soaska/proxy/internal/telegram"
 )
 
-func main() {
+// serve runs the proxy until it is interrupted
+func serve() {
+	// Catch SIGHUP before anything else, its default action would kill
+	// the process. One that arrives during startup waits in the channel
+	// until the reloader runs.
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
 	// Load configuration
 	if err := loadConfig(); err != nil {
-		panic(err)
+		log.Fatalf("[CONFIG] %v", err)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -36,42 +53,114 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	// One resolver for the whitelist and destinations, so both see the
+	// same answers
+	dns, err := buildResolver(cfg)
+	if err != nil {
+		panic(err)
+	}
+
 	// Start whitelist update loop
-	go checkIPsLoop()
+	wl := policy.NewWhitelist()
+	whitelistReloaded := make(chan struct{}, 1)
+	go checkIPsLoop(wl, dns, whitelistReloaded)
+
+	deny, allow, err := buildRules(cfg, wl)
+	if err != nil {
+		panic(err)
+	}
+	engine := policy.NewEngine(dns, deny, allow)
 
 	// Initialize statistics if enabled
+	var db *sql.DB
 	var statsCollector *stats.StatsCollector
 	var geoipService *geoip.Service
 	var speedtestService *speedtest.Service
+	var userStore *auth.Store
 
-	if cfg.Stats.Enabled {
-		log.Println("[STATS] Initializing statistics collection...")
-
+	if cfg.Stats.Enabled || cfg.Auth.Enabled {
 		// Initialize database
-		db, err := database.InitDB(cfg.Stats.DatabasePath)
+		db, err = database.InitDB(cfg.Stats.DatabasePath)
 		if err != nil {
 			log.Printf("[STATS] Failed to initialize database: %v", err)
-		} else {
-			// Initialize GeoIP
-			geoipService, err = geoip.NewService(cfg.Stats.GeoIPPath)
-			if err != nil {
-				log.Printf("[STATS] Failed to initialize GeoIP: %v", err)
-				log.Printf("[STATS] Continuing without GeoIP support")
-			}
+		}
+	}
 
-			// Initialize stats collector
-			statsCollector = stats.NewStatsCollector(db, geoipService, cfg.Stats.RetentionDays)
+	if cfg.Stats.Enabled && db != nil {
+		log.Println("[STATS] Initializing statistics collection...")
+
+		// Initialize GeoIP
+		geoipService, err = geoip.NewService(cfg.Stats.GeoIPPath)
+		if err != nil {
+			log.Printf("[STATS] Failed to initialize GeoIP: %v", err)
+			log.Printf("[STATS] Continuing without GeoIP support")
+		}
+
+		// Initialize stats collector
+		statsCollector = stats.NewStatsCollector(db, geoipService, cfg.Stats.RetentionDays)
+
+		// Initialize traffic quotas
+		if cfg.Quotas.Enabled {
+			statsCollector.SetQuotaManager(stats.NewQuotaManager(db,
+				cfg.Quotas.PerUser.limits(), cfg.Quotas.PerClient.limits(), cfg.Quotas.FlushInterval))
+		}
+
+		// Initialize speedtest service
+		speedtestService = speedtest.NewService(db, geoipService)
+
+		log.Println("[STATS] Statistics collection initialized")
+	}
 
-			// Initialize speedtest service
-			speedtestService = speedtest.NewService(db, geoipService)
+	// Per-user authentication lives in the stats database
+	if cfg.Auth.Enabled {
+		if db == nil {
+			panic("auth is enabled but the database is not available")
+		}
+		userStore = auth.NewStore(db)
+		log.Println("[AUTH] Per-user authentication enabled")
+	}
 
-			log.Println("[STATS] Statistics collection initialized")
+	pool, err := newEgressPool(cfg)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("Egress addresses: %s (%s)", pool, cfg.Egress.Strategy)
+
+	// Direct dialing and parent proxies, with failover between them
+	router, err := buildRouter(cfg, pool)
+	if err != nil {
+		panic(err)
+	}
+	startHealthChecks := sync.OnceFunc(func() {
+		if hc := cfg.Upstream.HealthCheck; hc.Interval > 0 {
+			go router.RunHealthChecks(ctx, hc.Target, hc.Interval, hc.Timeout)
 		}
+	})
+	if len(cfg.Upstream.Proxies) > 0 {
+		log.Printf("[UPSTREAM] %d parent proxies, %d routes", len(cfg.Upstream.Proxies), len(cfg.Upstream.Routes))
+		startHealthChecks()
+	}
+
+	// Telegram DC table, optionally kept in sync with a file
+	dcs := telegram.NewDCMap()
+	if cfg.Telegram.DCFile != "" {
+		go dcFileLoop(dcs, cfg.Telegram.DCFile)
+	}
+
+	var dcProber *telegram.Prober
+	if statsCollector != nil && cfg.Telegram.ProbeInterval > 0 {
+		dcProber = telegram.NewProber(db, dcs, func(probeCtx context.Context, network, addr string) (net.Conn, error) {
+			return dialFromPool(probeCtx, pool, "", network, addr)
+		})
+		go dcProber.Run(ctx, cfg.Telegram.ProbeInterval)
 	}
 
 	// Start HTTP API server if enabled
+	var apiServer *api.Server
 	if cfg.API.Enabled && statsCollector != nil {
-		apiServer := api.NewServer(statsCollector, speedtestService, cfg.API.APIKey, cfg.API.CORSOrigins)
+		apiServer = api.NewServer(statsCollector, speedtestService, userStore, cfg.API.APIKey, cfg.API.CORSOrigins)
+		apiServer.SetTelegram(dcs, dcProber)
+		apiServer.SetUpstreams(router)
 		go func() {
 			if err := apiServer.Start(ctx, cfg.API.Listen); err != nil {
 				log.Printf("[API] Server error: %v", err)
@@ -79,108 +168,178 @@ func main() {
 		}()
 	}
 
-	// Setup SOCKS5 server
-	subnet := iplib.NewNet4(net.ParseIP(cfg.Subnet), cfg.SubnetMask)
+	// Telegram admin bot
+	var adminBot *bot.Bot
+	if cfg.Bot.Token != "" {
+		if statsCollector == nil {
+			log.Println("[BOT] The bot needs stats.enabled, not starting")
+		} else {
+			adminBot = bot.NewBot(cfg.Bot.Token, cfg.Bot.AdminIDs, statsCollector.Query(), speedtestService)
+			if cfg.Bot.APIURL != "" {
+				adminBot.SetAPIURL(cfg.Bot.APIURL)
+			}
+			go adminBot.Run(ctx)
+		}
+	}
+
+	// Swapped by config reloads
+	var limiter atomic.Pointer[ratelimit.Limiter]
+	if cfg.RateLimit.Enabled {
+		limiter.Store(ratelimit.New(cfg.RateLimit.limiterConfig()))
+		log.Println("[RATELIMIT] Bandwidth rate limiting enabled")
+	}
+
+	// wrapConn applies rate limits and stats tracking to an upstream connection
+	wrapConn := func(ctx context.Context, network string, conn net.Conn, clientIP, target string) net.Conn {
+		// Shape traffic, this covers UDP associations too since their
+		// target connections are dialed here as well
+		if l := limiter.Load(); l != nil {
+			conn = l.Wrap(conn, clientIP, session.Username(ctx))
+		}
+
+		// Track connection if stats enabled. UDP is tracked per target by
+		// the SOCKS5 server, see udpStats.
+		if statsCollector != nil && !strings.HasPrefix(network, "udp") {
+			tracker := statsCollector.TrackConnection(ctx, stats.ConnectionInfo{
+				ClientIP:   clientIP,
+				Username:   session.Username(ctx),
+				TargetAddr: target,
+				Protocol:   session.Protocol(ctx),
+				DCID:       dcs.Lookup(remoteIP(conn)),
+			})
+			if tracker != nil {
+				// Wrap connection with tracker, closing it finalizes the tracker
+				conn = tracker.WrapConnection(conn)
+			}
+		}
+		return conn
+	}
 
 	server := &socks5.Server{
 		Dialer: func(dialCtx context.Context, network, addr string) (net.Conn, error) {
-			host, _, err := net.SplitHostPort(addr)
+			host, portStr, err := net.SplitHostPort(addr)
 			if err != nil {
 				return nil, fmt.Errorf("failed to split host and port: %w", err)
 			}
-
-			ip, err := net.ResolveIPAddr("ip4", host)
+			port, err := strconv.ParseUint(portStr, 10, 16)
 			if err != nil {
-				return nil, fmt.Errorf("failed to resolve IP: %w", err)
+				return nil, fmt.Errorf("invalid port %q: %w", portStr, err)
 			}
 
-			// Check whitelist
-			wlMutex.RLock()
-			_, ok := whitelist[ip.String()]
-			wlMutex.RUnlock()
+			clientIP := sessionClientIP(dialCtx)
 
-			if !ok {
-				ok = isIPInRange(ip.IP)
+			// Check destination policy
+			decision := engine.Allow(dialCtx, clientIP, network, host, uint16(port))
+			if err := decision.Error(); err != nil {
+				return nil, err
 			}
 
-			if !ok {
-				for _, whost := range cfg.Whitelist {
-					if strings.EqualFold(host, whost) {
-						ok = true
-						break
-					}
+			// Check traffic quotas before spending a connection on it
+			if statsCollector != nil && statsCollector.Quotas() != nil {
+				if err := statsCollector.Quotas().Check(dialCtx, session.Username(dialCtx), clientIP); err != nil {
+					return nil, err
 				}
 			}
 
-			// Valid destination
-			if ok {
-				newAddr := subnet.RandomIP()
-				log.Println("Dialing", network, addr, "from", newAddr)
-
-				dialer := &net.Dialer{
-					Control: func(network, address string, c syscall.RawConn) error {
-						if runtime.GOOS != "linux" {
-							return nil
-						}
-						var operr error
-						if err := c.Control(func(fd uintptr) {
-							const IP_FREEBIND = 15
-							operr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, IP_FREEBIND, 1)
-						}); err != nil {
-							return err
-						}
-						return operr
-					},
-				}
+			req := policy.Request{
+				Client:  clientIP,
+				Network: "tcp",
+				Port:    uint16(port),
+			}
+			if strings.HasPrefix(network, "udp") {
+				req.Network = "udp"
+			}
+			if net.ParseIP(host) == nil {
+				req.Host = strings.TrimSuffix(strings.ToLower(host), ".")
+			}
 
-				// Set appropriate local address based on network type
-				if network == "tcp" || network == "tcp4" || network == "tcp6" {
-					dialer.LocalAddr = &net.TCPAddr{
-						IP: newAddr,
-					}
-					network = "tcp4"
-				} else if network == "udp" || network == "udp4" || network == "udp6" {
-					dialer.LocalAddr = &net.UDPAddr{
-						IP: newAddr,
-					}
-					network = "udp4"
-				}
+			// Dial the exact addresses that passed the policy, racing them
+			// happy eyeballs style. UDP has no handshake to race and takes
+			// one of the preferred family.
+			ips := destinationAddrs(decision.Addrs, pool)
+			if req.Network == "udp" {
+				ips = []net.IP{pickDestination(ips, pool.IsIPv6())}
+			}
+			conn, ip, err := resolver.DialParallel(dialCtx, ips, pool.IsIPv6(), func(attemptCtx context.Context, ip net.IP) (net.Conn, error) {
+				r := req
+				r.IP = ip
+				conn, _, err := router.Dial(attemptCtx, &r, req.Network+ipFamily(ip), net.JoinHostPort(ip.String(), portStr))
+				return conn, err
+			})
+			if err != nil {
+				log.Println("Failed to dial:", err)
+				return nil, err
+			}
+			network = req.Network + ipFamily(ip)
+			log.Println("Dialed", network, addr, "via", net.JoinHostPort(ip.String(), portStr), "from", conn.LocalAddr())
 
-				conn, err := dialer.DialContext(dialCtx, network, addr)
-				if err != nil {
-					log.Println("Failed to dial:", err)
-					return nil, err
-				}
+			return wrapConn(dialCtx, network, conn, clientIP, addr), nil
+		},
+		Listen: func(listenCtx context.Context, network, addr string) (net.Listener, error) {
+			host, portStr, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to split host and port: %w", err)
+			}
+			port, err := strconv.ParseUint(portStr, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q: %w", portStr, err)
+			}
 
-				// Track connection if stats enabled
-				if statsCollector != nil {
-					clientIP := socks5.ClientAddr(dialCtx)
-					if clientIP != "" {
-						if host, _, err := net.SplitHostPort(clientIP); err == nil {
-							clientIP = host
-						}
-					}
-					if clientIP == "" {
-						clientIP = "unknown"
-					}
-					tracker := statsCollector.TrackConnection(dialCtx, clientIP, addr)
-					if tracker != nil {
-						// Wrap connection with tracker
-						conn = tracker.WrapConnection(conn)
-						// Setup cleanup on connection close
-						go func() {
-							<-dialCtx.Done()
-							tracker.Close(context.Background())
-						}()
-					}
+			// The expected peer of a BIND is checked like a destination
+			clientIP := sessionClientIP(listenCtx)
+			decision := engine.Allow(listenCtx, clientIP, network, host, uint16(port))
+			if err := decision.Error(); err != nil {
+				return nil, err
+			}
+			if statsCollector != nil && statsCollector.Quotas() != nil {
+				if err := statsCollector.Quotas().Check(listenCtx, session.Username(listenCtx), clientIP); err != nil {
+					return nil, err
 				}
+			}
 
-				return conn, nil
+			ln, err := listenBind(listenCtx, pool, egressKey(listenCtx), pickDestination(decision.Addrs, pool.IsIPv6()))
+			if err != nil {
+				log.Println("Failed to listen:", err)
+				return nil, err
 			}
+			log.Println("Listening for", addr, "on", ln.Addr())
 
-			return nil, fmt.Errorf("ip %s is not in the whitelist", ip.IP.String())
+			return &bindListener{TCPListener: ln, peers: decision.Addrs, wrap: func(peer net.Conn) net.Conn {
+				return wrapConn(listenCtx, "tcp", peer, clientIP, peer.RemoteAddr().String())
+			}}, nil
 		},
 	}
+	if userStore != nil {
+		server.Authenticator = userStore
+	}
+
+	if statsCollector != nil {
+		server.UDPTracker = udpStats{statsCollector, dcs}
+	}
+
+	// Session timeouts
+	server.HandshakeTimeout = cfg.Timeouts.Handshake
+	server.IdleTimeout = cfg.Timeouts.Idle
+	server.MaxLifetime = cfg.Timeouts.MaxLifetime
+	server.UDPTargetTimeout = cfg.Timeouts.UDPTarget
+
+	// Connection limits, shared by all listeners
+	limits := &socks5.Limits{
+		MaxConns:       cfg.Limits.MaxConns,
+		MaxConnsPerIP:  cfg.Limits.MaxConnsPerIP,
+		ConnRatePerIP:  cfg.Limits.ConnRatePerIP,
+		ConnBurstPerIP: cfg.Limits.ConnBurstPerIP,
+	}
+	server.Limits = limits
+	if statsCollector != nil {
+		limits.OnReject = func(remoteAddr net.Addr, reason string) {
+			host, _, err := net.SplitHostPort(remoteAddr.String())
+			if err != nil {
+				host = remoteAddr.String()
+			}
+			statsCollector.RecordRejected(host, reason)
+		}
+	}
 
 	ln, err := net.Listen("tcp", cfg.Listen)
 	if err != nil {
@@ -197,11 +356,105 @@ func main() {
 		}
 	}()
 
+	// Optional HTTP CONNECT listener sharing the SOCKS5 dial path
+	var httpLn net.Listener
+	if cfg.HTTPProxy.Enabled {
+		httpServer := &httpproxy.Server{
+			Dialer:           server.Dialer,
+			Limits:           limits,
+			HandshakeTimeout: cfg.Timeouts.Handshake,
+			IdleTimeout:      cfg.Timeouts.Idle,
+			MaxLifetime:      cfg.Timeouts.MaxLifetime,
+		}
+		if userStore != nil {
+			httpServer.Authenticator = userStore
+		}
+
+		httpLn, err = net.Listen("tcp", cfg.HTTPProxy.Listen)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("HTTP CONNECT proxy server started on %s", httpLn.Addr().String())
+
+		go func() {
+			if err := httpServer.Serve(httpLn); err != nil {
+				log.Printf("HTTP proxy server error: %v", err)
+				cancel()
+			}
+		}()
+	}
+
+	// Optional MTProto listener, DCs are dialed like any other destination
+	var mtprotoLn net.Listener
+	if cfg.MTProto.Enabled {
+		secrets := make([]mtproto.Secret, 0, len(cfg.MTProto.Secrets))
+		for _, sc := range cfg.MTProto.Secrets {
+			secret, err := mtproto.ParseSecret(sc.Name, sc.Secret)
+			if err != nil {
+				panic(err)
+			}
+			secrets = append(secrets, secret)
+		}
+		mtprotoServer := &mtproto.Server{
+			Dialer:           server.Dialer,
+			Secrets:          secrets,
+			Domain:           cfg.MTProto.FakeTLSDomain,
+			FrontAddr:        cfg.MTProto.FrontAddr,
+			TimeSkew:         cfg.MTProto.TimeSkew,
+			DCs:              dcs,
+			PreferIPv6:       pool.IsIPv6(),
+			Limits:           limits,
+			HandshakeTimeout: cfg.Timeouts.Handshake,
+			IdleTimeout:      cfg.Timeouts.Idle,
+			MaxLifetime:      cfg.Timeouts.MaxLifetime,
+			// Probes are forwarded to the front site from the egress
+			// pool too, it is outside the whitelist
+			FrontDialer: func(frontCtx context.Context, network, addr string) (net.Conn, error) {
+				return dialHostFromPool(frontCtx, dns, pool, egressKey(frontCtx), network, addr)
+			},
+		}
+
+		mtprotoLn, err = net.Listen("tcp", cfg.MTProto.Listen)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("MTProto proxy server started on %s", mtprotoLn.Addr().String())
+		logMTProtoLinks(secrets, mtprotoLn.Addr())
+
+		go func() {
+			if err := mtprotoServer.Serve(mtprotoLn); err != nil {
+				log.Printf("MTProto server error: %v", err)
+				cancel()
+			}
+		}()
+	}
+
+	// Reload the config on SIGHUP and when the file changes
+	reloader := &reloader{
+		wl:                wl,
+		engine:            engine,
+		dns:               dns,
+		pool:              pool,
+		router:            router,
+		limiter:           &limiter,
+		api:               apiServer,
+		bot:               adminBot,
+		reloaded:          whitelistReloaded,
+		startHealthChecks: startHealthChecks,
+	}
+	go reloader.watch(hupChan)
+
 	// Wait for shutdown signal
 	<-sigChan
 	log.Println("Shutting down gracefully...")
 	cancel()
 	ln.Close()
+	if httpLn != nil {
+		httpLn.Close()
+	}
+	if mtprotoLn != nil {
+		mtprotoLn.Close()
+	}
 
 	// Close stats collector if initialized
 	if statsCollector != nil {
@@ -210,3 +463,95 @@ func main() {
 
 	log.Println("Shutdown complete")
 }
+
+// udpStats tracks UDP association traffic per target
+type udpStats struct {
+	collector *stats.StatsCollector
+	dcs       *telegram.DCMap
+}
+
+func (u udpStats) TrackUDP(ctx context.Context, target string, conn net.Conn) socks5.UDPFlow {
+	tracker := u.collector.TrackConnection(ctx, stats.ConnectionInfo{
+		ClientIP:   sessionClientIP(ctx),
+		Username:   session.Username(ctx),
+		TargetAddr: target,
+		Protocol:   session.Protocol(ctx),
+		DCID:       u.dcs.Lookup(remoteIP(conn)),
+	})
+	if tracker == nil {
+		return nil
+	}
+	// Lets quotas cut the flow
+	tracker.Attach(conn)
+	return tracker
+}
+
+// logMTProtoLinks prints a tg://proxy link per secret
+func logMTProtoLinks(secrets []mtproto.Secret, addr net.Addr) {
+	port := addr.(*net.TCPAddr).Port
+	host := cfg.MTProto.PublicHost
+	if host == "" {
+		log.Println("[MTPROTO] Set mtproto.public_host to get tg://proxy links")
+		for _, s := range secrets {
+			log.Printf("[MTPROTO] Secret %s: %s", s.Name, s.ClientSecret(cfg.MTProto.FakeTLSDomain))
+		}
+		return
+	}
+	for _, s := range secrets {
+		log.Printf("[MTPROTO] Link for %s: %s", s.Name, s.Link(host, port, cfg.MTProto.FakeTLSDomain))
+	}
+}
+
+// sessionClientIP returns the IP of the proxy client from ctx
+func sessionClientIP(ctx context.Context) string {
+	clientIP := session.ClientAddr(ctx)
+	if clientIP != "" {
+		if host, _, err := net.SplitHostPort(clientIP); err == nil {
+			clientIP = host
+		}
+	}
+	if clientIP == "" {
+		clientIP = "unknown"
+	}
+	return clientIP
+}
+
+// destinationAddrs returns the addresses of ips in the families of the
+// egress pool. Without a matching family the kernel picks the source
+// address and every address is used.
+func destinationAddrs(ips []net.IP, pool *egress.Pool) []net.IP {
+	var matching []net.IP
+	for _, ip := range ips {
+		if pool.Has(ip.To4() == nil) {
+			matching = append(matching, ip)
+		}
+	}
+	if len(matching) == 0 {
+		matching = ips
+	}
+	return matching
+}
+
+// ipFamily returns the suffix of network names for ip
+func ipFamily(ip net.IP) string {
+	if ip.To4() == nil {
+		return "6"
+	}
+	return "4"
+}
+
+// pickDestination returns the first address of the preferred family,
+// falling back to the first IPv4 address and then to anything at all.
+func pickDestination(ips []net.IP, preferIPv6 bool) net.IP {
+	for _, ip := range ips {
+		if (ip.To4() == nil) == preferIPv6 {
+			return ip
+		}
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip
+		}
+	}
+	return ips[0]
+}
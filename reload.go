@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/soaska/proxy/internal/api"
+	"github.com/soaska/proxy/internal/bot"
+	"github.com/soaska/proxy/internal/egress"
+	"github.com/soaska/proxy/internal/policy"
+	"github.com/soaska/proxy/internal/ratelimit"
+	"github.com/soaska/proxy/internal/resolver"
+	"github.com/soaska/proxy/internal/upstream"
+)
+
+// configWatchInterval is how often the config file is checked for changes
+const configWatchInterval = 5 * time.Second
+
+// reloadable lists the settings applied by a reload, as yaml paths or
+// their prefixes. Changing anything else needs a restart.
+var reloadable = []string{
+	"whitelist",
+	"refresh_interval",
+	"resolved_ttl",
+	"subnet",
+	"subnet_mask",
+	"dns",
+	"egress",
+	"policy",
+	"upstream.proxies",
+	"upstream.routes",
+	"upstream.default",
+	"rate_limit",
+	"api.api_key",
+	"api.cors_origins",
+	"bot.admin_ids",
+}
+
+// secretKeys are yaml keys whose values are never logged
+var secretKeys = map[string]bool{
+	"api_key":  true,
+	"auth_key": true,
+	"password": true,
+	"secret":   true,
+	"secrets":  true,
+	"token":    true,
+}
+
+// reloader applies changes of the config file without a restart.
+// Listeners and open connections are left alone.
+type reloader struct {
+	wl       *policy.Whitelist
+	engine   *policy.Engine
+	dns      *resolver.Mux
+	pool     *egress.Pool
+	router   *upstream.Router
+	limiter  *atomic.Pointer[ratelimit.Limiter]
+	api      *api.Server // nil without the API
+	bot      *bot.Bot    // nil without the bot
+	reloaded chan<- struct{}
+
+	// startHealthChecks starts the upstream health checks once there
+	// are parent proxies
+	startHealthChecks func()
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// watch reloads the config on SIGHUP and whenever the file changes
+func (r *reloader) watch(hup <-chan os.Signal) {
+	r.fileChanged()
+
+	ticker := time.NewTicker(configWatchInterval)
+	for {
+		select {
+		case <-hup:
+			r.reload("SIGHUP")
+		case <-ticker.C:
+			if r.fileChanged() {
+				r.reload("file change")
+			}
+		}
+	}
+}
+
+func (r *reloader) fileChanged() bool {
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if info.ModTime().Equal(r.modTime) {
+		return false
+	}
+	r.modTime = info.ModTime()
+	return true
+}
+
+// reload reads the config and applies it. Everything is built before
+// anything is applied, so a broken config changes nothing.
+func (r *reloader) reload(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := currentConfig()
+	c, err := readConfig(configPath)
+	if err != nil {
+		log.Printf("[CONFIG] Reload on %s failed, keeping the current config: %v", reason, err)
+		return
+	}
+	changes := diffConfig(old, c)
+	if len(changes) == 0 {
+		log.Printf("[CONFIG] Reload on %s: no changes", reason)
+		return
+	}
+
+	sectionChanged := func(fields ...string) bool {
+		for _, change := range changes {
+			for _, f := range fields {
+				if change == f || strings.HasPrefix(change, f+".") || strings.HasPrefix(change, f+":") {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	deny, allow, err := buildRules(c, r.wl)
+	if err != nil {
+		log.Printf("[CONFIG] Reload on %s failed, keeping the current config: %v", reason, err)
+		return
+	}
+	var pool *egress.Pool
+	if sectionChanged("subnet", "subnet_mask", "egress") {
+		if pool, err = newEgressPool(c); err != nil {
+			log.Printf("[CONFIG] Reload on %s failed, keeping the current config: %v", reason, err)
+			return
+		}
+	}
+	var router *upstream.Router
+	if sectionChanged("upstream") {
+		// The new router dials through r.pool, which is updated in place
+		if router, err = buildRouter(c, r.pool); err != nil {
+			log.Printf("[CONFIG] Reload on %s failed, keeping the current config: %v", reason, err)
+			return
+		}
+	}
+	var dns *resolver.Mux
+	if sectionChanged("dns") {
+		if dns, err = buildResolver(c); err != nil {
+			log.Printf("[CONFIG] Reload on %s failed, keeping the current config: %v", reason, err)
+			return
+		}
+	}
+
+	for _, change := range changes {
+		if isReloadable(change) {
+			log.Printf("[CONFIG] %s", change)
+		} else {
+			log.Printf("[CONFIG] %s (needs a restart)", change)
+		}
+	}
+
+	liveConfig.Store(c)
+	r.engine.SetRules(deny, allow)
+	if pool != nil {
+		r.pool.Update(pool)
+	}
+	if router != nil {
+		r.router.Update(router)
+		if len(c.Upstream.Proxies) > 0 {
+			r.startHealthChecks()
+		}
+	}
+	if dns != nil {
+		r.dns.Update(dns)
+	}
+	if sectionChanged("rate_limit") {
+		switch l := r.limiter.Load(); {
+		case !c.RateLimit.Enabled:
+			r.limiter.Store(nil)
+		case l != nil:
+			l.SetConfig(c.RateLimit.limiterConfig())
+		default:
+			r.limiter.Store(ratelimit.New(c.RateLimit.limiterConfig()))
+		}
+	}
+	if r.api != nil {
+		r.api.SetAccess(c.API.APIKey, c.API.CORSOrigins)
+	}
+	if r.bot != nil {
+		r.bot.SetAdmins(c.Bot.AdminIDs)
+	}
+
+	// Refresh the whitelist right away rather than on the next tick
+	select {
+	case r.reloaded <- struct{}{}:
+	default:
+	}
+	log.Printf("[CONFIG] Reloaded on %s", reason)
+}
+
+func isReloadable(change string) bool {
+	for _, prefix := range reloadable {
+		if strings.HasPrefix(change, prefix+":") || strings.HasPrefix(change, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// diffConfig lists the settings that differ between old and c as
+// "path: old -> new". Secrets are not printed, and lists of sections
+// only by their length.
+func diffConfig(old, c *config) []string {
+	var changes []string
+	diffValue("", reflect.ValueOf(*old), reflect.ValueOf(*c), &changes)
+	return changes
+}
+
+func diffValue(path string, a, b reflect.Value, changes *[]string) {
+	if a.Kind() == reflect.Struct {
+		t := a.Type()
+		for i := range t.NumField() {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+			p := path
+			switch {
+			case name == "-":
+				continue
+			case name != "" && path != "":
+				p = path + "." + name
+			case name != "":
+				p = name
+			}
+			diffValue(p, a.Field(i), b.Field(i), changes)
+		}
+		return
+	}
+	if reflect.DeepEqual(a.Interface(), b.Interface()) {
+		return
+	}
+
+	key := path[strings.LastIndex(path, ".")+1:]
+	switch {
+	case secretKeys[key]:
+		*changes = append(*changes, path+": changed")
+	case a.Kind() == reflect.Slice && a.Type().Elem().Kind() == reflect.Struct:
+		*changes = append(*changes, fmt.Sprintf("%s: changed, %d -> %d entries", path, a.Len(), b.Len()))
+	default:
+		*changes = append(*changes, fmt.Sprintf("%s: %v -> %v", path, a.Interface(), b.Interface()))
+	}
+}
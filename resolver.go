@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/soaska/proxy/internal/policy"
+	"github.com/soaska/proxy/internal/resolver"
+)
+
+// buildResolver creates the resolver of the dns config section, with a
+// separate resolver and cache for every rule
+func buildResolver(c *config) (*resolver.Mux, error) {
+	newResolver := func(servers []string) (*resolver.Resolver, error) {
+		var parsed []resolver.Server
+		for _, s := range servers {
+			server, err := resolver.ParseServer(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			parsed = append(parsed, server)
+		}
+		return resolver.New(resolver.Config{
+			Servers:   parsed,
+			CacheSize: c.DNS.CacheSize,
+			MinTTL:    c.DNS.MinTTL,
+			MaxTTL:    c.DNS.MaxTTL,
+		}), nil
+	}
+
+	fallback, err := newResolver(c.DNS.Servers)
+	if err != nil {
+		return nil, fmt.Errorf("dns.servers: %w", err)
+	}
+
+	var routes []resolver.Route
+	for i, rc := range c.DNS.Rules {
+		if len(rc.Hosts) == 0 || len(rc.Servers) == 0 {
+			return nil, fmt.Errorf("dns.rules[%d]: hosts and servers are required", i)
+		}
+		r, err := newResolver(rc.Servers)
+		if err != nil {
+			return nil, fmt.Errorf("dns.rules[%d]: %w", i, err)
+		}
+		routes = append(routes, resolver.Route{Rule: policy.Host(rc.Hosts...), Resolver: r})
+	}
+	return resolver.NewMux(fallback, routes), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/soaska/proxy/internal/policy"
+)
+
+// buildRules compiles the policy config section. The whitelist rule is
+// always the first allow rule.
+func buildRules(c *config, wl *policy.Whitelist) (deny, allow []policy.Rule, err error) {
+	for i, rc := range c.Policy.Deny {
+		rule, err := compileRule(rc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("policy.deny[%d]: %w", i, err)
+		}
+		deny = append(deny, rule)
+	}
+
+	allow = append(allow, wl)
+	for i, rc := range c.Policy.Allow {
+		rule, err := compileRule(rc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("policy.allow[%d]: %w", i, err)
+		}
+		allow = append(allow, rule)
+	}
+
+	return deny, allow, nil
+}
+
+func compileRule(rc RuleConfig) (policy.Rule, error) {
+	var parts []policy.Rule
+
+	var dest []policy.Rule
+	if len(rc.Hosts) > 0 {
+		dest = append(dest, policy.Host(rc.Hosts...))
+	}
+	if len(rc.CIDRs) > 0 {
+		cidr, err := policy.ParseCIDR(rc.CIDRs...)
+		if err != nil {
+			return nil, err
+		}
+		dest = append(dest, cidr)
+	}
+	if len(dest) > 0 {
+		parts = append(parts, policy.Any(dest...))
+	}
+
+	if len(rc.Ports) > 0 {
+		ranges := make([]policy.PortRange, 0, len(rc.Ports))
+		for _, p := range rc.Ports {
+			r, err := policy.ParsePortRange(p)
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, r)
+		}
+		parts = append(parts, policy.Ports(ranges...))
+	}
+
+	if len(rc.Networks) > 0 {
+		for _, n := range rc.Networks {
+			if n != "tcp" && n != "udp" {
+				return nil, fmt.Errorf("invalid network %q, expected tcp or udp", n)
+			}
+		}
+		parts = append(parts, policy.Network(rc.Networks...))
+	}
+
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("rule has no conditions")
+	}
+
+	return policy.All(parts...), nil
+}
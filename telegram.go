@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/soaska/proxy/internal/telegram"
+)
+
+// dcFileLoop loads the DC table from path and reloads it whenever the
+// file changes. A broken file keeps the previous table.
+func dcFileLoop(dcs *telegram.DCMap, path string) {
+	var loaded time.Time
+	check := func() {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("[DC] Failed to stat DC file: %v", err)
+			return
+		}
+		if !info.ModTime().After(loaded) {
+			return
+		}
+		loaded = info.ModTime()
+
+		if err := dcs.Load(path); err != nil {
+			log.Printf("[DC] Failed to load DC file, keeping the previous table: %v", err)
+			return
+		}
+		log.Printf("[DC] Loaded %d DCs from %s", len(dcs.DCs()), path)
+	}
+
+	check()
+	ticker := time.NewTicker(cfg.UpdateInterval)
+	for range ticker.C {
+		check()
+	}
+}
+
+// remoteIP returns the IP of the remote end of conn, or nil
+func remoteIP(conn net.Conn) net.IP {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/soaska/proxy/internal/egress"
+	"github.com/soaska/proxy/internal/upstream"
+)
+
+// buildRouter creates the upstream router from the upstream config
+// section. Direct connections and connections to parent proxies leave
+// from the egress pool.
+func buildRouter(c *config, pool *egress.Pool) (*upstream.Router, error) {
+	direct := upstream.NewDirect(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialFromPool(ctx, pool, egressKey(ctx), network, addr)
+	})
+	forward := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialFromPool(ctx, pool, "", network, addr)
+	}
+
+	upstreams := []*upstream.Upstream{direct}
+	for i, pc := range c.Upstream.Proxies {
+		u, err := upstream.New(upstream.Config{
+			Name:     pc.Name,
+			Type:     pc.Type,
+			Address:  pc.Address,
+			Username: pc.Username,
+			Password: pc.Password,
+
+			StateDir:   pc.StateDir,
+			Hostname:   pc.Hostname,
+			AuthKey:    pc.AuthKey,
+			ControlURL: pc.ControlURL,
+			ExitNode:   pc.ExitNode,
+		}, forward)
+		if err != nil {
+			return nil, fmt.Errorf("upstream.proxies[%d]: %w", i, err)
+		}
+		upstreams = append(upstreams, u)
+	}
+
+	var routes []upstream.Route
+	for i, rc := range c.Upstream.Routes {
+		rule, err := compileRule(rc.RuleConfig)
+		if err != nil {
+			return nil, fmt.Errorf("upstream.routes[%d]: %w", i, err)
+		}
+		routes = append(routes, upstream.Route{Rule: rule, Via: rc.Via, HealthTarget: rc.HealthTarget})
+	}
+
+	router := upstream.NewRouter(direct)
+	if err := router.Set(upstreams, routes, c.Upstream.Default); err != nil {
+		return nil, fmt.Errorf("upstream: %w", err)
+	}
+	return router, nil
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/soaska/proxy/internal/egress"
+	"github.com/soaska/proxy/internal/mtproto"
+	"github.com/soaska/proxy/internal/policy"
+	"github.com/soaska/proxy/internal/resolver"
+	"github.com/soaska/proxy/internal/upstream"
+)
+
+// configError is an invalid setting
+type configError struct {
+	// Path is the yaml path of the setting, e.g. upstream.routes[1].via[0]
+	Path string
+	Msg  string
+	// Where the value came from: a line of the config file or an
+	// environment variable, both empty for defaults
+	File string
+	Line int
+	Env  string
+}
+
+func (e configError) String() string {
+	switch {
+	case e.Env != "":
+		return fmt.Sprintf("%s (from %s): %s", e.Path, e.Env, e.Msg)
+	case e.Line > 0:
+		return fmt.Sprintf("%s:%d: %s: %s", e.File, e.Line, e.Path, e.Msg)
+	}
+	return e.Path + ": " + e.Msg
+}
+
+// configErrors lists every invalid setting of a config
+type configErrors []configError
+
+func (errs configErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, e := range errs {
+		lines[i] = "  " + e.String()
+	}
+	return "invalid config:\n" + strings.Join(lines, "\n")
+}
+
+// locate fills in where each invalid value came from. root is the parsed
+// config file, nil without one, and sources maps yaml paths set from the
+// environment to the variable names.
+func (errs configErrors) locate(file string, root *yaml.Node, sources map[string]string) {
+	for i := range errs {
+		for p := errs[i].Path; p != ""; p = parentPath(p) {
+			if name, ok := sources[p]; ok {
+				errs[i].Env = name
+				break
+			}
+		}
+		if errs[i].Env == "" && root != nil {
+			errs[i].File = file
+			errs[i].Line = nodeLine(root, errs[i].Path)
+		}
+	}
+}
+
+// parentPath strips the last key or index from a yaml path
+func parentPath(p string) string {
+	i := strings.LastIndexAny(p, ".[")
+	if i < 0 {
+		return ""
+	}
+	return p[:i]
+}
+
+// nodeLine returns the line of the value at path in a yaml document, or
+// of its closest ancestor present in the document. It is 0 if none is.
+func nodeLine(root *yaml.Node, path string) int {
+	n := root
+	if n.Kind == yaml.DocumentNode {
+		if len(n.Content) == 0 {
+			return 0
+		}
+		n = n.Content[0]
+	}
+
+	line := 0
+	for part := range strings.SplitSeq(strings.ReplaceAll(path, "[", ".["), ".") {
+		var next *yaml.Node
+		switch {
+		case n.Kind == yaml.SequenceNode && strings.HasPrefix(part, "["):
+			i, err := strconv.Atoi(strings.Trim(part, "[]"))
+			if err == nil && i >= 0 && i < len(n.Content) {
+				next = n.Content[i]
+			}
+		case n.Kind == yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == part {
+					next = n.Content[i+1]
+					break
+				}
+			}
+		}
+		if next == nil {
+			break
+		}
+		n = next
+		line = n.Line
+	}
+	return line
+}
+
+// unknownKeys reports the keys of a yaml mapping that no field of t
+// reads, recursing into sections and lists of sections
+func unknownKeys(n *yaml.Node, t reflect.Type, path string, errs *configErrors) {
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch {
+	case n.Kind == yaml.DocumentNode:
+		for _, child := range n.Content {
+			unknownKeys(child, t, path, errs)
+		}
+	case n.Kind == yaml.AliasNode:
+		unknownKeys(n.Alias, t, path, errs)
+	case n.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for i, child := range n.Content {
+			unknownKeys(child, t.Elem(), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			unknownKeys(n.Content[i+1], t.Elem(), join(n.Content[i].Value), errs)
+		}
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			ft, ok := fields[key.Value]
+			if !ok {
+				*errs = append(*errs, configError{Path: join(key.Value), Msg: "unknown key", Line: key.Line})
+				continue
+			}
+			unknownKeys(n.Content[i+1], ft, join(key.Value), errs)
+		}
+	}
+}
+
+// yamlFields maps the yaml keys of struct t, including inlined ones, to
+// their types
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		switch {
+		case name == "-" || !f.IsExported():
+			continue
+		case opts == "inline":
+			maps.Copy(fields, yamlFields(f.Type))
+			continue
+		case name == "":
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// typeErrors turns the errors of decoding a yaml document into a value
+// of the wrong type into configErrors with the path of each value
+func typeErrors(root *yaml.Node, err *yaml.TypeError) configErrors {
+	var errs configErrors
+	for _, msg := range err.Errors {
+		var line int
+		if _, scanErr := fmt.Sscanf(msg, "line %d:", &line); scanErr != nil {
+			errs = append(errs, configError{Path: "?", Msg: msg})
+			continue
+		}
+		_, msg, _ = strings.Cut(msg, ": ")
+		errs = append(errs, configError{Path: pathAtLine(root, "", line), Msg: msg, Line: line})
+	}
+	return errs
+}
+
+// pathAtLine returns the path of the scalar or flow style value on line
+// in a yaml tree
+func pathAtLine(n *yaml.Node, path string, line int) string {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, child := range n.Content {
+			if p := pathAtLine(child, path, line); p != "" {
+				return p
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			p := n.Content[i].Value
+			if path != "" {
+				p = path + "." + p
+			}
+			value := n.Content[i+1]
+			if value.Line == line && value.Style&yaml.FlowStyle != 0 {
+				return p
+			}
+			if p := pathAtLine(value, p, line); p != "" {
+				return p
+			}
+		}
+	case yaml.SequenceNode:
+		for i, child := range n.Content {
+			if p := pathAtLine(child, fmt.Sprintf("%s[%d]", path, i), line); p != "" {
+				return p
+			}
+		}
+	case yaml.ScalarNode:
+		if n.Line == line {
+			return path
+		}
+	}
+	return ""
+}
+
+// validator collects the invalid settings of a config
+type validator struct {
+	errs configErrors
+}
+
+func (v *validator) addf(path, format string, args ...any) {
+	v.errs = append(v.errs, configError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) listen(path, addr string) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.addf(path, "invalid listen address %q: %v", addr, err)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		v.addf(path, "invalid port %q", port)
+	}
+}
+
+func (v *validator) hostPort(path, addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.addf(path, "invalid address %q: %v", addr, err)
+		return
+	}
+	if host == "" {
+		v.addf(path, "address %q has no host", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		v.addf(path, "invalid port %q", port)
+	}
+}
+
+func (v *validator) nonNegative(path string, d time.Duration) {
+	if d < 0 {
+		v.addf(path, "must not be negative")
+	}
+}
+
+func (v *validator) positive(path string, d time.Duration) {
+	if d <= 0 {
+		v.addf(path, "must be positive")
+	}
+}
+
+func (v *validator) rule(path string, rc RuleConfig) {
+	if len(rc.Hosts)+len(rc.CIDRs)+len(rc.Ports)+len(rc.Networks) == 0 {
+		v.addf(path, "rule has no conditions")
+	}
+	for i, h := range rc.Hosts {
+		if strings.TrimSpace(h) == "" {
+			v.addf(fmt.Sprintf("%s.hosts[%d]", path, i), "empty host")
+		}
+	}
+	for i, c := range rc.CIDRs {
+		if _, err := policy.ParseCIDR(c); err != nil {
+			v.addf(fmt.Sprintf("%s.cidrs[%d]", path, i), "%v", err)
+		}
+	}
+	for i, p := range rc.Ports {
+		if _, err := policy.ParsePortRange(p); err != nil {
+			v.addf(fmt.Sprintf("%s.ports[%d]", path, i), "%v", err)
+		}
+	}
+	for i, n := range rc.Networks {
+		if n != "tcp" && n != "udp" {
+			v.addf(fmt.Sprintf("%s.networks[%d]", path, i), "invalid network %q, expected tcp or udp", n)
+		}
+	}
+}
+
+// validate checks every setting of c and returns all problems at once
+func (c *config) validate() configErrors {
+	v := &validator{}
+
+	v.listen("listen", c.Listen)
+	for i, entry := range c.Whitelist {
+		path := fmt.Sprintf("whitelist[%d]", i)
+		switch {
+		case strings.TrimSpace(entry) == "":
+			v.addf(path, "empty entry")
+		case strings.Contains(entry, "/"):
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				v.addf(path, "invalid CIDR %q", entry)
+			}
+		}
+	}
+	v.positive("refresh_interval", c.UpdateInterval)
+	v.nonNegative("resolved_ttl", c.ResolvedTTL)
+
+	// Egress addresses
+	if len(c.Egress.Addresses) == 0 {
+		ip := net.ParseIP(c.Subnet)
+		switch {
+		case c.Subnet == "":
+			v.addf("subnet", "required unless egress.addresses is set")
+		case ip == nil:
+			v.addf("subnet", "invalid address %q", c.Subnet)
+		default:
+			maxLen := 32
+			if ip.To4() == nil {
+				maxLen = 128
+			}
+			if c.SubnetMask <= 0 || c.SubnetMask > maxLen {
+				v.addf("subnet_mask", "must be between 1 and %d for %s", maxLen, c.Subnet)
+			}
+		}
+	}
+	for i, entry := range c.Egress.Addresses {
+		entry = strings.TrimSpace(entry)
+		if net.ParseIP(entry) != nil {
+			continue
+		}
+		path := fmt.Sprintf("egress.addresses[%d]", i)
+		if strings.Contains(entry, "/") {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				v.addf(path, "invalid subnet %q", entry)
+			}
+			continue
+		}
+		if _, err := net.InterfaceByName(entry); err != nil {
+			v.addf(path, "%q is neither an address, a subnet nor an interface of this host", entry)
+		}
+	}
+	if _, err := egress.ParseStrategy(c.Egress.Strategy); err != nil {
+		v.addf("egress.strategy", "%v", err)
+	}
+	v.nonNegative("egress.sticky_ttl", c.Egress.StickyTTL)
+	switch c.Egress.StickyKey {
+	case "", "client_ip", "username":
+	default:
+		v.addf("egress.sticky_key", "unknown sticky key %q, expected client_ip or username", c.Egress.StickyKey)
+	}
+
+	// DNS
+	for i, s := range c.DNS.Servers {
+		if _, err := resolver.ParseServer(strings.TrimSpace(s)); err != nil {
+			v.addf(fmt.Sprintf("dns.servers[%d]", i), "%v", err)
+		}
+	}
+	v.nonNegative("dns.min_ttl", c.DNS.MinTTL)
+	v.nonNegative("dns.max_ttl", c.DNS.MaxTTL)
+	if c.DNS.MaxTTL > 0 && c.DNS.MinTTL > c.DNS.MaxTTL {
+		v.addf("dns.min_ttl", "is above max_ttl")
+	}
+	for i, rule := range c.DNS.Rules {
+		path := fmt.Sprintf("dns.rules[%d]", i)
+		if len(rule.Hosts) == 0 {
+			v.addf(path+".hosts", "must not be empty")
+		}
+		if len(rule.Servers) == 0 {
+			v.addf(path+".servers", "must not be empty")
+		}
+		for j, s := range rule.Servers {
+			if _, err := resolver.ParseServer(strings.TrimSpace(s)); err != nil {
+				v.addf(fmt.Sprintf("%s.servers[%d]", path, j), "%v", err)
+			}
+		}
+	}
+
+	// Upstreams
+	names := map[string]bool{upstream.Direct: true}
+	for i, pc := range c.Upstream.Proxies {
+		path := fmt.Sprintf("upstream.proxies[%d]", i)
+		switch {
+		case pc.Name == "":
+			v.addf(path+".name", "must not be empty")
+		case names[pc.Name]:
+			v.addf(path+".name", "duplicate upstream %q", pc.Name)
+		}
+		names[pc.Name] = true
+		switch pc.Type {
+		case upstream.TypeSOCKS5, upstream.TypeHTTP:
+			v.hostPort(path+".address", pc.Address)
+		case upstream.TypeTailscale:
+			if !upstream.TailscaleSupported {
+				v.addf(path+".type", "this binary is built without tailscale support, rebuild it with -tags tailscale")
+			}
+			// Every node needs its own state, or they would share an identity
+			if pc.StateDir == "" {
+				v.addf(path+".state_dir", "must not be empty")
+			}
+			if pc.ExitNode != "" {
+				if _, err := netip.ParseAddr(pc.ExitNode); err != nil {
+					v.addf(path+".exit_node", "must be the tailnet IP of the exit node: %v", err)
+				}
+			}
+		default:
+			v.addf(path+".type", "%v", upstream.UnknownTypeError(pc.Type))
+		}
+	}
+	via := func(path string, list []string) {
+		for i, name := range list {
+			if !names[name] {
+				v.addf(fmt.Sprintf("%s[%d]", path, i), "unknown upstream %q", name)
+			}
+		}
+	}
+	for i, rc := range c.Upstream.Routes {
+		path := fmt.Sprintf("upstream.routes[%d]", i)
+		v.rule(path, rc.RuleConfig)
+		if len(rc.Via) == 0 {
+			v.addf(path+".via", "must not be empty")
+		}
+		via(path+".via", rc.Via)
+		if rc.HealthTarget != "" {
+			v.hostPort(path+".health_target", rc.HealthTarget)
+		}
+	}
+	via("upstream.default", c.Upstream.Default)
+	if hc := c.Upstream.HealthCheck; len(c.Upstream.Proxies) > 0 && hc.Interval > 0 {
+		v.hostPort("upstream.health_check.target", hc.Target)
+		v.positive("upstream.health_check.timeout", hc.Timeout)
+	}
+	v.nonNegative("upstream.health_check.interval", c.Upstream.HealthCheck.Interval)
+
+	// Listeners
+	if c.HTTPProxy.Enabled {
+		v.listen("http_proxy.listen", c.HTTPProxy.Listen)
+	}
+	if c.MTProto.Enabled {
+		v.listen("mtproto.listen", c.MTProto.Listen)
+		if len(c.MTProto.Secrets) == 0 {
+			v.addf("mtproto.secrets", "at least one secret is required")
+		}
+		seen := map[string]bool{}
+		for i, sc := range c.MTProto.Secrets {
+			path := fmt.Sprintf("mtproto.secrets[%d]", i)
+			if seen[sc.Name] {
+				v.addf(path+".name", "duplicate name %q", sc.Name)
+			}
+			seen[sc.Name] = true
+			if _, err := mtproto.ParseSecret(sc.Name, sc.Secret); err != nil {
+				v.addf(path+".secret", "%v", err)
+			}
+		}
+		if c.MTProto.FrontAddr != "" {
+			v.hostPort("mtproto.front_addr", c.MTProto.FrontAddr)
+		}
+		v.nonNegative("mtproto.time_skew", c.MTProto.TimeSkew)
+	}
+	if c.API.Enabled {
+		v.listen("api.listen", c.API.Listen)
+	}
+	v.nonNegative("telegram.probe_interval", c.Telegram.ProbeInterval)
+	for i, id := range c.Bot.AdminIDs {
+		if id <= 0 {
+			v.addf(fmt.Sprintf("bot.admin_ids[%d]", i), "invalid user ID %d", id)
+		}
+	}
+	if c.Bot.APIURL != "" {
+		if u, err := url.Parse(c.Bot.APIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.addf("bot.api_url", "invalid URL %q, expected http(s)://host", c.Bot.APIURL)
+		}
+	}
+
+	// Policy
+	for i, rc := range c.Policy.Deny {
+		v.rule(fmt.Sprintf("policy.deny[%d]", i), rc)
+	}
+	for i, rc := range c.Policy.Allow {
+		v.rule(fmt.Sprintf("policy.allow[%d]", i), rc)
+	}
+
+	// Limits and timeouts
+	if c.Quotas.Enabled {
+		// Usage is counted by the stats collector, without it nothing
+		// would be enforced
+		if !c.Stats.Enabled {
+			v.addf("quotas.enabled", "requires stats.enabled")
+		}
+		v.positive("quotas.flush_interval", c.Quotas.FlushInterval)
+	}
+	if c.Limits.MaxConns < 0 {
+		v.addf("limits.max_conns", "must not be negative")
+	}
+	if c.Limits.MaxConnsPerIP < 0 {
+		v.addf("limits.max_conns_per_ip", "must not be negative")
+	}
+	if c.Limits.ConnRatePerIP < 0 {
+		v.addf("limits.conn_rate_per_ip", "must not be negative")
+	}
+	if c.Limits.ConnBurstPerIP < 0 {
+		v.addf("limits.conn_burst_per_ip", "must not be negative")
+	}
+	v.nonNegative("timeouts.handshake", c.Timeouts.Handshake)
+	v.nonNegative("timeouts.idle", c.Timeouts.Idle)
+	v.nonNegative("timeouts.max_lifetime", c.Timeouts.MaxLifetime)
+	v.nonNegative("timeouts.udp_target", c.Timeouts.UDPTarget)
+	if c.Stats.RetentionDays < 0 {
+		v.addf("stats.retention_days", "must not be negative")
+	}
+
+	return v.errs
+}
@@ -1,131 +1,143 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
-)
 
-var (
-	whitelist  = map[string]struct{}{}
-	ipRanges   = []*net.IPNet{}
-	wlMutex    = sync.RWMutex{}
-	rangeMutex = sync.RWMutex{}
+	"github.com/soaska/proxy/internal/policy"
+	"github.com/soaska/proxy/internal/resolver"
 )
 
-func checkHostIPs(wg *sync.WaitGroup, host string) {
-	defer wg.Done()
+// resolvedTTL returns how long an address resolved with the given record
+// TTL stays whitelisted. The record TTL is capped by resolved_ttl and never
+// drops below two refresh intervals, so addresses survive until the next
+// refresh even when it runs late.
+func resolvedTTL(recordTTL time.Duration) time.Duration {
+	c := currentConfig()
+	ttl := recordTTL
+	if ttl <= 0 || (c.ResolvedTTL > 0 && ttl > c.ResolvedTTL) {
+		ttl = c.ResolvedTTL
+	}
+	if floor := 2 * c.UpdateInterval; ttl < floor {
+		ttl = floor
+	}
+	return ttl
+}
 
-	if strings.Contains(host, "/") {
-		_, ipNet, err := net.ParseCIDR(host)
+func checkHostIPs(dns *resolver.Mux, host string, prev *policy.Snapshot) []policy.ResolvedIP {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Resolve the host to get the IPs
+	ips, recordTTL, err := dns.LookupTTL(ctx, host)
+	if err != nil || len(ips) == 0 {
 		if err != nil {
-			log.Printf("Failed to parse CIDR %s: %v", host, err)
-			return
+			log.Printf("Failed to resolve host %s: %v", host, err)
+		} else {
+			log.Println("No IPs found for host", host)
 		}
+		// Keep previous addresses until they expire on their own
+		return prev.Resolved[strings.TrimSuffix(strings.ToLower(host), ".")]
+	}
 
-		rangeMutex.Lock()
-		ipRanges = append(ipRanges, ipNet)
-		rangeMutex.Unlock()
+	ttl := resolvedTTL(recordTTL)
+	expiresAt := time.Now().Add(ttl)
 
-		log.Printf("Added IP range: %s", host)
-		return
+	resolved := make([]policy.ResolvedIP, 0, len(ips))
+	for _, ip := range ips {
+		resolved = append(resolved, policy.ResolvedIP{IP: ip, ExpiresAt: expiresAt})
 	}
 
-	// Resolve the host to get the IPs
-	ips, err := net.LookupHost(host)
-	if err != nil {
-		log.Printf("Failed to resolve host %s: %v", host, err)
-		return
-	}
+	log.Println("Resolved", host, "to", ips, "for", ttl)
+	return resolved
+}
 
-	// No IPs found
-	if len(ips) == 0 {
-		log.Println("No IPs found for host", host)
-		return
-	}
+func checkIPs(wl *policy.Whitelist, dns *resolver.Mux) {
+	prev := wl.Snapshot()
 
-	// Update the whitelist
-	hostWhitelist := make([]net.IP, 0, len(ips))
-	for _, ipStr := range ips {
-		ip, err := net.ResolveIPAddr("ip", ipStr)
+	var hosts []string
+	var ranges []*net.IPNet
+	for _, entry := range currentConfig().Whitelist {
+		if !strings.Contains(entry, "/") {
+			hosts = append(hosts, entry)
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
 		if err != nil {
-			log.Println("Failed to resolve IP:", err)
+			log.Printf("Failed to parse CIDR %s: %v", entry, err)
 			continue
 		}
-		hostWhitelist = append(hostWhitelist, ip.IP)
-
-		wlMutex.Lock()
-		whitelist[ip.String()] = struct{}{}
-		wlMutex.Unlock()
+		ranges = append(ranges, ipNet)
 	}
 
-	log.Println("Resolved", host, "to", hostWhitelist)
-}
-
-func checkIPs() {
-	rangeMutex.Lock()
-	ipRanges = []*net.IPNet{}
-	rangeMutex.Unlock()
+	var mu sync.Mutex
+	resolved := make(map[string][]policy.ResolvedIP, len(hosts))
 
 	wg := &sync.WaitGroup{}
-	for _, host := range cfg.Whitelist {
+	for _, host := range hosts {
 		wg.Add(1)
-		go checkHostIPs(wg, host)
+		go func() {
+			defer wg.Done()
+			ips := checkHostIPs(dns, host, prev)
+			mu.Lock()
+			resolved[host] = ips
+			mu.Unlock()
+		}()
 	}
 	wg.Wait()
 
-	printWhitelist()
+	snap := wl.Replace(hosts, resolved, ranges)
+	printWhitelist(snap)
 }
 
-func printWhitelist() {
-	wlMutex.RLock()
-	ipCount := len(whitelist)
-	wlMutex.RUnlock()
+func printWhitelist(snap *policy.Snapshot) {
+	log.Printf("Whitelist generation %d: %d hosts, %d resolved IPs, %d IP ranges",
+		snap.Generation, len(snap.Hosts), snap.IPCount(), len(snap.Ranges))
 
-	rangeMutex.RLock()
-	rangeCount := len(ipRanges)
-	rangeMutex.RUnlock()
-
-	log.Printf("Whitelist summary: %d resolved IPs, %d IP ranges", ipCount, rangeCount)
-
-	if rangeCount > 0 {
-		rangeMutex.RLock()
+	if len(snap.Ranges) > 0 {
 		log.Println("IP ranges:")
-		for _, ipNet := range ipRanges {
+		for _, ipNet := range snap.Ranges {
 			log.Printf("  - %s", ipNet.String())
 		}
-		rangeMutex.RUnlock()
 	}
 
-	if ipCount > 0 {
-		wlMutex.RLock()
-		log.Println("Resolved IPs:")
-		for ip := range whitelist {
-			log.Printf("  - %s", ip)
+	if len(snap.Resolved) > 0 {
+		hosts := make([]string, 0, len(snap.Resolved))
+		for host := range snap.Resolved {
+			hosts = append(hosts, host)
 		}
-		wlMutex.RUnlock()
-	}
-}
-
-func isIPInRange(ip net.IP) bool {
-	rangeMutex.RLock()
-	defer rangeMutex.RUnlock()
+		sort.Strings(hosts)
 
-	for _, ipNet := range ipRanges {
-		if ipNet.Contains(ip) {
-			return true
+		log.Println("Resolved IPs:")
+		for _, host := range hosts {
+			for _, r := range snap.Resolved[host] {
+				log.Printf("  - %s (%s, expires %s)", r.IP, host, r.ExpiresAt.Format(time.RFC3339))
+			}
 		}
 	}
-	return false
 }
 
-func checkIPsLoop() {
-	checkIPs()
-
-	ticker := time.NewTicker(cfg.UpdateInterval)
-	for range ticker.C {
-		checkIPs()
+// checkIPsLoop refreshes the whitelist every refresh interval, and at once
+// when a reloaded config arrives on reloaded
+func checkIPsLoop(wl *policy.Whitelist, dns *resolver.Mux, reloaded <-chan struct{}) {
+	checkIPs(wl, dns)
+
+	interval := currentConfig().UpdateInterval
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+		case <-reloaded:
+			if c := currentConfig(); c.UpdateInterval != interval {
+				interval = c.UpdateInterval
+				ticker.Reset(interval)
+			}
+		}
+		checkIPs(wl, dns)
 	}
 }